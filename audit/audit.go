@@ -0,0 +1,258 @@
+// Package audit records the queries proxied by the router: who ran which
+// query on which host, how long it took and what it returned.
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lodastack/router/config"
+	"github.com/lodastack/router/models"
+
+	"github.com/lodastack/log"
+)
+
+const (
+	defaultRingSize = 10000
+	defaultFileSize = 100
+	defaultFileNum  = 5
+	queueSize       = 4096
+	// measurement of the records written to the audit namespace
+	measurement = "router.audit"
+)
+
+// records are written to the audit namespace every nsFlushInterval
+var nsFlushInterval = 5 * time.Second
+
+// Record is the audit record of one request
+type Record struct {
+	Time     time.Time `json:"time"`
+	IP       string    `json:"ip"`
+	User     string    `json:"user,omitempty"`
+	Token    string    `json:"token,omitempty"`
+	Endpoint string    `json:"endpoint"`
+	NS       string    `json:"ns,omitempty"`
+	Host     string    `json:"host,omitempty"`
+	Query    string    `json:"query,omitempty"`
+	Duration float64   `json:"duration"`
+	Rows     int64     `json:"rows"`
+	Status   int       `json:"status"`
+	Slow     bool      `json:"slow,omitempty"`
+
+	mu sync.Mutex
+}
+
+// SetNS sets the namespace and query of r, r may be nil
+func (r *Record) SetNS(ns, query string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.NS = ns
+	if query != "" {
+		r.Query = normalize(query)
+	}
+	r.mu.Unlock()
+}
+
+// SetHost sets the influxdb host which served r, r may be nil
+func (r *Record) SetHost(host string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.Host = host
+	r.mu.Unlock()
+}
+
+// AddRows counts the rows returned, r may be nil
+func (r *Record) AddRows(n int64) {
+	if r == nil {
+		return
+	}
+	atomic.AddInt64(&r.Rows, n)
+}
+
+type ctxKey struct{}
+
+// NewContext returns ctx carrying r
+func NewContext(ctx context.Context, r *Record) context.Context {
+	return context.WithValue(ctx, ctxKey{}, r)
+}
+
+// FromContext returns the record of ctx, or nil
+func FromContext(ctx context.Context) *Record {
+	r, _ := ctx.Value(ctxKey{}).(*Record)
+	return r
+}
+
+// LineWriter writes line protocol, timestamps in precision, into a namespace
+type LineWriter func(ns, precision string, lines []byte) error
+
+var (
+	enabled int32
+	queue   chan *Record
+	ring    *recordRing
+	dropped uint64
+)
+
+// Init starts the audit log, write is used for the namespace sink
+func Init(write LineWriter) {
+	c := config.GetConfig().Audit
+	if !c.Enable {
+		return
+	}
+	size := c.RingSize
+	if size <= 0 {
+		size = defaultRingSize
+	}
+	ring = newRecordRing(size)
+
+	fileSize, fileNum := c.FileSize, c.FileNum
+	if fileSize <= 0 {
+		fileSize = defaultFileSize
+	}
+	if fileNum <= 0 {
+		fileNum = defaultFileNum
+	}
+	var file, slow *rotateFile
+	var err error
+	if c.Path != "" {
+		if file, err = newRotateFile(c.Path, int64(fileSize)<<20, fileNum); err != nil {
+			log.Errorf("open audit file %s failed: %s", c.Path, err)
+		}
+	}
+	if c.SlowPath != "" {
+		if slow, err = newRotateFile(c.SlowPath, int64(fileSize)<<20, fileNum); err != nil {
+			log.Errorf("open slow query file %s failed: %s", c.SlowPath, err)
+		}
+	}
+	if c.NS == "" {
+		write = nil
+	}
+
+	queue = make(chan *Record, queueSize)
+	go run(file, slow, c.NS, write)
+	atomic.StoreInt32(&enabled, 1)
+}
+
+// Enabled reports whether records are kept
+func Enabled() bool {
+	return atomic.LoadInt32(&enabled) == 1
+}
+
+// Finish completes r and queues it for the sinks, it never blocks: the
+// record is dropped when the sinks are behind.
+func Finish(r *Record, status int) {
+	if r == nil || !Enabled() {
+		return
+	}
+	r.mu.Lock()
+	r.Status = status
+	r.Duration = float64(time.Since(r.Time)) / float64(time.Millisecond)
+	threshold := config.GetConfig().Audit.SlowThreshold
+	r.Slow = threshold > 0 && r.Duration >= float64(threshold)
+	r.mu.Unlock()
+
+	ring.add(r)
+	select {
+	case queue <- r:
+	default:
+		atomic.AddUint64(&dropped, 1)
+	}
+}
+
+// Dropped is the number of records the sinks missed
+func Dropped() uint64 {
+	return atomic.LoadUint64(&dropped)
+}
+
+func run(file, slow *rotateFile, ns string, write LineWriter) {
+	ticker := time.NewTicker(nsFlushInterval)
+	var batch bytes.Buffer
+	// records of a series at the same timestamp overwrite each other,
+	// every record gets its own nanosecond
+	var last int64
+	for {
+		select {
+		case r := <-queue:
+			r.mu.Lock()
+			line, err := json.Marshal(r)
+			point := recordPoint(r)
+			isSlow := r.Slow
+			r.mu.Unlock()
+			if err != nil {
+				continue
+			}
+			line = append(line, '\n')
+			if file != nil {
+				if _, err := file.Write(line); err != nil {
+					log.Errorf("write audit file failed: %s", err)
+				}
+			}
+			if slow != nil && isSlow {
+				if _, err := slow.Write(line); err != nil {
+					log.Errorf("write slow query file failed: %s", err)
+				}
+			}
+			if write != nil {
+				if point.Timestamp <= last {
+					point.Timestamp = last + 1
+				}
+				last = point.Timestamp
+				batch.WriteString(point.Line())
+				batch.WriteByte('\n')
+			}
+		case <-ticker.C:
+			if batch.Len() == 0 {
+				continue
+			}
+			if err := write(ns, "n", batch.Bytes()); err != nil {
+				log.Errorf("write audit records to %s failed: %s", ns, err)
+			}
+			batch.Reset()
+		}
+	}
+}
+
+func recordPoint(r *Record) *models.Point {
+	tags := map[string]string{"status": strconv.Itoa(r.Status)}
+	// empty tag values are invalid in line protocol
+	for k, v := range map[string]string{"endpoint": r.Endpoint, "ns": r.NS, "host": r.Host, "ip": r.IP} {
+		if v != "" {
+			tags[k] = v
+		}
+	}
+	return &models.Point{
+		Measurement: measurement,
+		Timestamp:   r.Time.UnixNano(),
+		Tags:        tags,
+		Fields: map[string]interface{}{
+			"value": r.Duration,
+			"rows":  r.Rows,
+			"query": r.Query,
+		},
+	}
+}
+
+// normalize collapses the spaces of a query
+func normalize(q string) string {
+	return strings.TrimRight(strings.Join(strings.Fields(q), " "), ";")
+}
+
+// MaskToken keeps the first chars of a token
+func MaskToken(token string) string {
+	if token == "" {
+		return ""
+	}
+	if len(token) <= 4 {
+		return "****"
+	}
+	return token[:4] + "****"
+}
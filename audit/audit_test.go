@@ -0,0 +1,107 @@
+package audit
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lodastack/router/models"
+)
+
+var (
+	sinkOnce sync.Once
+	written  = make(chan []byte, 1)
+)
+
+// sink runs the sinks once, a run reads the package queue, and returns
+// the batches written to the namespace
+func sink(t *testing.T) <-chan []byte {
+	sinkOnce.Do(func() {
+		nsFlushInterval = 10 * time.Millisecond
+		queue = make(chan *Record, 2)
+		go run(nil, nil, "audit.router", func(ns, precision string, lines []byte) error {
+			if ns != "audit.router" || precision != "n" {
+				t.Errorf("written to %s in precision %s", ns, precision)
+			}
+			written <- append([]byte(nil), lines...)
+			return nil
+		})
+	})
+	return written
+}
+
+func TestNSSink(t *testing.T) {
+	written := sink(t)
+	r := &Record{
+		Time:     time.Unix(1600000000, 0),
+		IP:       "10.0.0.1, 10.0.0.2",
+		Endpoint: "query",
+		NS:       "collect.a b",
+		Host:     "influx=1",
+		Query:    `SELECT "value" FROM "cpu.idle" WHERE host = 'a\b'`,
+		Duration: 12.5,
+		Rows:     3,
+		Status:   200,
+	}
+	queue <- r
+
+	var lines []byte
+	select {
+	case lines = <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no audit record written")
+	}
+	lines = bytes.TrimSuffix(lines, []byte("\n"))
+	if bytes.Contains(lines, []byte("\n")) {
+		t.Fatalf("want one line, got %q", lines)
+	}
+	p, err := models.ParseLine(string(lines), "n")
+	if err != nil {
+		t.Fatalf("invalid line %q: %s", lines, err)
+	}
+	if p.Measurement != measurement || p.Timestamp != 1600000000 {
+		t.Errorf("got %s at %d", p.Measurement, p.Timestamp)
+	}
+	wantTags := map[string]string{"status": "200", "endpoint": "query", "ns": r.NS, "host": r.Host, "ip": r.IP}
+	for k, v := range wantTags {
+		if p.Tags[k] != v {
+			t.Errorf("tag %s = %q, want %q", k, p.Tags[k], v)
+		}
+	}
+	if p.Fields["query"] != r.Query {
+		t.Errorf("query = %q, want %q", p.Fields["query"], r.Query)
+	}
+	if p.Fields["value"] != 12.5 {
+		t.Errorf("value = %v", p.Fields["value"])
+	}
+}
+
+func TestNSSinkSameSecond(t *testing.T) {
+	written := sink(t)
+	// same series at the same time
+	now := time.Unix(1600000000, 0)
+	for i := 0; i < 2; i++ {
+		queue <- &Record{Time: now, IP: "10.0.0.1", Endpoint: "query", NS: "collect.a", Status: 200}
+	}
+
+	var lines [][]byte
+	for len(lines) < 2 {
+		select {
+		case batch := <-written:
+			lines = append(lines, bytes.Split(bytes.TrimSuffix(batch, []byte("\n")), []byte("\n"))...)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d audit records written, want 2", len(lines))
+		}
+	}
+	seen := make(map[string]bool)
+	for _, line := range lines {
+		fields := strings.Fields(string(line))
+		ts := fields[len(fields)-1]
+		if seen[ts] {
+			t.Errorf("two records at %s, one overwrites the other", ts)
+		}
+		seen[ts] = true
+	}
+}
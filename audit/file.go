@@ -0,0 +1,70 @@
+package audit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// rotateFile appends to path, which is rotated to path.1, path.2 ... when
+// it grows over size, num files are kept.
+type rotateFile struct {
+	path string
+	size int64
+	num  int
+
+	mu      sync.Mutex
+	f       *os.File
+	written int64
+}
+
+func newRotateFile(path string, size int64, num int) (*rotateFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	r := &rotateFile{path: path, size: size, num: num}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotateFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.written = f, info.Size()
+	return nil
+}
+
+func (r *rotateFile) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.written+int64(len(b)) > r.size && r.written > 0 {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(b)
+	r.written += int64(n)
+	return n, err
+}
+
+func (r *rotateFile) rotate() error {
+	r.f.Close()
+	for i := r.num - 1; i > 0; i-- {
+		from := fmt.Sprintf("%s.%d", r.path, i-1)
+		if i == 1 {
+			from = r.path
+		}
+		os.Rename(from, fmt.Sprintf("%s.%d", r.path, i))
+	}
+	return r.open()
+}
@@ -0,0 +1,89 @@
+package audit
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// recordRing keeps the latest records for search
+type recordRing struct {
+	mu      sync.RWMutex
+	records []*Record
+	next    int
+	full    bool
+}
+
+func newRecordRing(size int) *recordRing {
+	return &recordRing{records: make([]*Record, size)}
+}
+
+func (r *recordRing) add(rec *Record) {
+	r.mu.Lock()
+	r.records[r.next] = rec
+	r.next++
+	if r.next == len(r.records) {
+		r.next, r.full = 0, true
+	}
+	r.mu.Unlock()
+}
+
+// Filter selects records, zero fields match everything
+type Filter struct {
+	NS       string
+	Endpoint string
+	IP       string
+	User     string
+	Host     string
+	// Query is a substring of the query
+	Query string
+	Slow  bool
+	// MinDuration in milliseconds
+	MinDuration float64
+	Since       time.Time
+	Limit       int
+}
+
+func (f Filter) match(r *Record) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case f.NS != "" && r.NS != f.NS,
+		f.Endpoint != "" && r.Endpoint != f.Endpoint,
+		f.IP != "" && r.IP != f.IP,
+		f.User != "" && r.User != f.User,
+		f.Host != "" && r.Host != f.Host,
+		f.Query != "" && !strings.Contains(r.Query, f.Query),
+		f.Slow && !r.Slow,
+		r.Duration < f.MinDuration,
+		!f.Since.IsZero() && r.Time.Before(f.Since):
+		return false
+	}
+	return true
+}
+
+// Search returns the recent records matching f, the latest first
+func Search(f Filter) []*Record {
+	res := []*Record{}
+	if ring == nil {
+		return res
+	}
+	ring.mu.RLock()
+	defer ring.mu.RUnlock()
+	n := ring.next
+	if ring.full {
+		n = len(ring.records)
+	}
+	for i := 0; i < n; i++ {
+		idx := (ring.next - 1 - i + len(ring.records)) % len(ring.records)
+		rec := ring.records[idx]
+		if !f.match(rec) {
+			continue
+		}
+		res = append(res, rec)
+		if f.Limit > 0 && len(res) >= f.Limit {
+			break
+		}
+	}
+	return res
+}
@@ -0,0 +1,43 @@
+package catalog
+
+// builtin is the catalog used without a catalog file
+func builtin() Catalog {
+	return Catalog{
+		Categories: map[string]string{
+			"cpu":    "CPU",
+			"mem":    "Memory",
+			"net":    "Network",
+			"disk":   "Disk",
+			"fs":     "FileSystem",
+			"io":     "IO",
+			"port":   "Port",
+			"plugin": "Plugin",
+			"proc":   "Process",
+			"run":    "SDK",
+		},
+		Entries: []Entry{
+			{Pattern: "RUN.net.traffic.*", Detail: Detail{Unit: "bit"}},
+			{Pattern: "cpu.idle", Detail: Detail{Unit: "%"}},
+			{Pattern: "mem.buffers", Detail: Detail{Unit: "MB"}},
+			{Pattern: "mem.cached", Detail: Detail{Unit: "MB"}},
+			{Pattern: "mem.free", Detail: Detail{Unit: "MB"}},
+			{Pattern: "mem.total", Detail: Detail{Unit: "MB"}},
+			{Pattern: "mem.used", Detail: Detail{Unit: "MB"}},
+			{Pattern: "mem.used.percent", Detail: Detail{Unit: "%"}},
+			{Pattern: "fs.inodes.used.percent", Detail: Detail{Unit: "%"}},
+			{Pattern: "fs.space.used.percent", Detail: Detail{Unit: "%"}},
+			{Pattern: "fs.space.used", Detail: Detail{Unit: "MB"}},
+			{Pattern: "fs.space.free", Detail: Detail{Unit: "MB"}},
+			{Pattern: "fs.space.total", Detail: Detail{Unit: "MB"}},
+			{Pattern: "fs.files.rw", Detail: Detail{Mode: "bar"}},
+			{Pattern: "disk.io.util", Detail: Detail{Unit: "%"}},
+			{Pattern: "disk.io.read_requests", Detail: Detail{Unit: "IOPS"}},
+			{Pattern: "disk.io.write_requests", Detail: Detail{Unit: "IOPS"}},
+			{Pattern: "time.offset", Detail: Detail{Unit: "s"}},
+			{Pattern: "net.out", Detail: Detail{Unit: "bit"}},
+			{Pattern: "net.in", Detail: Detail{Unit: "bit"}},
+			{Pattern: "kernel.files.allocated.percent", Detail: Detail{Unit: "%"}},
+			{Pattern: "run.ping.loss", Detail: Detail{Unit: "%"}},
+		},
+	}
+}
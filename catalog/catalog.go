@@ -0,0 +1,294 @@
+// Package catalog holds the metadata of measurements: units, display mode,
+// default aggregation and fill, type and category. Entries come from the
+// catalog file, which the admin API edits, and the registry collects, with
+// built-in defaults below them.
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/lodastack/router/config"
+	"github.com/lodastack/router/loda"
+
+	"github.com/lodastack/log"
+)
+
+// metric types
+const (
+	Gauge   = "gauge"
+	Counter = "counter"
+)
+
+// OtherCategory is the category of measurements without one
+const OtherCategory = "Other"
+
+// Detail is the metadata of a measurement
+type Detail struct {
+	Unit        string `json:"unit"`
+	Mode        string `json:"mode"`
+	Aggregate   string `json:"aggregate"`
+	Fill        string `json:"fill"`
+	Description string `json:"description,omitempty"`
+	Type        string `json:"type,omitempty"`
+	Category    string `json:"category,omitempty"`
+}
+
+// Entry is the metadata of the measurements matching Pattern: a name, or
+// a glob like RUN.net.traffic.*
+type Entry struct {
+	Pattern string `json:"pattern"`
+	Detail
+}
+
+// Catalog is the content of the catalog file. Categories maps the first
+// part of measurement names, like mem of mem.used, to a category.
+type Catalog struct {
+	Categories map[string]string `json:"categories"`
+	Entries    []Entry           `json:"entries"`
+}
+
+var (
+	mu      sync.RWMutex
+	current = builtin()
+	// defaults answer the names the file and the registry do not know
+	defaults = builtin()
+	// updateMu serializes the edits
+	updateMu sync.Mutex
+)
+
+// Init loads the catalog file, the built-in catalog is kept when there is
+// no file yet. Names the file does not know still get the built-in
+// metadata.
+func Init() {
+	p := config.GetConfig().Catalog.Path
+	if p == "" {
+		return
+	}
+	b, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Errorf("read catalog %s failed: %s", p, err)
+		return
+	}
+	var c Catalog
+	if err := json.Unmarshal(b, &c); err != nil {
+		log.Errorf("parse catalog %s failed: %s", p, err)
+		return
+	}
+	if err := validate(c.Entries); err != nil {
+		log.Errorf("invalid catalog %s: %s", p, err)
+		return
+	}
+	mu.Lock()
+	current = c
+	mu.Unlock()
+}
+
+// Get returns a copy of the catalog
+func Get() Catalog {
+	mu.RLock()
+	defer mu.RUnlock()
+	c := Catalog{
+		Categories: make(map[string]string, len(current.Categories)),
+		Entries:    make([]Entry, len(current.Entries)),
+	}
+	for k, v := range current.Categories {
+		c.Categories[k] = v
+	}
+	copy(c.Entries, current.Entries)
+	return c
+}
+
+// Put adds or replaces the entry with the pattern of e and saves the catalog
+func Put(e Entry) error {
+	if err := validate([]Entry{e}); err != nil {
+		return err
+	}
+	return update(func(c *Catalog) error {
+		for i := range c.Entries {
+			if c.Entries[i].Pattern == e.Pattern {
+				c.Entries[i] = e
+				return nil
+			}
+		}
+		c.Entries = append(c.Entries, e)
+		return nil
+	})
+}
+
+// Delete removes the entry of pattern and saves the catalog
+func Delete(pattern string) error {
+	return update(func(c *Catalog) error {
+		for i := range c.Entries {
+			if c.Entries[i].Pattern == pattern {
+				c.Entries = append(c.Entries[:i], c.Entries[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("no entry %s", pattern)
+	})
+}
+
+// PutCategory maps the first part of measurement names to category, an
+// empty category removes it.
+func PutCategory(prefix, category string) error {
+	if prefix == "" {
+		return fmt.Errorf("empty prefix")
+	}
+	return update(func(c *Catalog) error {
+		if c.Categories == nil {
+			c.Categories = make(map[string]string)
+		}
+		if category == "" {
+			delete(c.Categories, strings.ToLower(prefix))
+		} else {
+			c.Categories[strings.ToLower(prefix)] = category
+		}
+		return nil
+	})
+}
+
+func update(f func(c *Catalog) error) error {
+	updateMu.Lock()
+	defer updateMu.Unlock()
+	c := Get()
+	if err := f(&c); err != nil {
+		return err
+	}
+	if err := save(c); err != nil {
+		return err
+	}
+	mu.Lock()
+	current = c
+	mu.Unlock()
+	return nil
+}
+
+// save writes the catalog file, it is replaced at once
+func save(c Catalog) error {
+	p := config.GetConfig().Catalog.Path
+	if p == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func validate(entries []Entry) error {
+	for _, e := range entries {
+		if e.Pattern == "" {
+			return fmt.Errorf("empty pattern")
+		}
+		if _, err := path.Match(e.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %s", e.Pattern)
+		}
+		if e.Type != "" && e.Type != Gauge && e.Type != Counter {
+			return fmt.Errorf("type of %s must be %s or %s", e.Pattern, Gauge, Counter)
+		}
+	}
+	return nil
+}
+
+// Lookup returns the metadata of measurement name. Catalog entries come
+// first, an exact name before the longest matching pattern, then the
+// registry collect with the longest matching name, then the built-in
+// entries.
+func Lookup(name string, collects []loda.CollectMetric) Detail {
+	mu.RLock()
+	c := current
+	mu.RUnlock()
+
+	d, ok := lookupEntries(name, c.Entries)
+	if !ok {
+		d, ok = lookupCollects(name, collects)
+	}
+	if !ok {
+		d, _ = lookupEntries(name, defaults.Entries)
+	}
+	if d.Category == "" {
+		d.Category = category(name, c.Categories, defaults.Categories)
+	}
+	return d
+}
+
+func lookupEntries(name string, entries []Entry) (Detail, bool) {
+	lower := strings.ToLower(name)
+	best := -1
+	for i, e := range entries {
+		if strings.ToLower(e.Pattern) == lower {
+			return e.Detail, true
+		}
+		if !strings.ContainsAny(e.Pattern, "*?[") {
+			continue
+		}
+		if ok, _ := path.Match(e.Pattern, name); ok && (best < 0 || len(e.Pattern) > len(entries[best].Pattern)) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return Detail{}, false
+	}
+	return entries[best].Detail, true
+}
+
+func lookupCollects(name string, collects []loda.CollectMetric) (Detail, bool) {
+	var best *loda.CollectMetric
+	for i := range collects {
+		m := &collects[i]
+		if m.Name == "" || !strings.HasPrefix(name, m.Name) {
+			continue
+		}
+		if best == nil || len(m.Name) > len(best.Name) {
+			best = m
+		}
+	}
+	if best == nil {
+		return Detail{}, false
+	}
+	return Detail{
+		Unit:        best.Unit,
+		Description: best.Comment,
+		Type:        best.MetricType,
+		Category:    best.Category,
+	}, true
+}
+
+// category maps the first part of name with the first of categories
+// knowing it, Other if none does
+func category(name string, categories ...map[string]string) string {
+	first := strings.ToLower(strings.SplitN(name, ".", 2)[0])
+	for _, m := range categories {
+		if c, ok := m[first]; ok {
+			return c
+		}
+	}
+	return OtherCategory
+}
+
+// Sorted returns the entries sorted by pattern
+func (c Catalog) Sorted() []Entry {
+	entries := make([]Entry, len(c.Entries))
+	copy(entries, c.Entries)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Pattern < entries[j].Pattern })
+	return entries
+}
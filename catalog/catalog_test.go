@@ -0,0 +1,60 @@
+package catalog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lodastack/router/config"
+	"github.com/lodastack/router/loda"
+)
+
+func TestLookupFallsBackToBuiltin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "catalog.json")
+	if err := ioutil.WriteFile(file, []byte(`{
+		"categories": {"mem": "RAM", "app": "Application"},
+		"entries": [
+			{"pattern": "mem.used", "unit": "GB"},
+			{"pattern": "app.*", "unit": "ms", "type": "gauge"}
+		]
+	}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, "router.toml")
+	if err := ioutil.WriteFile(conf, []byte(fmt.Sprintf("[catalog]\npath = %q\n", file)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.LoadConfig(conf); err != nil {
+		t.Fatal(err)
+	}
+	Init()
+	defer func() { current = builtin() }()
+
+	collects := []loda.CollectMetric{{Name: "svc.", Comment: "service", MetricType: Counter, Category: "Service"}}
+	tests := []struct {
+		name string
+		want Detail
+	}{
+		// the file wins over the built-in entry and category
+		{name: "mem.used", want: Detail{Unit: "GB", Category: "RAM"}},
+		{name: "app.latency", want: Detail{Unit: "ms", Type: Gauge, Category: "Application"}},
+		// names the file does not know keep the built-in metadata
+		{name: "mem.free", want: Detail{Unit: "MB", Category: "RAM"}},
+		{name: "cpu.idle", want: Detail{Unit: "%", Category: "CPU"}},
+		{name: "RUN.net.traffic.in", want: Detail{Unit: "bit", Category: "SDK"}},
+		{name: "svc.requests", want: Detail{Description: "service", Type: Counter, Category: "Service"}},
+		{name: "unknown.metric", want: Detail{Category: OtherCategory}},
+	}
+	for _, tt := range tests {
+		if got := Lookup(tt.name, collects); got != tt.want {
+			t.Errorf("Lookup(%s) = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
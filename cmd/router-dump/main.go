@@ -0,0 +1,212 @@
+// router-dump exports a namespace of the router as gzip line protocol and
+// imports such files back, to back up data or move it between clusters.
+//
+//	router-dump export -ns collect.xxx -start 2020-01-01T00:00:00Z -o xxx.lp.gz
+//	router-dump import -ns collect.xxx -rate 5000 xxx.lp.gz
+//
+// Both go through the admin API of the router, /export and /import.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lodastack/router/requests"
+)
+
+var (
+	router string
+	token  string
+	ns     string
+)
+
+func commonFlags(fs *flag.FlagSet) {
+	fs.StringVar(&router, "router", "http://127.0.0.1:8002", "router HTTP address")
+	fs.StringVar(&token, "token", os.Getenv("ROUTER_TOKEN"), "admin token, ROUTER_TOKEN by default")
+	fs.StringVar(&ns, "ns", "", "namespace")
+}
+
+// tagFlags collects the repeated -tag flags
+type tagFlags []string
+
+func (t *tagFlags) String() string { return strings.Join(*t, ",") }
+
+func (t *tagFlags) Set(v string) error {
+	if !strings.Contains(v, "=") {
+		return fmt.Errorf("tag must be key=value")
+	}
+	*t = append(*t, v)
+	return nil
+}
+
+// parseTime reads RFC3339 times, or durations before now like 24h
+func parseTime(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func do(req *http.Request) (*http.Response, error) {
+	if token != "" {
+		req.Header.Set("AuthToken", token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, requests.StatusError(resp.StatusCode, body)
+	}
+	return resp, nil
+}
+
+func export(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	commonFlags(fs)
+	measurement := fs.String("measurement", "", "measurement name, or regexp with -regexp, all if empty")
+	regexp := fs.Bool("regexp", false, "measurement is a regexp")
+	start := fs.String("start", "24h", "start time, RFC3339 or a duration before now")
+	end := fs.String("end", "", "end time, RFC3339 or a duration before now, now if empty")
+	out := fs.String("o", "", "output file, <ns>.lp.gz if empty, - for stdout")
+	var tags tagFlags
+	fs.Var(&tags, "tag", "key=value series filter, may be repeated")
+	fs.Parse(args)
+	if ns == "" {
+		return fmt.Errorf("need -ns")
+	}
+
+	params := url.Values{}
+	params.Set("ns", ns)
+	params.Set("measurement", *measurement)
+	if *regexp {
+		params.Set("regexp", "true")
+	}
+	st, err := parseTime(*start)
+	if err != nil {
+		return fmt.Errorf("invalid -start: %s", err)
+	}
+	params.Set("starttime", strconv.FormatInt(st.UnixNano()/1e6, 10))
+	if *end != "" {
+		et, err := parseTime(*end)
+		if err != nil {
+			return fmt.Errorf("invalid -end: %s", err)
+		}
+		params.Set("endtime", strconv.FormatInt(et.UnixNano()/1e6, 10))
+	}
+	for _, tag := range tags {
+		params.Add("tag", tag)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(router, "/")+"/export?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		if *out == "" {
+			*out = ns + ".lp.gz"
+		}
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		return err
+	}
+	if *out != "-" {
+		fmt.Fprintf(os.Stderr, "exported %d bytes to %s\n", n, *out)
+	}
+	return nil
+}
+
+func importFiles(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	commonFlags(fs)
+	rate := fs.Int("rate", 5000, "max points written per second")
+	precision := fs.String("precision", "s", "timestamp precision of the files")
+	fs.Parse(args)
+	if ns == "" || fs.NArg() == 0 {
+		return fmt.Errorf("need -ns and files")
+	}
+
+	params := url.Values{}
+	params.Set("ns", ns)
+	params.Set("rate", strconv.Itoa(*rate))
+	params.Set("precision", *precision)
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(router, "/")+"/import?"+params.Encode(), f)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		resp, err := do(req)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("import %s failed: %s", path, err)
+		}
+		var result struct {
+			Data struct {
+				Written int `json:"written"`
+				Skipped int `json:"skipped"`
+			} `json:"data"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("import %s: invalid response: %s", path, err)
+		}
+		fmt.Printf("%s: written %d points, skipped %d lines\n", path, result.Data.Written, result.Data.Skipped)
+	}
+	return nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s export|import [flags] [file...]\n", os.Args[0])
+	}
+	if len(os.Args) < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "export":
+		err = export(os.Args[2:])
+	case "import":
+		err = importFiles(os.Args[2:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+}
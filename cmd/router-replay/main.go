@@ -0,0 +1,239 @@
+// router-replay re-publishes recorded points files into the router, to
+// reproduce incidents against a staging cluster.
+//
+// Files are either JSONL, one models.Points batch per line, or InfluxDB
+// line protocol. Batches are published to NSQ topics, as agents do, or to
+// the router HTTP ingest path.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lodastack/router/models"
+	"github.com/lodastack/router/requests"
+
+	"github.com/bitly/go-nsq"
+)
+
+const maxLineSize = 64 * 1024 * 1024
+
+var (
+	format    = flag.String("format", "", "input format, jsonl or line, guessed from the file extension if empty")
+	target    = flag.String("target", "http", "publish to nsq or http")
+	nsqdAddr  = flag.String("nsqd", "127.0.0.1:4150", "nsqd TCP address")
+	router    = flag.String("router", "http://127.0.0.1:8002", "router HTTP address")
+	token     = flag.String("token", os.Getenv("ROUTER_TOKEN"), "admin token of the http target, ROUTER_TOKEN by default")
+	ns        = flag.String("ns", "", "namespace of line protocol files, overrides the database of jsonl batches")
+	precision = flag.String("precision", "n", "timestamp precision of line protocol files")
+	batchSize = flag.Int("batch", 500, "points per batch of line protocol files")
+	rate      = flag.Float64("rate", 1000, "max points published per second, 0 is unlimited")
+	shift     = flag.Duration("shift", 0, "duration added to every timestamp")
+	rebase    = flag.Bool("rebase", false, "shift timestamps so the first point is at now")
+)
+
+type publisher interface {
+	Publish(ns string, points models.Points) error
+	Stop()
+}
+
+type nsqPublisher struct {
+	producer *nsq.Producer
+}
+
+// Publish uses the namespace as topic, as the router consumes it
+func (p *nsqPublisher) Publish(ns string, points models.Points) error {
+	body, err := json.Marshal(points)
+	if err != nil {
+		return err
+	}
+	return p.producer.Publish(ns, body)
+}
+
+func (p *nsqPublisher) Stop() {
+	p.producer.Stop()
+}
+
+type httpPublisher struct {
+	addr  string
+	token string
+}
+
+func (p *httpPublisher) Publish(ns string, points models.Points) error {
+	body, err := json.Marshal(points)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/write?ns=%s", p.addr, url.QueryEscape(ns)), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.token != "" {
+		req.Header.Set("AuthToken", p.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	return requests.StatusError(resp.StatusCode, data)
+}
+
+func (p *httpPublisher) Stop() {}
+
+// replayer publishes batches with time shifting and rate control
+type replayer struct {
+	pub    publisher
+	offset int64
+	based  bool
+
+	start time.Time
+	sent  int
+}
+
+func (r *replayer) replay(points models.Points) error {
+	if *ns != "" {
+		points.Database = *ns
+	}
+	if points.Database == "" {
+		return fmt.Errorf("batch without database, use -ns")
+	}
+	if len(points.Points) == 0 {
+		return nil
+	}
+
+	if !r.based {
+		r.offset = int64(shift.Seconds())
+		if *rebase {
+			r.offset += time.Now().Unix() - points.Points[0].Timestamp
+		}
+		r.based = true
+		r.start = time.Now()
+	}
+	for _, p := range points.Points {
+		p.Timestamp += r.offset
+	}
+
+	if err := r.pub.Publish(points.Database, points); err != nil {
+		return err
+	}
+
+	r.sent += len(points.Points)
+	if *rate > 0 {
+		expected := time.Duration(float64(r.sent) / *rate * float64(time.Second))
+		if wait := expected - time.Since(r.start); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+	return nil
+}
+
+func (r *replayer) replayFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fileFormat := *format
+	if fileFormat == "" {
+		fileFormat = "line"
+		if ext := filepath.Ext(path); ext == ".jsonl" || ext == ".json" {
+			fileFormat = "jsonl"
+		}
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	batch := models.Points{Precision: "s"}
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if fileFormat == "jsonl" {
+			var points models.Points
+			if err := json.Unmarshal([]byte(line), &points); err != nil {
+				fmt.Fprintf(os.Stderr, "%s:%d: skip invalid batch: %s\n", path, n, err)
+				continue
+			}
+			if err := r.replay(points); err != nil {
+				return err
+			}
+			continue
+		}
+
+		p, err := models.ParseLine(line, *precision)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s:%d: skip invalid line: %s\n", path, n, err)
+			continue
+		}
+		batch.Points = append(batch.Points, p)
+		if len(batch.Points) >= *batchSize {
+			if err := r.replay(batch); err != nil {
+				return err
+			}
+			batch.Points = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(batch.Points) > 0 {
+		return r.replay(batch)
+	}
+	return nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] file...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var pub publisher
+	switch *target {
+	case "nsq":
+		producer, err := nsq.NewProducer(*nsqdAddr, nsq.NewConfig())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "connect nsqd failed: %s\n", err)
+			os.Exit(1)
+		}
+		pub = &nsqPublisher{producer: producer}
+	case "http":
+		pub = &httpPublisher{addr: strings.TrimSuffix(*router, "/"), token: *token}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown target %s\n", *target)
+		os.Exit(2)
+	}
+	defer pub.Stop()
+
+	r := &replayer{pub: pub}
+	for _, path := range flag.Args() {
+		if err := r.replayFile(path); err != nil {
+			fmt.Fprintf(os.Stderr, "replay %s failed: %s\n", path, err)
+			pub.Stop()
+			os.Exit(1)
+		}
+	}
+	fmt.Printf("replayed %d points\n", r.sent)
+}
@@ -6,8 +6,12 @@ import (
 	"os"
 	"runtime"
 
+	"github.com/lodastack/router/audit"
+	"github.com/lodastack/router/catalog"
 	"github.com/lodastack/router/config"
+	"github.com/lodastack/router/jobs"
 	"github.com/lodastack/router/loda"
+	"github.com/lodastack/router/migrate"
 	"github.com/lodastack/router/query"
 	"github.com/lodastack/router/worker"
 
@@ -52,6 +56,10 @@ func main() {
 	}
 	go httpd.Start()
 	loda.Init(config.GetConfig().Reg.Link, config.GetConfig().Reg.ExpireDur)
+	audit.Init(worker.WriteLines)
+	catalog.Init()
+	jobs.Init()
+	migrate.Init()
 	go loda.PurgeAll()
 	select {}
 }
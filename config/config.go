@@ -6,6 +6,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/lodastack/router/requests"
+
 	"github.com/BurntSushi/toml"
 	"github.com/bitly/go-nsq"
 	"github.com/lodastack/log"
@@ -18,13 +20,24 @@ var (
 )
 
 type Config struct {
-	Com       CommonConfig   `toml:"common"`
-	Reg       RegistryConfig `toml:"registry"`
-	Usg       UsageConfig    `toml:"usage"`
-	LinkStats LinkStasConfig `toml:"linkstats"`
-	IDC       []IDCConfig    `toml:"idc"`
-	Nsq       NsqConfig      `toml:"nsq"`
-	Log       LogConfig      `toml:"log"`
+	Com       CommonConfig    `toml:"common"`
+	Reg       RegistryConfig  `toml:"registry"`
+	InfluxDB  InfluxDBConfig  `toml:"influxdb"`
+	Usg       UsageConfig     `toml:"usage"`
+	LinkStats LinkStasConfig  `toml:"linkstats"`
+	IDC       []IDCConfig     `toml:"idc"`
+	Nsq       NsqConfig       `toml:"nsq"`
+	Dedup     DedupConfig     `toml:"dedup"`
+	Timestamp TimestampConfig `toml:"timestamp"`
+	Cache     CacheConfig     `toml:"cache"`
+	Query     QueryConfig     `toml:"query"`
+	Limits    LimitsConfig    `toml:"limits"`
+	Admin     AdminConfig     `toml:"admin"`
+	Audit     AuditConfig     `toml:"audit"`
+	Catalog   CatalogConfig   `toml:"catalog"`
+	Jobs      JobsConfig      `toml:"jobs"`
+	Migrate   MigrateConfig   `toml:"migrate"`
+	Log       LogConfig       `toml:"log"`
 }
 
 type CommonConfig struct {
@@ -46,8 +59,32 @@ type LogConfig struct {
 }
 
 type RegistryConfig struct {
-	Link      string `toml:"link"`
-	ExpireDur int    `toml:"expireDur"`
+	Link      string           `toml:"link"`
+	ExpireDur int              `toml:"expireDur"`
+	HTTP      HTTPClientConfig `toml:"http"`
+}
+
+// InfluxDBConfig tunes the HTTP clients used to talk to InfluxDB.
+type InfluxDBConfig struct {
+	// ReadStrategy picks the host of a read, "roundrobin" or "latency"
+	ReadStrategy string `toml:"readStrategy"`
+	// FailCooldown is how long a failed host is avoided, in milliseconds,
+	// doubled every consecutive failure.
+	FailCooldown int `toml:"failCooldown"`
+
+	Query HTTPClientConfig `toml:"query"`
+	Write HTTPClientConfig `toml:"write"`
+}
+
+// HTTPClientConfig tunes the HTTP client of one backend.
+type HTTPClientConfig struct {
+	// Timeout of a call in milliseconds
+	Timeout             int `toml:"timeout"`
+	MaxIdleConnsPerHost int `toml:"maxIdleConnsPerHost"`
+	Retries             int `toml:"retries"`
+	// Backoff before the first retry in milliseconds
+	Backoff int  `toml:"backoff"`
+	Gzip    bool `toml:"gzip"`
 }
 
 type UsageConfig struct {
@@ -76,6 +113,133 @@ type NsqConfig struct {
 	TopicPrefix         string   `toml:"topicPrefix"`
 }
 
+// DedupConfig controls suppression of points batches that were already
+// written, e.g. NSQ redeliveries after a timeout or agent retries.
+type DedupConfig struct {
+	Enable bool `toml:"enable"`
+	// Window is how long a written batch is remembered, in seconds.
+	Window int `toml:"window"`
+	// Size is the max number of fingerprints remembered per namespace.
+	Size int `toml:"size"`
+}
+
+// TimestampConfig is the policy for points whose timestamp is too far
+// from the router's clock.
+type TimestampConfig struct {
+	Enable bool `toml:"enable"`
+	// MaxPast is the max age of a point, in seconds.
+	MaxPast int64 `toml:"maxPast"`
+	// MaxFuture is the max skew ahead of the router clock, in seconds.
+	MaxFuture int64 `toml:"maxFuture"`
+	// Action is one of "reject", "clamp" or "rewrite".
+	Action string `toml:"action"`
+}
+
+// QueryConfig restricts the InfluxQL proxied by /query
+type QueryConfig struct {
+	// AllowStatements are the statement kinds accepted, a kind matches
+	// an entry it starts with, e.g. "SHOW" allows every SHOW statement.
+	AllowStatements []string `toml:"allowStatements"`
+	// Timeout of a query in milliseconds, the query is killed on
+	// InfluxDB when it passes
+	Timeout int `toml:"timeout"`
+	// EndpointTimeouts overrides Timeout by endpoint, like "query2"
+	EndpointTimeouts map[string]int `toml:"endpointTimeouts"`
+	// NSTimeouts overrides the endpoint timeouts by namespace
+	NSTimeouts map[string]int `toml:"nsTimeouts"`
+}
+
+// LimitsConfig are the guardrails of /query, NS entries override the
+// non zero fields of Default by namespace. Admin requests bypass them.
+type LimitsConfig struct {
+	Default LimitConfig            `toml:"default"`
+	NS      map[string]LimitConfig `toml:"ns"`
+}
+
+// LimitConfig is one set of query limits, 0 is no limit
+type LimitConfig struct {
+	// MaxRawRange is the max time range of a raw SELECT, in seconds
+	MaxRawRange int64 `toml:"maxRawRange"`
+	// MaxSeries is the max number of series returned
+	MaxSeries int64 `toml:"maxSeries"`
+	// MaxPoints is the max number of points returned
+	MaxPoints int64 `toml:"maxPoints"`
+	// MaxGroupByRatio is the max time range / GROUP BY interval
+	MaxGroupByRatio int64 `toml:"maxGroupByRatio"`
+}
+
+// CacheConfig is the query result cache config
+type CacheConfig struct {
+	Enable bool `toml:"enable"`
+	// Size is the max number of cached results
+	Size int `toml:"size"`
+	// TTL of results in seconds
+	TTL int `toml:"ttl"`
+	// RecentTTL in seconds is used for open ended ranges and ranges
+	// ending in the last RecentWindow seconds, whose data still changes.
+	RecentTTL    int `toml:"recentTTL"`
+	RecentWindow int `toml:"recentWindow"`
+}
+
+// AuditConfig is the query audit log config
+type AuditConfig struct {
+	Enable bool `toml:"enable"`
+	// Path of the audit file, no file if empty
+	Path string `toml:"path"`
+	// FileSize in MB before the file is rotated, FileNum files are kept
+	FileSize int `toml:"fileSize"`
+	FileNum  int `toml:"fileNum"`
+	// NS is the loda namespace the records are also written to
+	NS string `toml:"ns"`
+	// SlowThreshold in milliseconds, slower queries go to SlowPath too
+	SlowThreshold int    `toml:"slowThreshold"`
+	SlowPath      string `toml:"slowPath"`
+	// RingSize is the number of recent records kept for search
+	RingSize int `toml:"ringSize"`
+}
+
+// CatalogConfig is the measurement metadata catalog config
+type CatalogConfig struct {
+	// Path of the catalog JSON file, edits through the admin API are
+	// saved to it. The built-in catalog is used if empty.
+	Path string `toml:"path"`
+}
+
+// JobsConfig is the config of the maintenance jobs, like deletes
+type JobsConfig struct {
+	// Path is the directory jobs are saved in to survive restarts, they
+	// are only kept in memory if empty.
+	Path string `toml:"path"`
+	// ClusterConcurrency is the number of statements run at once on an
+	// influxdb cluster.
+	ClusterConcurrency int `toml:"clusterConcurrency"`
+	// Retention in hours of finished jobs
+	Retention int `toml:"retention"`
+	// ConfirmSecret signs the confirm tokens of dry runs, so that all
+	// routers accept them. Random per process if empty.
+	ConfirmSecret string `toml:"confirmSecret"`
+}
+
+// MigrateConfig is the config of the history copies when the registry
+// routes a namespace to another cluster
+type MigrateConfig struct {
+	Enable bool `toml:"enable"`
+	// Path is the directory migrations are saved in with their
+	// checkpoints, they restart from scratch if empty.
+	Path string `toml:"path"`
+	// History in hours copied before the route change
+	History int `toml:"history"`
+	// Rate is the max points copied per second by a migration
+	Rate int `toml:"rate"`
+}
+
+// AdminConfig protects the admin API
+type AdminConfig struct {
+	// Token must be sent in the AuthToken header of admin requests,
+	// the admin API is disabled if empty.
+	Token string `toml:"token"`
+}
+
 func (this NsqConfig) GetNsqConfig() *nsq.Config {
 	nsqConfig := nsq.NewConfig()
 	nsqConfig.MaxAttempts = this.MaxAttempts
@@ -87,6 +251,21 @@ func (this NsqConfig) GetNsqConfig() *nsq.Config {
 	return nsqConfig
 }
 
+func (this HTTPClientConfig) GetOptions() requests.Options {
+	timeout := this.Timeout
+	if timeout < 0 {
+		// a call without timeout is not configurable
+		timeout = 0
+	}
+	return requests.Options{
+		Timeout:             time.Duration(timeout) * time.Millisecond,
+		MaxIdleConnsPerHost: this.MaxIdleConnsPerHost,
+		Retries:             this.Retries,
+		Backoff:             time.Duration(this.Backoff) * time.Millisecond,
+		Gzip:                this.Gzip,
+	}
+}
+
 func Reload() {
 	err := LoadConfig(configPath)
 	if err != nil {
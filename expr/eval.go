@@ -0,0 +1,366 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Point is a non null value of a series, Time is a unix timestamp
+type Point struct {
+	Time  int64
+	Value float64
+}
+
+// Series is a tagged series of points sorted by time
+type Series struct {
+	Tags   map[string]string
+	Points []Point
+}
+
+// elementwise functions of one series
+var mathFuncs = map[string]func(float64) float64{
+	"abs":   math.Abs,
+	"ceil":  math.Ceil,
+	"floor": math.Floor,
+	"round": math.Round,
+	"sqrt":  math.Sqrt,
+	"exp":   math.Exp,
+	"ln":    math.Log,
+	"log2":  math.Log2,
+	"log10": math.Log10,
+}
+
+// functions aggregating all series into one
+var aggFuncs = map[string]bool{
+	"sum":   true,
+	"avg":   true,
+	"min":   true,
+	"max":   true,
+	"count": true,
+}
+
+func checkCall(c *Call) error {
+	switch {
+	case mathFuncs[c.Name] != nil, c.Name == "rate", c.Name == "derivative":
+		if len(c.Args) != 1 {
+			return fmt.Errorf("%s takes 1 argument", c.Name)
+		}
+	case c.Name == "min", c.Name == "max":
+		// min(x) aggregates, min(x, y) compares
+		if len(c.Args) != 1 && len(c.Args) != 2 {
+			return fmt.Errorf("%s takes 1 or 2 arguments", c.Name)
+		}
+	case aggFuncs[c.Name]:
+		if len(c.Args) != 1 {
+			return fmt.Errorf("%s takes 1 argument", c.Name)
+		}
+	default:
+		return fmt.Errorf("unknown function %s", c.Name)
+	}
+	return nil
+}
+
+// value is a scalar or a set of series. pinned are the tags fixed by the
+// selectors of the set, they are ignored when matching series.
+type value struct {
+	scalar bool
+	num    float64
+	series []Series
+	pinned map[string]bool
+}
+
+// Eval evaluates n, data holds the series of every selector by its String.
+func Eval(n Node, data map[string][]Series) ([]Series, error) {
+	v, err := eval(n, data)
+	if err != nil {
+		return nil, err
+	}
+	if v.scalar {
+		return nil, fmt.Errorf("expression has no series")
+	}
+	return v.series, nil
+}
+
+func eval(n Node, data map[string][]Series) (value, error) {
+	switch n := n.(type) {
+	case *Number:
+		return value{scalar: true, num: n.Val}, nil
+	case *Selector:
+		pinned := make(map[string]bool)
+		for k := range n.Pinned() {
+			pinned[k] = true
+		}
+		return value{series: data[n.String()], pinned: pinned}, nil
+	case *Binary:
+		lhs, err := eval(n.LHS, data)
+		if err != nil {
+			return value{}, err
+		}
+		rhs, err := eval(n.RHS, data)
+		if err != nil {
+			return value{}, err
+		}
+		return binary(n.Op, lhs, rhs)
+	case *Call:
+		return call(n, data)
+	}
+	return value{}, fmt.Errorf("unknown node %s", n)
+}
+
+func call(c *Call, data map[string][]Series) (value, error) {
+	if err := checkCall(c); err != nil {
+		return value{}, err
+	}
+	args := make([]value, len(c.Args))
+	for i, a := range c.Args {
+		v, err := eval(a, data)
+		if err != nil {
+			return value{}, err
+		}
+		args[i] = v
+	}
+	if len(args) == 2 {
+		op := byte('<')
+		if c.Name == "max" {
+			op = '>'
+		}
+		return binary(op, args[0], args[1])
+	}
+
+	arg := args[0]
+	if f := mathFuncs[c.Name]; f != nil {
+		if arg.scalar {
+			return value{scalar: true, num: f(arg.num)}, nil
+		}
+		return mapPoints(arg, f), nil
+	}
+	if arg.scalar {
+		return value{}, fmt.Errorf("%s needs a series", c.Name)
+	}
+	switch c.Name {
+	case "rate":
+		return deltas(arg, true), nil
+	case "derivative":
+		return deltas(arg, false), nil
+	}
+	return aggregate(c.Name, arg), nil
+}
+
+func mapPoints(v value, f func(float64) float64) value {
+	res := value{pinned: v.pinned}
+	for _, s := range v.series {
+		out := Series{Tags: s.Tags}
+		for _, p := range s.Points {
+			if val := f(p.Value); valid(val) {
+				out.Points = append(out.Points, Point{Time: p.Time, Value: val})
+			}
+		}
+		res.series = append(res.series, out)
+	}
+	return res
+}
+
+// deltas is the per second change between points, counter resets are
+// skipped by rate.
+func deltas(v value, counter bool) value {
+	res := value{pinned: v.pinned}
+	for _, s := range v.series {
+		out := Series{Tags: s.Tags}
+		for i := 1; i < len(s.Points); i++ {
+			prev, cur := s.Points[i-1], s.Points[i]
+			d := cur.Value - prev.Value
+			if counter && d < 0 {
+				continue
+			}
+			out.Points = append(out.Points, Point{Time: cur.Time, Value: d / float64(cur.Time-prev.Time)})
+		}
+		res.series = append(res.series, out)
+	}
+	return res
+}
+
+// aggregate merges all series into one per timestamp, keeping the tags
+// shared by every series.
+func aggregate(fn string, v value) value {
+	type acc struct {
+		val float64
+		n   int
+	}
+	accs := make(map[int64]*acc)
+	for _, s := range v.series {
+		for _, p := range s.Points {
+			a, ok := accs[p.Time]
+			if !ok {
+				accs[p.Time] = &acc{val: p.Value, n: 1}
+				continue
+			}
+			switch fn {
+			case "min":
+				a.val = math.Min(a.val, p.Value)
+			case "max":
+				a.val = math.Max(a.val, p.Value)
+			default:
+				a.val += p.Value
+			}
+			a.n++
+		}
+	}
+	out := Series{Tags: commonTags(v.series)}
+	for t, a := range accs {
+		val := a.val
+		switch fn {
+		case "avg":
+			val /= float64(a.n)
+		case "count":
+			val = float64(a.n)
+		}
+		out.Points = append(out.Points, Point{Time: t, Value: val})
+	}
+	sort.Slice(out.Points, func(i, j int) bool { return out.Points[i].Time < out.Points[j].Time })
+	res := value{pinned: v.pinned}
+	if len(v.series) > 0 {
+		res.series = []Series{out}
+	}
+	return res
+}
+
+func binary(op byte, lhs, rhs value) (value, error) {
+	switch {
+	case lhs.scalar && rhs.scalar:
+		val, ok := apply(op, lhs.num, rhs.num)
+		if !ok {
+			return value{}, fmt.Errorf("invalid scalar %g %c %g", lhs.num, op, rhs.num)
+		}
+		return value{scalar: true, num: val}, nil
+	case rhs.scalar:
+		return mapPoints(lhs, func(v float64) float64 {
+			val, _ := apply(op, v, rhs.num)
+			return val
+		}), nil
+	case lhs.scalar:
+		return mapPoints(rhs, func(v float64) float64 {
+			val, _ := apply(op, lhs.num, v)
+			return val
+		}), nil
+	}
+
+	res := value{pinned: make(map[string]bool)}
+	for k := range lhs.pinned {
+		res.pinned[k] = true
+	}
+	for k := range rhs.pinned {
+		res.pinned[k] = true
+	}
+
+	// a single series matches every series of the other side
+	if len(rhs.series) == 1 && len(lhs.series) != 1 {
+		for _, l := range lhs.series {
+			res.series = append(res.series, join(op, l, rhs.series[0], l.Tags))
+		}
+		return res, nil
+	}
+	if len(lhs.series) == 1 && len(rhs.series) != 1 {
+		for _, r := range rhs.series {
+			res.series = append(res.series, join(op, lhs.series[0], r, r.Tags))
+		}
+		return res, nil
+	}
+
+	rights := make(map[string]Series, len(rhs.series))
+	for _, r := range rhs.series {
+		sig := signature(r.Tags, res.pinned)
+		if _, ok := rights[sig]; ok {
+			return value{}, fmt.Errorf("many series match {%s}, filter or aggregate the operands", sig)
+		}
+		rights[sig] = r
+	}
+	for _, l := range lhs.series {
+		r, ok := rights[signature(l.Tags, res.pinned)]
+		if !ok {
+			continue
+		}
+		res.series = append(res.series, join(op, l, r, commonTags([]Series{l, r})))
+	}
+	return res, nil
+}
+
+// join applies op to the points of l and r at the same time
+func join(op byte, l, r Series, tags map[string]string) Series {
+	out := Series{Tags: tags}
+	i, j := 0, 0
+	for i < len(l.Points) && j < len(r.Points) {
+		lp, rp := l.Points[i], r.Points[j]
+		switch {
+		case lp.Time < rp.Time:
+			i++
+		case lp.Time > rp.Time:
+			j++
+		default:
+			if val, ok := apply(op, lp.Value, rp.Value); ok {
+				out.Points = append(out.Points, Point{Time: lp.Time, Value: val})
+			}
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+// apply returns false for results which are not finite
+func apply(op byte, a, b float64) (float64, bool) {
+	var val float64
+	switch op {
+	case '+':
+		val = a + b
+	case '-':
+		val = a - b
+	case '*':
+		val = a * b
+	case '/':
+		val = a / b
+	case '%':
+		val = math.Mod(a, b)
+	case '<':
+		val = math.Min(a, b)
+	case '>':
+		val = math.Max(a, b)
+	}
+	return val, valid(val)
+}
+
+func valid(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+// signature identifies the tags of a series except the ignored ones
+func signature(tags map[string]string, ignore map[string]bool) string {
+	kv := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if !ignore[k] {
+			kv = append(kv, k+"="+v)
+		}
+	}
+	sort.Strings(kv)
+	return strings.Join(kv, ",")
+}
+
+// commonTags returns the tags with the same value in all series
+func commonTags(series []Series) map[string]string {
+	if len(series) == 0 {
+		return nil
+	}
+	tags := make(map[string]string)
+	for k, v := range series[0].Tags {
+		tags[k] = v
+	}
+	for _, s := range series[1:] {
+		for k, v := range tags {
+			if s.Tags[k] != v {
+				delete(tags, k)
+			}
+		}
+	}
+	return tags
+}
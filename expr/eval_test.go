@@ -0,0 +1,109 @@
+package expr
+
+import (
+	"reflect"
+	"testing"
+)
+
+func series(tags map[string]string, values ...float64) Series {
+	s := Series{Tags: tags}
+	for i, v := range values {
+		s.Points = append(s.Points, Point{Time: int64(i), Value: v})
+	}
+	return s
+}
+
+func TestEval(t *testing.T) {
+	data := map[string][]Series{
+		"used":           {series(map[string]string{"host": "a"}, 1, 2), series(map[string]string{"host": "b"}, 3, 4)},
+		"total":          {series(map[string]string{"host": "a"}, 4, 4), series(map[string]string{"host": "b"}, 8, 8)},
+		"one":            {series(map[string]string{"host": "c"}, 10, 20)},
+		`used{host="a"}`: {series(map[string]string{"host": "a"}, 1, 2)},
+		`used{host="b"}`: {series(map[string]string{"host": "b"}, 3, 4)},
+		"counter":        {series(nil, 1, 3, 0, 2)},
+		"zero":           {series(map[string]string{"host": "c"}, 0, 1)},
+		`used{dc="x"}`: {
+			series(map[string]string{"host": "a", "dc": "x"}, 1),
+			series(map[string]string{"host": "b", "dc": "x"}, 1),
+		},
+		"disk": {
+			series(map[string]string{"host": "a", "dc": "x"}, 1),
+			series(map[string]string{"host": "a", "dc": "y"}, 1),
+		},
+	}
+	tests := []struct {
+		expr string
+		want []Series
+		err  bool
+	}{
+		{
+			expr: "used / total * 100",
+			want: []Series{series(map[string]string{"host": "a"}, 25, 50), series(map[string]string{"host": "b"}, 37.5, 50)},
+		},
+		{
+			// a single series matches every series of the other side
+			expr: "used + one",
+			want: []Series{series(map[string]string{"host": "a"}, 11, 22), series(map[string]string{"host": "b"}, 13, 24)},
+		},
+		{
+			// pinned tags are ignored when matching
+			expr: `used{host="b"} - used{host="a"}`,
+			want: []Series{series(map[string]string{}, 2, 2)},
+		},
+		{expr: "sum(used)", want: []Series{series(map[string]string{}, 4, 6)}},
+		{expr: "avg(used)", want: []Series{series(map[string]string{}, 2, 3)}},
+		{expr: "count(used)", want: []Series{series(map[string]string{}, 2, 2)}},
+		{expr: "max(used)", want: []Series{series(map[string]string{}, 3, 4)}},
+		{expr: "min(used, 2)", want: []Series{series(map[string]string{"host": "a"}, 1, 2), series(map[string]string{"host": "b"}, 2, 2)}},
+		{expr: "abs(-1 * one)", want: []Series{series(map[string]string{"host": "c"}, 10, 20)}},
+		{
+			// the counter reset is skipped
+			expr: "rate(counter)",
+			want: []Series{{Points: []Point{{Time: 1, Value: 2}, {Time: 3, Value: 2}}}},
+		},
+		{
+			// division by zero drops the point
+			expr: "one / zero",
+			want: []Series{{Tags: map[string]string{"host": "c"}, Points: []Point{{Time: 1, Value: 20}}}},
+		},
+
+		{expr: "1 + 2", err: true},
+		{expr: "rate(1)", err: true},
+		{expr: "1 / 0", err: true},
+		{
+			// dc is pinned, both disk series match host=a
+			expr: `used{dc="x"} + disk`,
+			err:  true,
+		},
+	}
+	for _, tt := range tests {
+		n, err := Parse(tt.expr)
+		if err != nil {
+			t.Errorf("Parse(%q): %s", tt.expr, err)
+			continue
+		}
+		got, err := Eval(n, data)
+		if tt.err {
+			if err == nil {
+				t.Errorf("Eval(%q) = %v, want error", tt.expr, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Eval(%q): %s", tt.expr, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Eval(%q) = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestEvalCallWithoutArgs(t *testing.T) {
+	// calls built by hand are checked like parsed ones
+	for _, name := range []string{"sum", "abs", "rate", "foo"} {
+		if _, err := Eval(&Call{Name: name}, nil); err == nil {
+			t.Errorf("Eval(%s()) want error", name)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+// Package expr evaluates arithmetic over metric series, like
+// mem.used / mem.total * 100 or cpu.idle{host="a"} - cpu.idle{host="b"}.
+package expr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Node is a node of an expression
+type Node interface {
+	String() string
+}
+
+// Number is a scalar
+type Number struct {
+	Val float64
+}
+
+func (n *Number) String() string { return strconv.FormatFloat(n.Val, 'g', -1, 64) }
+
+// Matcher filters the series of a selector by a tag
+type Matcher struct {
+	Key   string
+	Op    string // =, !=, =~ or !~
+	Value string
+}
+
+func (m Matcher) String() string {
+	if m.Op == "=~" || m.Op == "!~" {
+		return fmt.Sprintf("%s%s/%s/", m.Key, m.Op, m.Value)
+	}
+	return fmt.Sprintf("%s%s%q", m.Key, m.Op, m.Value)
+}
+
+// Selector is the series of a measurement, optionally filtered by tags
+type Selector struct {
+	Measurement string
+	Matchers    []Matcher
+}
+
+func (s *Selector) String() string {
+	if len(s.Matchers) == 0 {
+		return s.Measurement
+	}
+	ms := make([]string, len(s.Matchers))
+	for i, m := range s.Matchers {
+		ms[i] = m.String()
+	}
+	return s.Measurement + "{" + strings.Join(ms, ",") + "}"
+}
+
+// Pinned returns the tags the selector fixes to one value
+func (s *Selector) Pinned() map[string]string {
+	pinned := make(map[string]string)
+	for _, m := range s.Matchers {
+		if m.Op == "=" {
+			pinned[m.Key] = m.Value
+		}
+	}
+	return pinned
+}
+
+// Binary is "LHS Op RHS"
+type Binary struct {
+	Op  byte
+	LHS Node
+	RHS Node
+}
+
+func (b *Binary) String() string {
+	return "(" + b.LHS.String() + " " + string(b.Op) + " " + b.RHS.String() + ")"
+}
+
+// Call is a function call
+type Call struct {
+	Name string
+	Args []Node
+}
+
+func (c *Call) String() string {
+	args := make([]string, len(c.Args))
+	for i, a := range c.Args {
+		args[i] = a.String()
+	}
+	return c.Name + "(" + strings.Join(args, ", ") + ")"
+}
+
+// Selectors returns the distinct selectors of n
+func Selectors(n Node) []*Selector {
+	var sels []*Selector
+	seen := make(map[string]bool)
+	var walk func(Node)
+	walk = func(n Node) {
+		switch n := n.(type) {
+		case *Selector:
+			if !seen[n.String()] {
+				seen[n.String()] = true
+				sels = append(sels, n)
+			}
+		case *Binary:
+			walk(n.LHS)
+			walk(n.RHS)
+		case *Call:
+			for _, a := range n.Args {
+				walk(a)
+			}
+		}
+	}
+	walk(n)
+	return sels
+}
+
+// Parse parses an expression
+func Parse(s string) (Node, error) {
+	p := &parser{src: []rune(s)}
+	n, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.src) {
+		return nil, p.errorf("unexpected %q", string(p.src[p.pos]))
+	}
+	return n, nil
+}
+
+type parser struct {
+	src []rune
+	pos int
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s at char %d", fmt.Sprintf(format, args...), p.pos+1)
+}
+
+func (p *parser) skipSpace() {
+	for p.pos < len(p.src) && unicode.IsSpace(p.src[p.pos]) {
+		p.pos++
+	}
+}
+
+// peek returns the next non space rune, 0 at the end
+func (p *parser) peek() rune {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *parser) expect(r rune) error {
+	if p.peek() != r {
+		return p.errorf("expected %q", string(r))
+	}
+	p.pos++
+	return nil
+}
+
+// expr := term (("+" | "-") term)*
+func (p *parser) parseExpr() (Node, error) {
+	lhs, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return lhs, nil
+		}
+		p.pos++
+		rhs, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &Binary{Op: byte(op), LHS: lhs, RHS: rhs}
+	}
+}
+
+// term := unary (("*" | "/" | "%") unary)*
+func (p *parser) parseTerm() (Node, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' {
+			return lhs, nil
+		}
+		p.pos++
+		rhs, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &Binary{Op: byte(op), LHS: lhs, RHS: rhs}
+	}
+}
+
+// unary := "-" unary | primary
+func (p *parser) parseUnary() (Node, error) {
+	if p.peek() == '-' {
+		p.pos++
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if num, ok := n.(*Number); ok {
+			return &Number{Val: -num.Val}, nil
+		}
+		return &Binary{Op: '*', LHS: &Number{Val: -1}, RHS: n}, nil
+	}
+	return p.parsePrimary()
+}
+
+// primary := number | "(" expr ")" | name "(" args ")" | selector
+func (p *parser) parsePrimary() (Node, error) {
+	r := p.peek()
+	switch {
+	case r == 0:
+		return nil, p.errorf("unexpected end")
+	case r == '(':
+		p.pos++
+		n, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return n, p.expect(')')
+	case unicode.IsDigit(r) || r == '.':
+		return p.parseNumber()
+	case r == '"':
+		name, err := p.parseQuoted('"')
+		if err != nil {
+			return nil, err
+		}
+		return p.parseSelector(name)
+	case isNameChar(r):
+		name := p.parseName()
+		if p.peek() == '(' {
+			return p.parseCall(name)
+		}
+		return p.parseSelector(name)
+	}
+	return nil, p.errorf("unexpected %q", string(r))
+}
+
+func (p *parser) parseNumber() (Node, error) {
+	start := p.pos
+	for p.pos < len(p.src) && (unicode.IsDigit(p.src[p.pos]) || strings.ContainsRune(".eE", p.src[p.pos]) ||
+		(p.pos > start && strings.ContainsRune("eE", p.src[p.pos-1]) && strings.ContainsRune("+-", p.src[p.pos]))) {
+		p.pos++
+	}
+	v, err := strconv.ParseFloat(string(p.src[start:p.pos]), 64)
+	if err != nil {
+		return nil, p.errorf("invalid number %s", string(p.src[start:p.pos]))
+	}
+	return &Number{Val: v}, nil
+}
+
+func (p *parser) parseName() string {
+	start := p.pos
+	for p.pos < len(p.src) && isNameChar(p.src[p.pos]) {
+		p.pos++
+	}
+	return string(p.src[start:p.pos])
+}
+
+func (p *parser) parseQuoted(quote rune) (string, error) {
+	p.pos++
+	var b strings.Builder
+	for p.pos < len(p.src) {
+		r := p.src[p.pos]
+		p.pos++
+		switch r {
+		case quote:
+			return b.String(), nil
+		case '\\':
+			if p.pos < len(p.src) {
+				b.WriteRune(p.src[p.pos])
+				p.pos++
+			}
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return "", p.errorf("unterminated string")
+}
+
+func (p *parser) parseCall(name string) (Node, error) {
+	p.pos++
+	c := &Call{Name: strings.ToLower(name)}
+	if p.peek() == ')' {
+		p.pos++
+		return c, checkCall(c)
+	}
+	for {
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		c.Args = append(c.Args, arg)
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ')':
+			p.pos++
+			return c, checkCall(c)
+		default:
+			return nil, p.errorf("expected , or )")
+		}
+	}
+}
+
+// selector := name ["{" matcher ("," matcher)* "}"]
+func (p *parser) parseSelector(name string) (Node, error) {
+	s := &Selector{Measurement: name}
+	if p.peek() != '{' {
+		return s, nil
+	}
+	p.pos++
+	for {
+		if p.peek() == '}' {
+			p.pos++
+			return s, nil
+		}
+		var m Matcher
+		if p.peek() == '"' {
+			key, err := p.parseQuoted('"')
+			if err != nil {
+				return nil, err
+			}
+			m.Key = key
+		} else {
+			m.Key = p.parseName()
+		}
+		if m.Key == "" {
+			return nil, p.errorf("expected tag key")
+		}
+		p.skipSpace()
+		for _, op := range []string{"=~", "!~", "!=", "="} {
+			if strings.HasPrefix(string(p.src[p.pos:]), op) {
+				m.Op = op
+				p.pos += len(op)
+				break
+			}
+		}
+		if m.Op == "" {
+			return nil, p.errorf("expected =, !=, =~ or !~")
+		}
+		var err error
+		switch p.peek() {
+		case '"', '\'':
+			m.Value, err = p.parseQuoted(p.src[p.pos])
+		case '/':
+			m.Value, err = p.parseQuoted('/')
+		default:
+			m.Value = p.parseName()
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.Matchers = append(s.Matchers, m)
+		if p.peek() == ',' {
+			p.pos++
+		}
+	}
+}
+
+func isNameChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.' || r == ':'
+}
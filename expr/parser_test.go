@@ -0,0 +1,75 @@
+package expr
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+		err  bool
+	}{
+		{expr: "mem.used / mem.total * 100", want: "((mem.used / mem.total) * 100)"},
+		{expr: "1 + 2 * 3", want: "(1 + (2 * 3))"},
+		{expr: "(1 + 2) * 3", want: "((1 + 2) * 3)"},
+		{expr: "-cpu.idle", want: "(-1 * cpu.idle)"},
+		{expr: "-2", want: "-2"},
+		{expr: "1.5e3", want: "1500"},
+		{expr: `cpu.idle{host="a", dc!="b"}`, want: `cpu.idle{host="a",dc!="b"}`},
+		{expr: `cpu.idle{host=~"web.*"}`, want: `cpu.idle{host=~/web.*/}`},
+		{expr: `"cpu idle"{"the host"="a"}`, want: `cpu idle{the host="a"}`},
+		{expr: "SUM(cpu.idle)", want: "sum(cpu.idle)"},
+		{expr: "max(a, b)", want: "max(a, b)"},
+		{expr: "abs(a - b)", want: "abs((a - b))"},
+
+		{expr: "", err: true},
+		{expr: "1 +", err: true},
+		{expr: "(1 + 2", err: true},
+		{expr: "1 2", err: true},
+		{expr: `cpu{host="a"`, err: true},
+		{expr: `cpu{host="a}`, err: true},
+		{expr: "sum()", err: true},
+		{expr: "foo()", err: true},
+		{expr: "foo(a)", err: true},
+		{expr: "abs(a, b)", err: true},
+		{expr: "min(a, b, c)", err: true},
+		{expr: "rate()", err: true},
+		{expr: "sum(a b)", err: true},
+	}
+	for _, tt := range tests {
+		n, err := Parse(tt.expr)
+		if tt.err {
+			if err == nil {
+				t.Errorf("Parse(%q) = %s, want error", tt.expr, n)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q): %s", tt.expr, err)
+			continue
+		}
+		if got := n.String(); got != tt.want {
+			t.Errorf("Parse(%q) = %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestSelectors(t *testing.T) {
+	n, err := Parse(`a / b + a * sum(c{x="1"})`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sels := Selectors(n)
+	var got []string
+	for _, s := range sels {
+		got = append(got, s.String())
+	}
+	want := []string{"a", "b", `c{x="1"}`}
+	if len(got) != len(want) {
+		t.Fatalf("Selectors = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Selectors = %v, want %v", got, want)
+		}
+	}
+}
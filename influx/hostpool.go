@@ -0,0 +1,124 @@
+package influx
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lodastack/router/config"
+)
+
+const (
+	// StrategyRoundRobin spreads reads over the healthy hosts
+	StrategyRoundRobin = "roundrobin"
+	// StrategyLatency prefers the healthy host with the lowest latency
+	StrategyLatency = "latency"
+
+	defaultFailCooldown = 10 * time.Second
+	maxFailCooldown     = 5 * time.Minute
+	// weight of the last sample in the latency moving average
+	latencyWeight = 0.3
+)
+
+// hostStat is the passive health of one influxdb host, learned from the
+// result of the reads sent to it.
+type hostStat struct {
+	failures  uint
+	downUntil time.Time
+	latency   time.Duration
+}
+
+type hostPool struct {
+	mu    sync.Mutex
+	stats map[string]*hostStat
+	next  int
+}
+
+var pool = &hostPool{stats: make(map[string]*hostStat)}
+
+// order returns hosts in the order reads should try them: healthy hosts
+// first by strategy, then the hosts marked down, soonest back first.
+func (p *hostPool) order(hosts []string) []string {
+	if len(hosts) < 2 {
+		return hosts
+	}
+	now := time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var up, down []string
+	for _, h := range hosts {
+		if s, ok := p.stats[h]; ok && now.Before(s.downUntil) {
+			down = append(down, h)
+		} else {
+			up = append(up, h)
+		}
+	}
+
+	switch config.GetConfig().InfluxDB.ReadStrategy {
+	case StrategyLatency:
+		sort.SliceStable(up, func(i, j int) bool {
+			return p.latency(up[i]) < p.latency(up[j])
+		})
+	default:
+		if len(up) > 1 {
+			p.next++
+			n := p.next % len(up)
+			up = append(up[n:], up[:n]...)
+		}
+	}
+	sort.SliceStable(down, func(i, j int) bool {
+		return p.stats[down[i]].downUntil.Before(p.stats[down[j]].downUntil)
+	})
+	return append(up, down...)
+}
+
+// latency of a host never read from is 0, so it gets probed
+func (p *hostPool) latency(host string) time.Duration {
+	if s, ok := p.stats[host]; ok {
+		return s.latency
+	}
+	return 0
+}
+
+func (p *hostPool) stat(host string) *hostStat {
+	s, ok := p.stats[host]
+	if !ok {
+		s = new(hostStat)
+		p.stats[host] = s
+	}
+	return s
+}
+
+func (p *hostPool) success(host string, latency time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.stat(host)
+	s.failures = 0
+	s.downUntil = time.Time{}
+	if s.latency == 0 {
+		s.latency = latency
+	} else {
+		s.latency = time.Duration(latencyWeight*float64(latency) + (1-latencyWeight)*float64(s.latency))
+	}
+}
+
+// failure marks host down, the cooldown doubles every consecutive failure
+func (p *hostPool) failure(host string) {
+	cooldown := time.Duration(config.GetConfig().InfluxDB.FailCooldown) * time.Millisecond
+	if cooldown <= 0 {
+		cooldown = defaultFailCooldown
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.stat(host)
+	s.failures++
+	for i := uint(1); i < s.failures && cooldown < maxFailCooldown; i++ {
+		cooldown *= 2
+	}
+	if cooldown > maxFailCooldown {
+		cooldown = maxFailCooldown
+	}
+	s.downUntil = time.Now().Add(cooldown)
+}
@@ -0,0 +1,39 @@
+package influx
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHostPoolCooldown(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{failures: 1, want: defaultFailCooldown},
+		{failures: 2, want: 2 * defaultFailCooldown},
+		{failures: 3, want: 4 * defaultFailCooldown},
+		{failures: 6, want: maxFailCooldown},
+		{failures: 64, want: maxFailCooldown},
+		{failures: 1000, want: maxFailCooldown},
+	}
+	for _, tt := range tests {
+		p := &hostPool{stats: make(map[string]*hostStat)}
+		start := time.Now()
+		for i := 0; i < tt.failures; i++ {
+			p.failure("a")
+		}
+		cooldown := p.stats["a"].downUntil.Sub(start)
+		if cooldown < tt.want || cooldown > tt.want+time.Second {
+			t.Errorf("%d failures: cooldown %s, want %s", tt.failures, cooldown, tt.want)
+		}
+		if hosts := p.order([]string{"a", "b"}); hosts[0] != "b" {
+			t.Errorf("%d failures: order %v, want the failed host last", tt.failures, hosts)
+		}
+
+		p.success("a", time.Millisecond)
+		if !p.stats["a"].downUntil.IsZero() || p.stats["a"].failures != 0 {
+			t.Errorf("%d failures: host still down after a success", tt.failures)
+		}
+	}
+}
@@ -1,11 +1,18 @@
 package influx
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"net/url"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/lodastack/router/audit"
 	"github.com/lodastack/router/config"
 	"github.com/lodastack/router/loda"
 	"github.com/lodastack/router/models"
@@ -16,6 +23,27 @@ import (
 
 var limit Fixed
 
+var (
+	clientsOnce sync.Once
+	queryClient *requests.Client
+	writeClient *requests.Client
+	// execClient has no timeout, it runs statements which change data and
+	// long reads bounded by their caller. It does not retry.
+	execClient *requests.Client
+)
+
+// clients are built on first use, after the config is loaded
+func initClients() {
+	clientsOnce.Do(func() {
+		queryClient = requests.NewClient(config.GetConfig().InfluxDB.Query.GetOptions())
+		writeClient = requests.NewClient(config.GetConfig().InfluxDB.Write.GetOptions())
+		execClient = requests.NewClient(requests.Options{
+			Timeout:             -1,
+			MaxIdleConnsPerHost: config.GetConfig().InfluxDB.Query.MaxIdleConnsPerHost,
+		})
+	})
+}
+
 const defaultWorkerNum = 10000
 
 func init() {
@@ -77,7 +105,7 @@ func ParseParams(params map[string]string) string {
 }
 
 func Query(hosts []string, params map[string]string, ip string) (*ResultsObj, error) {
-	resp, err := QueryRaw(hosts, params, ip)
+	resp, err := QueryRaw(context.Background(), hosts, params, ip)
 	if err != nil {
 		return nil, err
 	}
@@ -93,32 +121,210 @@ func Query(hosts []string, params map[string]string, ip string) (*ResultsObj, er
 	return &rs, nil
 }
 
-func QueryRaw(hosts []string, params map[string]string, ip string) (*requests.Resp, error) {
+// ErrTimeout is returned when a query runs longer than the timeout of
+// the query client, the query is killed on the host.
+var ErrTimeout = fmt.Errorf("influxdb query timeout")
 
-	var host string
+// QueryRaw reads from a healthy host of hosts, failing over to the next
+// one on connection errors or 5xx. When ctx is done before the response,
+// the query is killed on the host.
+func QueryRaw(ctx context.Context, hosts []string, params map[string]string, ip string) (*requests.Resp, error) {
 	var resp *requests.Resp
 	var err error
 
-	if len(hosts) > 0 {
-		host = hosts[0]
-	} else {
+	if len(hosts) == 0 {
 		return resp, fmt.Errorf("no db config")
 	}
 
+	for _, host := range pool.order(hosts) {
+		if resp, err = queryHost(ctx, host, params, ip); err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return resp, ctx.Err()
+		}
+		if err == ErrTimeout {
+			// another host would take as long
+			return resp, err
+		}
+		log.Warningf("query influxdb %s failed, try next host: %s", host, err)
+	}
+	if err != nil {
+		return resp, err
+	}
+
+	if resp.Status/100 != 2 {
+		return resp, fmt.Errorf("Influxdb returned invalid status code: %v", resp.Status)
+	}
+	return resp, nil
+}
+
+// QueryAll runs a statement which changes data, like DROP or DELETE, on
+// every host, since each of them holds a full replica.
+func QueryAll(hosts []string, params map[string]string, ip string) (*requests.Resp, error) {
+	return QueryAllContext(context.Background(), hosts, params, ip)
+}
+
+// QueryAllContext is QueryAll, the statement has no deadline and is only
+// killed when ctx is done
+func QueryAllContext(ctx context.Context, hosts []string, params map[string]string, ip string) (*requests.Resp, error) {
+	var resp *requests.Resp
+	var err error
+
+	if len(hosts) == 0 {
+		return resp, fmt.Errorf("no db config")
+	}
+
+	for _, host := range hosts {
+		if resp, err = execHost(ctx, host, params, ip); err != nil {
+			return resp, err
+		}
+		if resp.Status/100 != 2 {
+			return resp, fmt.Errorf("Influxdb %s returned invalid status code: %v", host, resp.Status)
+		}
+	}
+	return resp, nil
+}
+
+func execHost(ctx context.Context, host string, params map[string]string, ip string) (*requests.Resp, error) {
+	fullUrl := fmt.Sprintf("%s%s", GetQueryUrl(host), ParseParams(params))
+	log.Infof("exec [%s] ip [%s]", fullUrl, ip)
+
+	initClients()
+	resp, err := execClient.Get(ctx, fullUrl)
+	if ctx.Err() != nil {
+		go killQuery(host, params)
+		return nil, ctx.Err()
+	}
+	return resp, err
+}
+
+func queryHost(ctx context.Context, host string, params map[string]string, ip string) (*requests.Resp, error) {
 	fullUrl := fmt.Sprintf("%s%s", GetQueryUrl(host), ParseParams(params))
 	log.Infof("query [%s] ip [%s]", fullUrl, ip)
 
-	resp, err = requests.Get(fullUrl)
+	initClients()
+	// the client timeout applies anyway, bound ctx by it to tell it apart
+	// from a failure of the host
+	qctx, cancel := context.WithTimeout(ctx, queryClient.Timeout())
+	defer cancel()
+	deadline, _ := qctx.Deadline()
+	start := time.Now()
+	resp, err := queryClient.Get(qctx, fullUrl)
+	// the header timeout of the transport may fire before qctx is done
+	if qctx.Err() != nil || (err != nil && !time.Now().Before(deadline)) {
+		// the caller gave up or the query timed out, the host is not to blame
+		go killQuery(host, params)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, ErrTimeout
+	}
+	if err == nil && resp.Status >= 500 {
+		err = fmt.Errorf("Influxdb returned invalid status code: %v", resp.Status)
+	}
 	if err != nil {
+		pool.failure(host)
 		return resp, err
 	}
+	pool.success(host, time.Since(start))
+	audit.FromContext(ctx).SetHost(host)
+	return resp, nil
+}
 
-	if resp.Status/100 != 2 {
-		return resp, fmt.Errorf("Influxdb returned invalid status code: %v", resp.Status)
+// QueryStream reads from a healthy host like QueryRaw and returns the
+// unread response, the caller must close its body. Canceling ctx aborts
+// the read of the body.
+func QueryStream(ctx context.Context, hosts []string, params map[string]string, ip string) (*http.Response, error) {
+	initClients()
+	return queryStream(ctx, queryClient, queryClient.Timeout(), hosts, params, ip)
+}
+
+// QueryStreamTimeout is QueryStream with the wait for the header bounded
+// by headerTimeout instead of the query client timeout
+func QueryStreamTimeout(ctx context.Context, hosts []string, params map[string]string, ip string, headerTimeout time.Duration) (*http.Response, error) {
+	initClients()
+	return queryStream(ctx, execClient, headerTimeout, hosts, params, ip)
+}
+
+func queryStream(ctx context.Context, client *requests.Client, headerTimeout time.Duration, hosts []string, params map[string]string, ip string) (*http.Response, error) {
+	var resp *http.Response
+	var err error
+	var queried string
+
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no db config")
 	}
+
+	var cancel context.CancelFunc
+	for _, host := range pool.order(hosts) {
+		fullUrl := fmt.Sprintf("%s%s", GetQueryUrl(host), ParseParams(params))
+		log.Infof("query [%s] ip [%s]", fullUrl, ip)
+
+		// headerTimeout bounds the wait for the header, the body is only
+		// bounded by ctx
+		var hctx context.Context
+		hctx, cancel = context.WithCancel(ctx)
+		timer := time.AfterFunc(headerTimeout, cancel)
+		start := time.Now()
+		resp, err = client.GetStream(hctx, fullUrl)
+		if !timer.Stop() || ctx.Err() != nil {
+			// the caller gave up or the query timed out, the host is not
+			// to blame
+			cancel()
+			if err == nil {
+				resp.Body.Close()
+			}
+			go killQuery(host, params)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, ErrTimeout
+		}
+		if err == nil && resp.StatusCode < 500 {
+			pool.success(host, time.Since(start))
+			audit.FromContext(ctx).SetHost(host)
+			queried = host
+			break
+		}
+		cancel()
+		if err == nil {
+			err = statusError(resp)
+		}
+		pool.failure(host)
+		log.Warningf("query influxdb %s failed, try next host: %s", host, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		cancel()
+		return nil, statusError(resp)
+	}
+	resp.Body = &cancelBody{ReadCloser: watchBody(ctx, resp.Body, queried, params), cancel: cancel}
 	return resp, nil
 }
 
+// cancelBody releases the context of a streamed response when closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// statusError reads and closes the body of a failed response
+func statusError(resp *http.Response) error {
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("Influxdb %s", requests.StatusError(resp.StatusCode, body))
+}
+
 func WritePoints(influxDbs []string, pointsObj models.Points) error {
 
 	db := pointsObj.Database
@@ -154,7 +360,8 @@ func writePoints(influxDb string, db string, precision string, data []byte, poin
 
 	var err error
 	var resp *requests.Resp
-	if resp, err = requests.PostBytes(fullUrl, data); err != nil {
+	initClients()
+	if resp, err = writeClient.PostBytes(context.Background(), fullUrl, data); err != nil {
 		// clean cache, maybe config changed
 		loda.PurgeChan <- db
 		return err
@@ -176,6 +383,44 @@ func writePoints(influxDb string, db string, precision string, data []byte, poin
 	}
 }
 
+// WriteLines writes line protocol, timestamps in precision, to every host
+// of influxDbs. Unlike WritePoints any non 2xx answer is an error: the
+// points were not stored.
+func WriteLines(influxDbs []string, db, precision string, data []byte) error {
+	if len(influxDbs) == 0 {
+		return fmt.Errorf("no db config")
+	}
+	initClients()
+	for _, host := range influxDbs {
+		if err := writeLines(host, db, precision, data); err != nil {
+			return fmt.Errorf("write %s: %s", host, err)
+		}
+	}
+	return nil
+}
+
+func writeLines(host, db, precision string, data []byte) error {
+	limit.Take()
+	defer limit.Release()
+	fullUrl := fmt.Sprintf("%s?%s", GetWriteUrl(host), ParseParams(map[string]string{
+		"db":        db,
+		"precision": precision,
+	}))
+	for retried := false; ; retried = true {
+		resp, err := writeClient.PostBytes(context.Background(), fullUrl, data)
+		if err != nil {
+			return err
+		}
+		if !retried && strings.Contains(string(resp.Body), "database not found") {
+			if err := createDbAndRP([]string{host}, db); err != nil {
+				return err
+			}
+			continue
+		}
+		return requests.StatusError(resp.Status, resp.Body)
+	}
+}
+
 var rpMap = map[string]string{
 	".api.loda":     "500d",
 	".switch.loda":  "500d",
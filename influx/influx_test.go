@@ -0,0 +1,217 @@
+package influx
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lodastack/router/config"
+	"github.com/lodastack/router/requests"
+)
+
+// fakeInfluxDB serves h as the influxdb of every host
+func fakeInfluxDB(t *testing.T, h http.Handler) *httptest.Server {
+	srv := httptest.NewServer(h)
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	f, err := ioutil.TempFile("", "router-*.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintf(f, "[common]\ninfluxdPort = %s\n", port)
+	f.Close()
+	if err := config.LoadConfig(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+// slowInfluxDB runs every query for delay, it answers SHOW QUERIES and
+// records the killed queries.
+type slowInfluxDB struct {
+	delay time.Duration
+
+	mu      sync.Mutex
+	queries []string
+	killed  []string
+}
+
+func (s *slowInfluxDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.FormValue("q")
+	s.mu.Lock()
+	s.queries = append(s.queries, r.Host+" "+q)
+	s.mu.Unlock()
+	switch {
+	case q == "SHOW QUERIES":
+		fmt.Fprint(w, `{"results":[{"series":[{"columns":["qid","query","database","duration"],"values":[[7,"SELECT * FROM cpu","collect.a","1s"]]}]}]}`)
+	case strings.HasPrefix(q, "KILL QUERY"):
+		s.mu.Lock()
+		s.killed = append(s.killed, q)
+		s.mu.Unlock()
+		fmt.Fprint(w, `{"results":[{}]}`)
+	default:
+		select {
+		case <-time.After(s.delay):
+		case <-r.Context().Done():
+		}
+		fmt.Fprint(w, `{"results":[{"series":[{"name":"cpu","columns":["time","value"],"values":[[1,1]]}]}]}`)
+	}
+}
+
+func (s *slowInfluxDB) count(prefix string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, q := range s.queries {
+		if strings.Contains(q, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *slowInfluxDB) waitKilled(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		s.mu.Lock()
+		n := len(s.killed)
+		s.mu.Unlock()
+		if n > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("query not killed")
+}
+
+func TestQueryClientTimeout(t *testing.T) {
+	db := &slowInfluxDB{delay: time.Second}
+	srv := fakeInfluxDB(t, db)
+	defer srv.Close()
+	initClients()
+	saved := queryClient
+	queryClient = requests.NewClient(requests.Options{Timeout: 100 * time.Millisecond})
+	defer func() { queryClient = saved }()
+
+	hosts := []string{"127.0.0.1", "localhost"}
+	params := map[string]string{"db": "collect.a", "q": "SELECT * FROM cpu"}
+	tests := []struct {
+		name  string
+		query func(ctx context.Context) error
+	}{
+		{"QueryRaw", func(ctx context.Context) error {
+			_, err := QueryRaw(ctx, hosts, params, "")
+			return err
+		}},
+		{"QueryStream", func(ctx context.Context) error {
+			resp, err := QueryStream(ctx, hosts, params, "")
+			if err == nil {
+				resp.Body.Close()
+			}
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		db.queries, db.killed = nil, nil
+		pool = &hostPool{stats: make(map[string]*hostStat)}
+
+		// a longer deadline of the caller is bounded by the client timeout
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := tt.query(ctx)
+		cancel()
+		if err != ErrTimeout {
+			t.Errorf("%s: error %v, want %v", tt.name, err, ErrTimeout)
+		}
+		db.waitKilled(t)
+		if n := db.count("SELECT"); n != 1 {
+			t.Errorf("%s: queried %d times, want no failover", tt.name, n)
+		}
+		for _, host := range hosts {
+			if s, ok := pool.stats[host]; ok && s.failures > 0 {
+				t.Errorf("%s: %s marked down", tt.name, host)
+			}
+		}
+	}
+}
+
+func TestQueryCallerDeadline(t *testing.T) {
+	db := &slowInfluxDB{delay: time.Second}
+	srv := fakeInfluxDB(t, db)
+	defer srv.Close()
+	initClients()
+	saved := queryClient
+	queryClient = requests.NewClient(requests.Options{Timeout: time.Minute})
+	defer func() { queryClient = saved }()
+	pool = &hostPool{stats: make(map[string]*hostStat)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := QueryRaw(ctx, []string{"127.0.0.1", "localhost"}, map[string]string{"db": "collect.a", "q": "SELECT * FROM cpu"}, "")
+	if err != context.DeadlineExceeded {
+		t.Errorf("error %v, want %v", err, context.DeadlineExceeded)
+	}
+	db.waitKilled(t)
+	if n := db.count("SELECT"); n != 1 {
+		t.Errorf("queried %d times, want no failover", n)
+	}
+}
+
+func TestQueryFast(t *testing.T) {
+	db := &slowInfluxDB{}
+	srv := fakeInfluxDB(t, db)
+	defer srv.Close()
+	initClients()
+	saved := queryClient
+	queryClient = requests.NewClient(requests.Options{Timeout: time.Second})
+	defer func() { queryClient = saved }()
+
+	resp, err := QueryStream(context.Background(), []string{"127.0.0.1"}, map[string]string{"db": "collect.a", "q": "SELECT * FROM cpu"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the body outlives the header timeout
+	time.Sleep(1500 * time.Millisecond)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || !strings.Contains(string(body), `"cpu"`) {
+		t.Errorf("body %q, error %v", body, err)
+	}
+}
+
+func TestQueryStreamTimeout(t *testing.T) {
+	db := &slowInfluxDB{delay: 300 * time.Millisecond}
+	srv := fakeInfluxDB(t, db)
+	defer srv.Close()
+	initClients()
+	saved := queryClient
+	queryClient = requests.NewClient(requests.Options{Timeout: 100 * time.Millisecond})
+	defer func() { queryClient = saved }()
+	pool = &hostPool{stats: make(map[string]*hostStat)}
+
+	// the header takes longer than the query client timeout
+	resp, err := QueryStreamTimeout(context.Background(), []string{"127.0.0.1"}, map[string]string{"db": "collect.a", "q": "SELECT * FROM cpu"}, "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || !strings.Contains(string(body), `"cpu"`) {
+		t.Errorf("body %q, error %v", body, err)
+	}
+	if n := db.count("KILL"); n != 0 {
+		t.Errorf("killed %d times, want none", n)
+	}
+
+	_, err = QueryStreamTimeout(context.Background(), []string{"127.0.0.1"}, map[string]string{"db": "collect.a", "q": "SELECT * FROM cpu"}, "", 100*time.Millisecond)
+	if err != ErrTimeout {
+		t.Errorf("error %v, want %v", err, ErrTimeout)
+	}
+	db.waitKilled(t)
+}
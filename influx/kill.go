@@ -0,0 +1,135 @@
+package influx
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lodastack/log"
+)
+
+// killTimeout bounds the SHOW QUERIES and KILL QUERY of an abandoned query
+const killTimeout = 5 * time.Second
+
+// watchedBody kills the query on the host when ctx is done before the
+// body is closed, i.e. when the reader gave up in the middle of it.
+type watchedBody struct {
+	io.ReadCloser
+	once sync.Once
+	done chan struct{}
+}
+
+func (b *watchedBody) Close() error {
+	b.once.Do(func() { close(b.done) })
+	return b.ReadCloser.Close()
+}
+
+func watchBody(ctx context.Context, body io.ReadCloser, host string, params map[string]string) io.ReadCloser {
+	if ctx.Done() == nil {
+		return body
+	}
+	b := &watchedBody{ReadCloser: body, done: make(chan struct{})}
+	go func() {
+		select {
+		case <-b.done:
+		case <-ctx.Done():
+			select {
+			case <-b.done:
+				return
+			default:
+			}
+			killQuery(host, params)
+		}
+	}()
+	return b
+}
+
+// killQuery finds the query of params running on host and kills it
+func killQuery(host string, params map[string]string) {
+	q, db := params["q"], params["db"]
+	if q == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), killTimeout)
+	defer cancel()
+
+	initClients()
+	url := GetQueryUrl(host) + ParseParams(map[string]string{"q": "SHOW QUERIES"})
+	resp, err := queryClient.Get(ctx, url)
+	if err != nil {
+		log.Errorf("show queries on %s failed: %s", host, err)
+		return
+	}
+	rs := ResultsObj{}
+	if err := resp.Obj(&rs); err != nil {
+		log.Errorf("show queries on %s failed: %s", host, err)
+		return
+	}
+
+	for _, id := range runningQueries(rs, db, q) {
+		url := GetQueryUrl(host) + ParseParams(map[string]string{"q": fmt.Sprintf("KILL QUERY %s", id)})
+		if _, err := queryClient.Get(ctx, url); err != nil {
+			log.Errorf("kill query %s on %s failed: %s", id, host, err)
+			continue
+		}
+		log.Infof("killed query %s on %s: %s", id, host, q)
+	}
+}
+
+// runningQueries returns the ids of the SHOW QUERIES rows running q on
+// db. InfluxDB shows a query formatted its own way, so they are compared
+// without case, quotes and spaces.
+func runningQueries(rs ResultsObj, db, q string) []string {
+	want := normalizeQuery(q)
+	var ids []string
+	for _, result := range rs.Results {
+		for _, serie := range result.Series {
+			qid, query, database := -1, -1, -1
+			for i, c := range serie.Columns {
+				switch c {
+				case "qid":
+					qid = i
+				case "query":
+					query = i
+				case "database":
+					database = i
+				}
+			}
+			if qid < 0 || query < 0 {
+				continue
+			}
+			for _, value := range serie.Values {
+				v, ok := value.([]interface{})
+				if !ok || len(v) <= qid || len(v) <= query {
+					continue
+				}
+				if database >= 0 && len(v) > database && db != "" {
+					if d, _ := v[database].(string); d != db {
+						continue
+					}
+				}
+				if text, _ := v[query].(string); normalizeQuery(text) != want {
+					continue
+				}
+				if id, ok := v[qid].(float64); ok {
+					ids = append(ids, strconv.FormatInt(int64(id), 10))
+				}
+			}
+		}
+	}
+	return ids
+}
+
+func normalizeQuery(q string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '"', ' ', '\t', '\n', '\r', ';':
+			return -1
+		}
+		return r
+	}, strings.ToLower(q))
+}
@@ -0,0 +1,44 @@
+package influx
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+// writeServer answers writes with status, the body written is sent to got
+func writeServer(status int, got chan<- string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		got <- r.URL.Query().Get("db") + " " + r.URL.Query().Get("precision") + " " + string(body)
+		w.WriteHeader(status)
+		if status/100 != 2 {
+			fmt.Fprint(w, `{"error":"unable to parse"}`)
+		}
+	})
+}
+
+func TestWriteLines(t *testing.T) {
+	lines := "cpu,host=a\\ b msg=\"say \\\"hi\\\"\" 1600000000\n"
+	tests := []struct {
+		status int
+		err    bool
+	}{
+		{status: http.StatusNoContent},
+		{status: http.StatusBadRequest, err: true},
+		{status: http.StatusInternalServerError, err: true},
+	}
+	for _, tt := range tests {
+		got := make(chan string, 1)
+		srv := fakeInfluxDB(t, writeServer(tt.status, got))
+		err := WriteLines([]string{"127.0.0.1"}, "collect.a", "s", []byte(lines))
+		srv.Close()
+		if (err != nil) != tt.err {
+			t.Errorf("status %d: error %v, want error %v", tt.status, err, tt.err)
+		}
+		if body := <-got; body != "collect.a s "+lines {
+			t.Errorf("status %d: written %q", tt.status, body)
+		}
+	}
+}
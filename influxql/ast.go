@@ -0,0 +1,414 @@
+// Package influxql parses the InfluxQL queries proxied by the router,
+// enough to check what a query does and which data it reads.
+package influxql
+
+import (
+	"strings"
+	"time"
+)
+
+// Query is a list of statements separated by ";"
+type Query struct {
+	Statements []Statement
+}
+
+// Statement is a parsed statement
+type Statement interface {
+	// Kind is the statement keywords, like "SELECT" or "SHOW TAG KEYS"
+	Kind() string
+}
+
+// SelectStatement is a SELECT, or the statement of an EXPLAIN
+type SelectStatement struct {
+	Explain    bool
+	Fields     []*Field
+	Into       *Measurement
+	Sources    []Source
+	Condition  Expr
+	Dimensions []Expr
+	Fill       string
+	Limit      int
+	Offset     int
+	SLimit     int
+	SOffset    int
+	Descending bool
+	Location   string
+}
+
+// Kind of the statement
+func (s *SelectStatement) Kind() string {
+	if s.Explain {
+		return "EXPLAIN"
+	}
+	return "SELECT"
+}
+
+// ShowStatement is any SHOW statement
+type ShowStatement struct {
+	Keywords  string
+	Database  string
+	Sources   []Source
+	Condition Expr
+}
+
+// Kind of the statement
+func (s *ShowStatement) Kind() string { return s.Keywords }
+
+// OtherStatement is a statement which is only recognized by its kind,
+// like DROP MEASUREMENT or CREATE DATABASE
+type OtherStatement struct {
+	Keywords string
+}
+
+// Kind of the statement
+func (s *OtherStatement) Kind() string { return s.Keywords }
+
+// Field is a selected expression
+type Field struct {
+	Expr  Expr
+	Alias string
+}
+
+// Source is a Measurement or a SubQuery
+type Source interface {
+	source()
+}
+
+// Measurement is a source or INTO target, Regex is set for /regex/ sources
+type Measurement struct {
+	Database        string
+	RetentionPolicy string
+	Name            string
+	Regex           string
+}
+
+func (*Measurement) source() {}
+
+// SubQuery is a SELECT used as source
+type SubQuery struct {
+	Statement *SelectStatement
+}
+
+func (*SubQuery) source() {}
+
+// Expr is an expression
+type Expr interface {
+	expr()
+}
+
+// BinaryExpr is "LHS Op RHS"
+type BinaryExpr struct {
+	Op  Token
+	LHS Expr
+	RHS Expr
+}
+
+// ParenExpr is "(Expr)"
+type ParenExpr struct {
+	Expr Expr
+}
+
+// Call is a function call
+type Call struct {
+	Name string
+	Args []Expr
+}
+
+// VarRef is a field or tag reference, Type is the optional ::type
+type VarRef struct {
+	Val  string
+	Type string
+}
+
+// Wildcard is "*", Type is the optional ::type
+type Wildcard struct {
+	Type string
+}
+
+// NumberLiteral is a float
+type NumberLiteral struct {
+	Val float64
+}
+
+// IntegerLiteral is an integer
+type IntegerLiteral struct {
+	Val int64
+}
+
+// DurationLiteral is a duration like 10s
+type DurationLiteral struct {
+	Val time.Duration
+}
+
+// StringLiteral is a single quoted string
+type StringLiteral struct {
+	Val string
+}
+
+// BooleanLiteral is true or false
+type BooleanLiteral struct {
+	Val bool
+}
+
+// RegexLiteral is a /regex/
+type RegexLiteral struct {
+	Val string
+}
+
+// BoundParameter is a $param
+type BoundParameter struct {
+	Name string
+}
+
+func (*BinaryExpr) expr()      {}
+func (*ParenExpr) expr()       {}
+func (*Call) expr()            {}
+func (*VarRef) expr()          {}
+func (*Wildcard) expr()        {}
+func (*NumberLiteral) expr()   {}
+func (*IntegerLiteral) expr()  {}
+func (*DurationLiteral) expr() {}
+func (*StringLiteral) expr()   {}
+func (*BooleanLiteral) expr()  {}
+func (*RegexLiteral) expr()    {}
+func (*BoundParameter) expr()  {}
+
+// Measurements returns the measurements read by q, including the ones of
+// subqueries.
+func (q *Query) Measurements() []*Measurement {
+	var ms []*Measurement
+	for _, stmt := range q.Statements {
+		switch stmt := stmt.(type) {
+		case *SelectStatement:
+			ms = append(ms, stmt.measurements()...)
+		case *ShowStatement:
+			ms = append(ms, sourcesMeasurements(stmt.Sources)...)
+		}
+	}
+	return ms
+}
+
+// Databases returns the distinct databases read by q, unqualified
+// sources are read from defaultDB.
+func (q *Query) Databases(defaultDB string) []string {
+	var dbs []string
+	seen := make(map[string]bool)
+	add := func(db string) {
+		if db == "" {
+			db = defaultDB
+		}
+		if db != "" && !seen[db] {
+			seen[db] = true
+			dbs = append(dbs, db)
+		}
+	}
+	for _, stmt := range q.Statements {
+		switch stmt := stmt.(type) {
+		case *SelectStatement:
+			for _, m := range stmt.measurements() {
+				add(m.Database)
+			}
+		case *ShowStatement:
+			if stmt.Database != "" {
+				add(stmt.Database)
+				continue
+			}
+			ms := sourcesMeasurements(stmt.Sources)
+			for _, m := range ms {
+				add(m.Database)
+			}
+			if len(ms) == 0 {
+				add("")
+			}
+		default:
+			add("")
+		}
+	}
+	return dbs
+}
+
+// Selects returns the SELECT statements of q, not including subqueries
+func (q *Query) Selects() []*SelectStatement {
+	var stmts []*SelectStatement
+	for _, stmt := range q.Statements {
+		if s, ok := stmt.(*SelectStatement); ok {
+			stmts = append(stmts, s)
+		}
+	}
+	return stmts
+}
+
+func (s *SelectStatement) measurements() []*Measurement {
+	return sourcesMeasurements(s.Sources)
+}
+
+func sourcesMeasurements(sources []Source) []*Measurement {
+	var ms []*Measurement
+	for _, src := range sources {
+		switch src := src.(type) {
+		case *Measurement:
+			ms = append(ms, src)
+		case *SubQuery:
+			ms = append(ms, src.Statement.measurements()...)
+		}
+	}
+	return ms
+}
+
+// IsRaw reports whether s selects raw points, with no aggregate or
+// selector function.
+func (s *SelectStatement) IsRaw() bool {
+	for _, f := range s.Fields {
+		if hasAggregate(f.Expr) {
+			return false
+		}
+	}
+	return true
+}
+
+// mathFuncs are functions applied point by point
+var mathFuncs = map[string]bool{
+	"abs": true, "sin": true, "cos": true, "tan": true, "asin": true,
+	"acos": true, "atan": true, "atan2": true, "exp": true, "log": true,
+	"ln": true, "log2": true, "log10": true, "sqrt": true, "pow": true,
+	"floor": true, "ceil": true, "round": true,
+}
+
+func hasAggregate(e Expr) bool {
+	switch e := e.(type) {
+	case *Call:
+		if !mathFuncs[strings.ToLower(e.Name)] {
+			return true
+		}
+		for _, arg := range e.Args {
+			if hasAggregate(arg) {
+				return true
+			}
+		}
+	case *BinaryExpr:
+		return hasAggregate(e.LHS) || hasAggregate(e.RHS)
+	case *ParenExpr:
+		return hasAggregate(e.Expr)
+	}
+	return false
+}
+
+// GroupByInterval returns the interval of GROUP BY time(), or 0
+func (s *SelectStatement) GroupByInterval() time.Duration {
+	for _, d := range s.Dimensions {
+		if call, ok := d.(*Call); ok && strings.ToLower(call.Name) == "time" && len(call.Args) > 0 {
+			if lit, ok := call.Args[0].(*DurationLiteral); ok {
+				return lit.Val
+			}
+		}
+	}
+	return 0
+}
+
+// TimeRange returns the time bounds of the condition of s, a zero bound
+// is unbounded. Bounds in OR branches are ignored.
+func (s *SelectStatement) TimeRange(now time.Time) (min, max time.Time) {
+	timeRange(s.Condition, now, &min, &max)
+	return min, max
+}
+
+func timeRange(e Expr, now time.Time, min, max *time.Time) {
+	switch e := e.(type) {
+	case *ParenExpr:
+		timeRange(e.Expr, now, min, max)
+	case *BinaryExpr:
+		if e.Op == AND {
+			timeRange(e.LHS, now, min, max)
+			timeRange(e.RHS, now, min, max)
+			return
+		}
+
+		op, value := e.Op, e.RHS
+		if !isTimeRef(e.LHS) {
+			if !isTimeRef(e.RHS) {
+				return
+			}
+			// "value op time", swap the comparison
+			value = e.LHS
+			switch op {
+			case LT:
+				op = GT
+			case LTE:
+				op = GTE
+			case GT:
+				op = LT
+			case GTE:
+				op = LTE
+			}
+		}
+		t, ok := timeValue(value, now)
+		if !ok {
+			return
+		}
+		switch op {
+		case GT, GTE:
+			if min.IsZero() || t.After(*min) {
+				*min = t
+			}
+		case LT, LTE:
+			if max.IsZero() || t.Before(*max) {
+				*max = t
+			}
+		case EQ:
+			*min, *max = t, t
+		}
+	}
+}
+
+func isTimeRef(e Expr) bool {
+	ref, ok := e.(*VarRef)
+	return ok && strings.ToLower(ref.Val) == "time"
+}
+
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// timeValue evaluates a time expression like now() - 1h, 1600000000000ms
+// or '2020-01-01T00:00:00Z'
+func timeValue(e Expr, now time.Time) (time.Time, bool) {
+	switch e := e.(type) {
+	case *ParenExpr:
+		return timeValue(e.Expr, now)
+	case *Call:
+		if strings.ToLower(e.Name) == "now" && len(e.Args) == 0 {
+			return now, true
+		}
+	case *IntegerLiteral:
+		return time.Unix(0, e.Val), true
+	case *NumberLiteral:
+		return time.Unix(0, int64(e.Val)), true
+	case *DurationLiteral:
+		return time.Unix(0, int64(e.Val)), true
+	case *StringLiteral:
+		for _, layout := range timeLayouts {
+			if t, err := time.Parse(layout, e.Val); err == nil {
+				return t, true
+			}
+		}
+	case *BinaryExpr:
+		t, ok := timeValue(e.LHS, now)
+		if !ok {
+			return t, false
+		}
+		d, ok := e.RHS.(*DurationLiteral)
+		if !ok {
+			return t, false
+		}
+		switch e.Op {
+		case ADD:
+			return t.Add(d.Val), true
+		case SUB:
+			return t.Add(-d.Val), true
+		}
+	}
+	return time.Time{}, false
+}
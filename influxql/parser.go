@@ -0,0 +1,758 @@
+package influxql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseError is a syntax error at a position of the query
+type ParseError struct {
+	Message string
+	Pos     int
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s at char %d", e.Message, e.Pos+1)
+}
+
+type item struct {
+	tok Token
+	pos int
+	lit string
+}
+
+type parser struct {
+	s    *scanner
+	back []item
+}
+
+// ParseQuery parses a query of one or more statements
+func ParseQuery(q string) (*Query, error) {
+	p := &parser{s: newScanner(q)}
+	query := &Query{}
+	for {
+		it := p.scan()
+		switch it.tok {
+		case SEMICOLON:
+			continue
+		case EOF:
+			if len(query.Statements) == 0 {
+				return nil, &ParseError{Message: "empty query", Pos: it.pos}
+			}
+			return query, nil
+		}
+		p.unscan(it)
+
+		stmt, err := p.parseStatement()
+		if err != nil {
+			return nil, err
+		}
+		query.Statements = append(query.Statements, stmt)
+
+		if it := p.scan(); it.tok != SEMICOLON && it.tok != EOF {
+			return nil, errFound(it, ";")
+		}
+	}
+}
+
+// ParseDuration parses a duration literal like 10s or 1h30m
+func ParseDuration(lit string) (time.Duration, error) {
+	var d time.Duration
+	i := 0
+	for i < len(lit) {
+		start := i
+		for i < len(lit) && lit[i] >= '0' && lit[i] <= '9' {
+			i++
+		}
+		n, err := strconv.ParseInt(lit[start:i], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %s", lit)
+		}
+		start = i
+		for i < len(lit) && (lit[i] < '0' || lit[i] > '9') {
+			i++
+		}
+		var unit time.Duration
+		switch lit[start:i] {
+		case "ns":
+			unit = time.Nanosecond
+		case "u", "µ":
+			unit = time.Microsecond
+		case "ms":
+			unit = time.Millisecond
+		case "s":
+			unit = time.Second
+		case "m":
+			unit = time.Minute
+		case "h":
+			unit = time.Hour
+		case "d":
+			unit = 24 * time.Hour
+		case "w":
+			unit = 7 * 24 * time.Hour
+		default:
+			return 0, fmt.Errorf("invalid duration %s", lit)
+		}
+		d += time.Duration(n) * unit
+	}
+	return d, nil
+}
+
+// scan returns the next token which is not white space
+func (p *parser) scan() item {
+	if n := len(p.back); n > 0 {
+		it := p.back[n-1]
+		p.back = p.back[:n-1]
+		return it
+	}
+	for {
+		tok, pos, lit := p.s.scan()
+		if tok != WS {
+			return item{tok: tok, pos: pos, lit: lit}
+		}
+	}
+}
+
+func (p *parser) unscan(it item) {
+	p.back = append(p.back, it)
+}
+
+// scanRegex reads a regex after its opening "/" was scanned as DIV
+func (p *parser) scanRegex(it item) (string, error) {
+	if len(p.back) > 0 {
+		// the scanner is past the pushed back tokens
+		return "", &ParseError{Message: "unexpected regex", Pos: it.pos}
+	}
+	re, err := p.s.scanRegex()
+	if err != nil {
+		return "", &ParseError{Message: err.Error(), Pos: it.pos}
+	}
+	return re, nil
+}
+
+func (p *parser) isKeyword(it item, kw string) bool {
+	return it.tok == KEYWORD && it.lit == kw
+}
+
+func (p *parser) expectKeyword(kw string) error {
+	if it := p.scan(); !p.isKeyword(it, kw) {
+		return errFound(it, kw)
+	}
+	return nil
+}
+
+func (p *parser) expect(tok Token) (item, error) {
+	it := p.scan()
+	if it.tok != tok {
+		return it, errFound(it, tok.String())
+	}
+	return it, nil
+}
+
+func errFound(it item, expected string) error {
+	found := it.lit
+	if it.tok == EOF {
+		found = "EOF"
+	}
+	return &ParseError{Message: fmt.Sprintf("found %s, expected %s", found, expected), Pos: it.pos}
+}
+
+func (p *parser) parseStatement() (Statement, error) {
+	it := p.scan()
+	if it.tok != KEYWORD {
+		return nil, errFound(it, "SELECT, SHOW or another statement")
+	}
+	switch it.lit {
+	case "SELECT":
+		return p.parseSelect()
+	case "EXPLAIN":
+		if next := p.scan(); !p.isKeyword(next, "ANALYZE") {
+			p.unscan(next)
+		}
+		if err := p.expectKeyword("SELECT"); err != nil {
+			return nil, err
+		}
+		stmt, err := p.parseSelect()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Explain = true
+		return stmt, nil
+	case "SHOW":
+		return p.parseShow()
+	}
+	return p.parseOther(it.lit)
+}
+
+// parseOther reads the kind of a statement the router does not need to
+// understand, and skips the rest of it
+func (p *parser) parseOther(kind string) (Statement, error) {
+	next := p.scan()
+	if next.tok == KEYWORD && next.lit != "FROM" && next.lit != "WHERE" && next.lit != "ON" {
+		kind += " " + next.lit
+	} else {
+		p.unscan(next)
+	}
+
+	prev := KEYWORD
+	for {
+		it := p.scan()
+		switch it.tok {
+		case SEMICOLON, EOF:
+			p.unscan(it)
+			return &OtherStatement{Keywords: kind}, nil
+		case ILLEGAL:
+			return nil, &ParseError{Message: "illegal " + it.lit, Pos: it.pos}
+		case DIV:
+			if prev == KEYWORD || prev == EQREGEX || prev == NEQREGEX || prev == COMMA {
+				if _, err := p.scanRegex(it); err != nil {
+					return nil, err
+				}
+				it.tok = REGEX
+			}
+		}
+		prev = it.tok
+	}
+}
+
+func (p *parser) parseSelect() (*SelectStatement, error) {
+	stmt := &SelectStatement{}
+	var err error
+	if stmt.Fields, err = p.parseFields(); err != nil {
+		return nil, err
+	}
+
+	it := p.scan()
+	if p.isKeyword(it, "INTO") {
+		if stmt.Into, err = p.parseMeasurement(); err != nil {
+			return nil, err
+		}
+		it = p.scan()
+	}
+	if !p.isKeyword(it, "FROM") {
+		return nil, errFound(it, "FROM")
+	}
+	if stmt.Sources, err = p.parseSources(); err != nil {
+		return nil, err
+	}
+
+	for {
+		it := p.scan()
+		switch {
+		case p.isKeyword(it, "WHERE"):
+			if stmt.Condition, err = p.parseExpr(); err != nil {
+				return nil, err
+			}
+		case p.isKeyword(it, "GROUP"):
+			if err := p.expectKeyword("BY"); err != nil {
+				return nil, err
+			}
+			if stmt.Dimensions, err = p.parseExprList(); err != nil {
+				return nil, err
+			}
+		case it.tok == IDENT && strings.ToLower(it.lit) == "fill":
+			if stmt.Fill, err = p.parseFill(); err != nil {
+				return nil, err
+			}
+		case p.isKeyword(it, "ORDER"):
+			if stmt.Descending, err = p.parseOrderBy(); err != nil {
+				return nil, err
+			}
+		case p.isKeyword(it, "LIMIT"):
+			if stmt.Limit, err = p.parseInt(); err != nil {
+				return nil, err
+			}
+		case p.isKeyword(it, "OFFSET"):
+			if stmt.Offset, err = p.parseInt(); err != nil {
+				return nil, err
+			}
+		case p.isKeyword(it, "SLIMIT"):
+			if stmt.SLimit, err = p.parseInt(); err != nil {
+				return nil, err
+			}
+		case p.isKeyword(it, "SOFFSET"):
+			if stmt.SOffset, err = p.parseInt(); err != nil {
+				return nil, err
+			}
+		case it.tok == IDENT && strings.ToLower(it.lit) == "tz":
+			if _, err := p.expect(LPAREN); err != nil {
+				return nil, err
+			}
+			loc, err := p.expect(STRING)
+			if err != nil {
+				return nil, err
+			}
+			stmt.Location = loc.lit
+			if _, err := p.expect(RPAREN); err != nil {
+				return nil, err
+			}
+		default:
+			p.unscan(it)
+			return stmt, nil
+		}
+	}
+}
+
+func (p *parser) parseFields() ([]*Field, error) {
+	var fields []*Field
+	for {
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		f := &Field{Expr: expr}
+		it := p.scan()
+		if p.isKeyword(it, "AS") {
+			alias := p.scan()
+			if alias.tok != IDENT && alias.tok != KEYWORD {
+				return nil, errFound(alias, "alias")
+			}
+			f.Alias = alias.lit
+			it = p.scan()
+		}
+		fields = append(fields, f)
+		if it.tok != COMMA {
+			p.unscan(it)
+			return fields, nil
+		}
+	}
+}
+
+func (p *parser) parseExprList() ([]Expr, error) {
+	var exprs []Expr
+	for {
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		if it := p.scan(); it.tok != COMMA {
+			p.unscan(it)
+			return exprs, nil
+		}
+	}
+}
+
+func (p *parser) parseSources() ([]Source, error) {
+	var sources []Source
+	for {
+		it := p.scan()
+		if it.tok == LPAREN {
+			if err := p.expectKeyword("SELECT"); err != nil {
+				return nil, err
+			}
+			stmt, err := p.parseSelect()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expect(RPAREN); err != nil {
+				return nil, err
+			}
+			sources = append(sources, &SubQuery{Statement: stmt})
+		} else {
+			p.unscan(it)
+			m, err := p.parseMeasurement()
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, m)
+		}
+
+		if it := p.scan(); it.tok != COMMA {
+			p.unscan(it)
+			return sources, nil
+		}
+	}
+}
+
+// parseMeasurement reads [db.][rp.]name, the name may be a /regex/ or
+// the :MEASUREMENT back reference of INTO
+func (p *parser) parseMeasurement() (*Measurement, error) {
+	var segments []string
+	m := &Measurement{}
+	for {
+		it := p.scan()
+		switch {
+		case it.tok == IDENT:
+			segments = append(segments, it.lit)
+		case it.tok == DOT:
+			// empty segment, like db..name
+			segments = append(segments, "")
+			continue
+		case it.tok == DIV:
+			re, err := p.scanRegex(it)
+			if err != nil {
+				return nil, err
+			}
+			m.Regex = re
+			segments = append(segments, "")
+		case it.tok == COLON:
+			if err := p.expectKeyword("MEASUREMENT"); err != nil {
+				return nil, err
+			}
+			segments = append(segments, ":MEASUREMENT")
+		default:
+			return nil, errFound(it, "measurement")
+		}
+
+		if it := p.scan(); it.tok != DOT {
+			p.unscan(it)
+			break
+		}
+	}
+
+	switch len(segments) {
+	case 1:
+		m.Name = segments[0]
+	case 2:
+		m.RetentionPolicy, m.Name = segments[0], segments[1]
+	case 3:
+		m.Database, m.RetentionPolicy, m.Name = segments[0], segments[1], segments[2]
+	default:
+		return nil, &ParseError{Message: "too many segments in " + strings.Join(segments, ".")}
+	}
+	return m, nil
+}
+
+func (p *parser) parseFill() (string, error) {
+	if _, err := p.expect(LPAREN); err != nil {
+		return "", err
+	}
+	it := p.scan()
+	fill := it.lit
+	if it.tok == SUB {
+		it = p.scan()
+		fill = "-" + it.lit
+	}
+	if it.tok != IDENT && it.tok != INTEGER && it.tok != NUMBER {
+		return "", errFound(it, "fill option")
+	}
+	if _, err := p.expect(RPAREN); err != nil {
+		return "", err
+	}
+	return strings.ToLower(fill), nil
+}
+
+// parseOrderBy reads "BY time [ASC|DESC]", returns true for DESC
+func (p *parser) parseOrderBy() (bool, error) {
+	if err := p.expectKeyword("BY"); err != nil {
+		return false, err
+	}
+	if _, err := p.expect(IDENT); err != nil {
+		return false, err
+	}
+	it := p.scan()
+	switch {
+	case p.isKeyword(it, "DESC"):
+		return true, nil
+	case p.isKeyword(it, "ASC"):
+		return false, nil
+	}
+	p.unscan(it)
+	return false, nil
+}
+
+func (p *parser) parseInt() (int, error) {
+	it, err := p.expect(INTEGER)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(it.lit)
+	if err != nil {
+		return 0, &ParseError{Message: "invalid integer " + it.lit, Pos: it.pos}
+	}
+	return n, nil
+}
+
+func (p *parser) parseShow() (*ShowStatement, error) {
+	stmt := &ShowStatement{Keywords: "SHOW"}
+	for {
+		it := p.scan()
+		if it.tok != KEYWORD || showClauses[it.lit] {
+			p.unscan(it)
+			break
+		}
+		stmt.Keywords += " " + it.lit
+	}
+	if stmt.Keywords == "SHOW" {
+		return nil, errFound(p.scan(), "SHOW target")
+	}
+
+	var err error
+	for {
+		it := p.scan()
+		switch {
+		case p.isKeyword(it, "ON"):
+			db, err := p.expect(IDENT)
+			if err != nil {
+				return nil, err
+			}
+			stmt.Database = db.lit
+		case p.isKeyword(it, "FROM"):
+			if stmt.Sources, err = p.parseSources(); err != nil {
+				return nil, err
+			}
+		case p.isKeyword(it, "WITH"):
+			if err := p.parseWith(); err != nil {
+				return nil, err
+			}
+		case p.isKeyword(it, "WHERE"):
+			if stmt.Condition, err = p.parseExpr(); err != nil {
+				return nil, err
+			}
+		case p.isKeyword(it, "LIMIT"), p.isKeyword(it, "OFFSET"),
+			p.isKeyword(it, "SLIMIT"), p.isKeyword(it, "SOFFSET"):
+			if _, err := p.parseInt(); err != nil {
+				return nil, err
+			}
+		case p.isKeyword(it, "ORDER"):
+			if _, err := p.parseOrderBy(); err != nil {
+				return nil, err
+			}
+		default:
+			p.unscan(it)
+			return stmt, nil
+		}
+	}
+}
+
+var showClauses = map[string]bool{
+	"ON": true, "FROM": true, "WITH": true, "WHERE": true, "LIMIT": true,
+	"OFFSET": true, "SLIMIT": true, "SOFFSET": true, "ORDER": true,
+}
+
+// parseWith reads "KEY|MEASUREMENT op value" of SHOW statements
+func (p *parser) parseWith() error {
+	if it := p.scan(); !p.isKeyword(it, "KEY") && !p.isKeyword(it, "MEASUREMENT") {
+		return errFound(it, "KEY or MEASUREMENT")
+	}
+	op := p.scan()
+	switch {
+	case op.tok == EQ || op.tok == NEQ:
+		_, err := p.expect(IDENT)
+		return err
+	case op.tok == EQREGEX || op.tok == NEQREGEX:
+		_, err := p.parseRegex()
+		return err
+	case p.isKeyword(op, "IN"):
+		if _, err := p.expect(LPAREN); err != nil {
+			return err
+		}
+		for {
+			if _, err := p.expect(IDENT); err != nil {
+				return err
+			}
+			it := p.scan()
+			if it.tok == RPAREN {
+				return nil
+			}
+			if it.tok != COMMA {
+				return errFound(it, ")")
+			}
+		}
+	}
+	return errFound(op, "=, !=, =~, !~ or IN")
+}
+
+func (p *parser) parseRegex() (*RegexLiteral, error) {
+	it := p.scan()
+	if it.tok != DIV {
+		return nil, errFound(it, "regex")
+	}
+	re, err := p.scanRegex(it)
+	if err != nil {
+		return nil, err
+	}
+	return &RegexLiteral{Val: re}, nil
+}
+
+// parseExpr parses an expression by operator precedence
+func (p *parser) parseExpr() (Expr, error) {
+	return p.parseBinary(1)
+}
+
+func (p *parser) parseBinary(minPrec int) (Expr, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.scan()
+		prec := op.tok.precedence()
+		if prec == 0 || prec < minPrec {
+			p.unscan(op)
+			return lhs, nil
+		}
+
+		var rhs Expr
+		if op.tok == EQREGEX || op.tok == NEQREGEX {
+			if next := p.scan(); next.tok == BOUNDPARAM {
+				rhs = &BoundParameter{Name: next.lit}
+			} else {
+				p.unscan(next)
+				if rhs, err = p.parseRegex(); err != nil {
+					return nil, err
+				}
+			}
+		} else if rhs, err = p.parseBinary(prec + 1); err != nil {
+			return nil, err
+		}
+		lhs = &BinaryExpr{Op: op.tok, LHS: lhs, RHS: rhs}
+	}
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	it := p.scan()
+	switch it.tok {
+	case LPAREN:
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(RPAREN); err != nil {
+			return nil, err
+		}
+		return &ParenExpr{Expr: expr}, nil
+	case ADD, SUB:
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if it.tok == ADD {
+			return expr, nil
+		}
+		switch lit := expr.(type) {
+		case *IntegerLiteral:
+			lit.Val = -lit.Val
+			return lit, nil
+		case *NumberLiteral:
+			lit.Val = -lit.Val
+			return lit, nil
+		case *DurationLiteral:
+			lit.Val = -lit.Val
+			return lit, nil
+		}
+		return &BinaryExpr{Op: MUL, LHS: &IntegerLiteral{Val: -1}, RHS: expr}, nil
+	case IDENT:
+		next := p.scan()
+		if next.tok == LPAREN {
+			return p.parseCall(it.lit)
+		}
+		p.unscan(next)
+		ref := &VarRef{Val: it.lit}
+		ref.Type = p.parseCast()
+		return ref, nil
+	case KEYWORD:
+		if it.lit == "DISTINCT" {
+			next := p.scan()
+			if next.tok == LPAREN {
+				return p.parseCall("distinct")
+			}
+			p.unscan(next)
+			arg, err := p.parseUnary()
+			if err != nil {
+				return nil, err
+			}
+			return &Call{Name: "distinct", Args: []Expr{arg}}, nil
+		}
+	case MUL:
+		return &Wildcard{Type: p.parseCast()}, nil
+	case DIV:
+		re, err := p.scanRegex(it)
+		if err != nil {
+			return nil, err
+		}
+		return &RegexLiteral{Val: re}, nil
+	case STRING:
+		return &StringLiteral{Val: it.lit}, nil
+	case INTEGER:
+		n, err := strconv.ParseInt(it.lit, 10, 64)
+		if err != nil {
+			// too large for an integer
+			f, err := strconv.ParseFloat(it.lit, 64)
+			if err != nil {
+				return nil, &ParseError{Message: "invalid integer " + it.lit, Pos: it.pos}
+			}
+			return &NumberLiteral{Val: f}, nil
+		}
+		return &IntegerLiteral{Val: n}, nil
+	case NUMBER:
+		f, err := strconv.ParseFloat(it.lit, 64)
+		if err != nil {
+			return nil, &ParseError{Message: "invalid number " + it.lit, Pos: it.pos}
+		}
+		return &NumberLiteral{Val: f}, nil
+	case DURATION:
+		d, err := ParseDuration(it.lit)
+		if err != nil {
+			return nil, &ParseError{Message: err.Error(), Pos: it.pos}
+		}
+		return &DurationLiteral{Val: d}, nil
+	case TRUE, FALSE:
+		return &BooleanLiteral{Val: it.tok == TRUE}, nil
+	case BOUNDPARAM:
+		return &BoundParameter{Name: it.lit}, nil
+	case ILLEGAL:
+		return nil, &ParseError{Message: "illegal " + it.lit, Pos: it.pos}
+	}
+	return nil, errFound(it, "identifier, literal or expression")
+}
+
+// parseCast reads an optional ::type
+func (p *parser) parseCast() string {
+	it := p.scan()
+	if it.tok != DOUBLECOLON {
+		p.unscan(it)
+		return ""
+	}
+	typ := p.scan()
+	if typ.tok != IDENT && typ.tok != KEYWORD {
+		p.unscan(typ)
+		return ""
+	}
+	return strings.ToLower(typ.lit)
+}
+
+func (p *parser) parseCall(name string) (Expr, error) {
+	call := &Call{Name: strings.ToLower(name)}
+	it := p.scan()
+	if it.tok == RPAREN {
+		return call, nil
+	}
+	p.unscan(it)
+	for {
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		call.Args = append(call.Args, arg)
+		it := p.scan()
+		if it.tok == RPAREN {
+			return call, nil
+		}
+		if it.tok != COMMA {
+			return nil, errFound(it, ", or )")
+		}
+	}
+}
+
+// QuoteIdent quotes an identifier when it is not a plain one
+func QuoteIdent(s string) string {
+	plain := s != "" && isIdentStart([]rune(s)[0]) && !keywords[strings.ToUpper(s)]
+	for _, ch := range s {
+		if !isIdentChar(ch) {
+			plain = false
+		}
+	}
+	if plain {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+// QuoteString quotes a string literal
+func QuoteString(s string) string {
+	return `'` + strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\n", `\n`).Replace(s) + `'`
+}
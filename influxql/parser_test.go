@@ -0,0 +1,242 @@
+package influxql
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseQueryKind(t *testing.T) {
+	tests := []struct {
+		q     string
+		kinds []string
+	}{
+		{q: `SELECT value FROM cpu`, kinds: []string{"SELECT"}},
+		{q: `select mean(value) from "cpu" where time > now() - 1h group by time(1m), host fill(none)`, kinds: []string{"SELECT"}},
+		{q: `EXPLAIN ANALYZE SELECT * FROM cpu`, kinds: []string{"EXPLAIN"}},
+		{q: `SHOW MEASUREMENTS`, kinds: []string{"SHOW MEASUREMENTS"}},
+		{q: `SHOW TAG VALUES FROM cpu WITH KEY = host`, kinds: []string{"SHOW TAG VALUES"}},
+		{q: `SHOW FIELD KEYS ON db FROM cpu`, kinds: []string{"SHOW FIELD KEYS"}},
+		{q: `DROP MEASUREMENT cpu`, kinds: []string{"DROP MEASUREMENT"}},
+		{q: `DELETE FROM cpu WHERE host =~ /a/`, kinds: []string{"DELETE"}},
+		{q: `CREATE DATABASE x`, kinds: []string{"CREATE DATABASE"}},
+		{q: `SELECT * FROM cpu; DROP DATABASE x`, kinds: []string{"SELECT", "DROP DATABASE"}},
+		{q: `;SELECT * FROM cpu;; SHOW DATABASES;`, kinds: []string{"SELECT", "SHOW DATABASES"}},
+	}
+	for _, tt := range tests {
+		q, err := ParseQuery(tt.q)
+		if err != nil {
+			t.Errorf("ParseQuery(%q): %s", tt.q, err)
+			continue
+		}
+		var kinds []string
+		for _, stmt := range q.Statements {
+			kinds = append(kinds, stmt.Kind())
+		}
+		if !reflect.DeepEqual(kinds, tt.kinds) {
+			t.Errorf("ParseQuery(%q) kinds %v, want %v", tt.q, kinds, tt.kinds)
+		}
+	}
+}
+
+func TestParseQueryError(t *testing.T) {
+	for _, q := range []string{
+		``,
+		` ; `,
+		`SELECT`,
+		`SELECT * FROM`,
+		`SELECT * FROM cpu WHERE host = 'a`,
+		`SELECT * FROM cpu WHERE (host = 'a'`,
+		`SELECT * FROM cpu x`,
+		`SELECT * FROM cpu LIMIT a`,
+		`SHOW`,
+		`value FROM cpu`,
+	} {
+		if _, err := ParseQuery(q); err == nil {
+			t.Errorf("ParseQuery(%q) succeeded", q)
+		}
+	}
+}
+
+func TestParseSelect(t *testing.T) {
+	q, err := ParseQuery(`SELECT mean(value) INTO "db"."rp"."cpu 1m" FROM db..cpu, /^mem/, (SELECT max(v) FROM "other"."autogen"."disk") ` +
+		`WHERE time > now() - 1h GROUP BY time(1m), host fill(0) ORDER BY time DESC LIMIT 10 SLIMIT 2 tz('Asia/Shanghai')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := q.Selects()[0]
+	if want := (&Measurement{Database: "db", RetentionPolicy: "rp", Name: "cpu 1m"}); !reflect.DeepEqual(s.Into, want) {
+		t.Errorf("into %+v, want %+v", s.Into, want)
+	}
+	want := []*Measurement{
+		{Database: "db", Name: "cpu"},
+		{Regex: "^mem"},
+		{Database: "other", RetentionPolicy: "autogen", Name: "disk"},
+	}
+	if ms := q.Measurements(); !reflect.DeepEqual(ms, want) {
+		t.Errorf("measurements %+v, want %+v", ms, want)
+	}
+	if dbs := q.Databases("def"); !reflect.DeepEqual(dbs, []string{"db", "def", "other"}) {
+		t.Errorf("databases %v", dbs)
+	}
+	if s.IsRaw() {
+		t.Error("mean() is raw")
+	}
+	if d := s.GroupByInterval(); d != time.Minute {
+		t.Errorf("group by interval %s, want 1m", d)
+	}
+	if s.Fill != "0" || !s.Descending || s.Limit != 10 || s.SLimit != 2 || s.Location != "Asia/Shanghai" {
+		t.Errorf("clauses %+v", s)
+	}
+}
+
+func TestIsRaw(t *testing.T) {
+	tests := []struct {
+		q    string
+		want bool
+	}{
+		{q: `SELECT * FROM cpu`, want: true},
+		{q: `SELECT value * 2, abs(value) FROM cpu`, want: true},
+		{q: `SELECT max(value) FROM cpu`},
+		{q: `SELECT abs(mean(value)) FROM cpu`},
+		{q: `SELECT value / (sum(value) + 1) FROM cpu`},
+	}
+	for _, tt := range tests {
+		q, err := ParseQuery(tt.q)
+		if err != nil {
+			t.Fatalf("ParseQuery(%q): %s", tt.q, err)
+		}
+		if got := q.Selects()[0].IsRaw(); got != tt.want {
+			t.Errorf("IsRaw(%q) = %v, want %v", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestQuote(t *testing.T) {
+	for _, s := range []string{
+		"cpu",
+		"cpu idle",
+		"select",
+		`a"b`,
+		`a\"; DROP DATABASE x; SELECT "`,
+		"a\nb",
+		"1m",
+		"",
+	} {
+		q, err := ParseQuery("SELECT value FROM " + QuoteIdent(s) + " WHERE host = " + QuoteString(s))
+		if err != nil {
+			t.Errorf("%q: %s", s, err)
+			continue
+		}
+		if n := len(q.Statements); n != 1 {
+			t.Errorf("%q: %d statements", s, n)
+			continue
+		}
+		stmt := q.Selects()[0]
+		if name := stmt.Sources[0].(*Measurement).Name; name != s {
+			t.Errorf("QuoteIdent(%q) parsed as %q", s, name)
+		}
+		cond, ok := stmt.Condition.(*BinaryExpr)
+		if !ok {
+			t.Errorf("%q: condition %#v", s, stmt.Condition)
+			continue
+		}
+		if lit, ok := cond.RHS.(*StringLiteral); !ok || lit.Val != s {
+			t.Errorf("QuoteString(%q) parsed as %#v", s, cond.RHS)
+		}
+	}
+	if got := QuoteIdent("cpu_1"); got != "cpu_1" {
+		t.Errorf("QuoteIdent(cpu_1) = %s", got)
+	}
+}
+
+func TestTimeRange(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	jan := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		where    string
+		min, max time.Time
+	}{
+		{where: `host = 'a'`},
+		{where: `time > now() - 1h`, min: now.Add(-time.Hour)},
+		{where: `time >= now() - 1h AND time < now() - 30m`, min: now.Add(-time.Hour), max: now.Add(-30 * time.Minute)},
+		{where: `now() - 1h < time`, min: now.Add(-time.Hour)},
+		{where: `time > '2020-01-01T00:00:00Z' AND host = 'a'`, min: jan},
+		{where: `time < '2020-01-01'`, max: jan},
+		{where: `time > 1577836800000ms`, min: jan},
+		{where: `time > 1577836800000000000`, min: jan},
+		{where: `(time > now() - 2h AND time > now() - 1h)`, min: now.Add(-time.Hour)},
+		{where: `time = '2020-01-01 00:00:00'`, min: jan, max: jan},
+		// bounds in OR branches are ignored
+		{where: `host = 'a' OR time > now() - 1h`},
+		{where: `time > host`},
+	}
+	for _, tt := range tests {
+		q, err := ParseQuery("SELECT * FROM cpu WHERE " + tt.where)
+		if err != nil {
+			t.Errorf("%q: %s", tt.where, err)
+			continue
+		}
+		min, max := q.Selects()[0].TimeRange(now)
+		if !min.Equal(tt.min) || !max.Equal(tt.max) {
+			t.Errorf("TimeRange(%q) = %s, %s, want %s, %s", tt.where, min, max, tt.min, tt.max)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		lit  string
+		want time.Duration
+		err  bool
+	}{
+		{lit: "10s", want: 10 * time.Second},
+		{lit: "1h30m", want: 90 * time.Minute},
+		{lit: "2d", want: 48 * time.Hour},
+		{lit: "1w", want: 7 * 24 * time.Hour},
+		{lit: "5ms", want: 5 * time.Millisecond},
+		{lit: "5u", want: 5 * time.Microsecond},
+		{lit: "10", err: true},
+		{lit: "10y", err: true},
+		{lit: "s", err: true},
+	}
+	for _, tt := range tests {
+		d, err := ParseDuration(tt.lit)
+		if (err != nil) != tt.err || d != tt.want && !tt.err {
+			t.Errorf("ParseDuration(%q) = %s, %v", tt.lit, d, err)
+		}
+	}
+}
+
+func TestParseRegex(t *testing.T) {
+	tests := []struct {
+		re   string
+		want string
+		err  bool
+	}{
+		{re: `/a.b/`, want: `a.b`},
+		{re: `/a\/b/`, want: `a/b`},
+		{re: `/a\.b/`, want: `a\.b`},
+		{re: `/a\\/`, want: `a\\`},
+		{re: `/a\\\/b/`, want: `a\\/b`},
+		{re: `/a\/`, err: true},
+		{re: `/a\`, err: true},
+	}
+	for _, tt := range tests {
+		q, err := ParseQuery("SELECT * FROM cpu WHERE host =~ " + tt.re)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: parsed", tt.re)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.re, err)
+			continue
+		}
+		cond := q.Selects()[0].Condition.(*BinaryExpr)
+		if lit, ok := cond.RHS.(*RegexLiteral); !ok || lit.Val != tt.want {
+			t.Errorf("%s: parsed as %#v, want %s", tt.re, cond.RHS, tt.want)
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package influxql
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Token is a lexical token of InfluxQL
+type Token int
+
+// Tokens
+const (
+	ILLEGAL Token = iota
+	EOF
+	WS
+
+	IDENT
+	BOUNDPARAM
+	NUMBER
+	INTEGER
+	DURATION
+	STRING
+	REGEX
+	TRUE
+	FALSE
+
+	ADD
+	SUB
+	MUL
+	DIV
+	MOD
+	BITAND
+	BITOR
+	BITXOR
+
+	AND
+	OR
+
+	EQ
+	NEQ
+	EQREGEX
+	NEQREGEX
+	LT
+	LTE
+	GT
+	GTE
+
+	LPAREN
+	RPAREN
+	COMMA
+	COLON
+	DOUBLECOLON
+	SEMICOLON
+	DOT
+
+	KEYWORD
+)
+
+var operatorNames = map[Token]string{
+	ADD: "+", SUB: "-", MUL: "*", DIV: "/", MOD: "%",
+	BITAND: "&", BITOR: "|", BITXOR: "^",
+	AND: "AND", OR: "OR",
+	EQ: "=", NEQ: "!=", EQREGEX: "=~", NEQREGEX: "!~",
+	LT: "<", LTE: "<=", GT: ">", GTE: ">=",
+}
+
+func (tok Token) String() string {
+	if s, ok := operatorNames[tok]; ok {
+		return s
+	}
+	switch tok {
+	case EOF:
+		return "EOF"
+	case LPAREN:
+		return "("
+	case RPAREN:
+		return ")"
+	case COMMA:
+		return ","
+	case SEMICOLON:
+		return ";"
+	}
+	return fmt.Sprintf("token(%d)", int(tok))
+}
+
+// precedence of binary operators, 0 for other tokens
+func (tok Token) precedence() int {
+	switch tok {
+	case OR:
+		return 1
+	case AND:
+		return 2
+	case EQ, NEQ, EQREGEX, NEQREGEX, LT, LTE, GT, GTE:
+		return 4
+	case ADD, SUB, BITOR, BITXOR:
+		return 5
+	case MUL, DIV, MOD, BITAND:
+		return 6
+	}
+	return 0
+}
+
+// keywords are returned as KEYWORD with the upper case literal, except
+// the ones which are operators or literals
+var keywords = map[string]bool{}
+
+func init() {
+	for _, k := range []string{
+		"ALL", "ALTER", "ANALYZE", "ANY", "AS", "ASC", "BEGIN", "BY",
+		"CARDINALITY", "CREATE", "CONTINUOUS", "DATABASE", "DATABASES",
+		"DEFAULT", "DELETE", "DESC", "DESTINATIONS", "DIAGNOSTICS",
+		"DISTINCT", "DROP", "DURATION", "END", "EVERY", "EXACT", "EXPLAIN",
+		"FIELD", "FOR", "FROM", "GRANT", "GRANTS", "GROUP", "GROUPS", "IN",
+		"INF", "INSERT", "INTO", "KEY", "KEYS", "KILL", "LIMIT",
+		"MEASUREMENT", "MEASUREMENTS", "NAME", "OFFSET", "ON", "ORDER",
+		"PASSWORD", "POLICY", "POLICIES", "PRIVILEGES", "QUERIES", "QUERY",
+		"READ", "REPLICATION", "RESAMPLE", "RETENTION", "REVOKE", "SELECT",
+		"SERIES", "SET", "SHARD", "SHARDS", "SHOW", "SLIMIT", "SOFFSET",
+		"STATS", "SUBSCRIPTION", "SUBSCRIPTIONS", "TAG", "TO", "USER",
+		"USERS", "VALUES", "WHERE", "WITH", "WRITE",
+	} {
+		keywords[k] = true
+	}
+}
+
+// scanner reads tokens from a query, regexes are only scanned on demand
+// since "/" is also the division operator
+type scanner struct {
+	src []rune
+	pos int
+}
+
+func newScanner(s string) *scanner {
+	return &scanner{src: []rune(s)}
+}
+
+func (s *scanner) read() rune {
+	if s.pos >= len(s.src) {
+		s.pos++
+		return 0
+	}
+	ch := s.src[s.pos]
+	s.pos++
+	return ch
+}
+
+func (s *scanner) unread() {
+	s.pos--
+}
+
+func (s *scanner) peek() rune {
+	if s.pos >= len(s.src) {
+		return 0
+	}
+	return s.src[s.pos]
+}
+
+// scan returns the next token, its position and literal
+func (s *scanner) scan() (Token, int, string) {
+	pos := s.pos
+	ch := s.read()
+
+	switch {
+	case ch == 0 && pos >= len(s.src):
+		return EOF, pos, ""
+	case unicode.IsSpace(ch):
+		for unicode.IsSpace(s.peek()) {
+			s.read()
+		}
+		return WS, pos, ""
+	case isIdentStart(ch):
+		s.unread()
+		return s.scanIdent(pos)
+	case ch == '"':
+		lit, err := s.scanQuoted('"')
+		if err != nil {
+			return ILLEGAL, pos, err.Error()
+		}
+		return IDENT, pos, lit
+	case ch == '\'':
+		lit, err := s.scanQuoted('\'')
+		if err != nil {
+			return ILLEGAL, pos, err.Error()
+		}
+		return STRING, pos, lit
+	case ch == '.':
+		if unicode.IsDigit(s.peek()) {
+			s.unread()
+			return s.scanNumber(pos)
+		}
+		return DOT, pos, "."
+	case ch == '$':
+		tok, _, lit := s.scanIdent(s.pos)
+		if tok != IDENT {
+			return ILLEGAL, pos, "$"
+		}
+		return BOUNDPARAM, pos, lit
+	case unicode.IsDigit(ch):
+		s.unread()
+		return s.scanNumber(pos)
+	}
+
+	switch ch {
+	case '+':
+		return ADD, pos, "+"
+	case '-':
+		if s.peek() == '-' {
+			// comment until the end of line
+			for ch := s.read(); ch != '\n' && ch != 0; ch = s.read() {
+			}
+			return WS, pos, ""
+		}
+		return SUB, pos, "-"
+	case '*':
+		return MUL, pos, "*"
+	case '/':
+		return DIV, pos, "/"
+	case '%':
+		return MOD, pos, "%"
+	case '&':
+		return BITAND, pos, "&"
+	case '|':
+		return BITOR, pos, "|"
+	case '^':
+		return BITXOR, pos, "^"
+	case '=':
+		if s.peek() == '~' {
+			s.read()
+			return EQREGEX, pos, "=~"
+		}
+		return EQ, pos, "="
+	case '!':
+		switch s.peek() {
+		case '=':
+			s.read()
+			return NEQ, pos, "!="
+		case '~':
+			s.read()
+			return NEQREGEX, pos, "!~"
+		}
+	case '<':
+		switch s.peek() {
+		case '=':
+			s.read()
+			return LTE, pos, "<="
+		case '>':
+			s.read()
+			return NEQ, pos, "<>"
+		}
+		return LT, pos, "<"
+	case '>':
+		if s.peek() == '=' {
+			s.read()
+			return GTE, pos, ">="
+		}
+		return GT, pos, ">"
+	case '(':
+		return LPAREN, pos, "("
+	case ')':
+		return RPAREN, pos, ")"
+	case ',':
+		return COMMA, pos, ","
+	case ';':
+		return SEMICOLON, pos, ";"
+	case ':':
+		if s.peek() == ':' {
+			s.read()
+			return DOUBLECOLON, pos, "::"
+		}
+		return COLON, pos, ":"
+	}
+	return ILLEGAL, pos, string(ch)
+}
+
+func (s *scanner) scanIdent(pos int) (Token, int, string) {
+	var buf bytes.Buffer
+	for ch := s.peek(); isIdentChar(ch); ch = s.peek() {
+		buf.WriteRune(s.read())
+	}
+	lit := buf.String()
+	upper := strings.ToUpper(lit)
+	switch upper {
+	case "AND":
+		return AND, pos, lit
+	case "OR":
+		return OR, pos, lit
+	case "TRUE":
+		return TRUE, pos, lit
+	case "FALSE":
+		return FALSE, pos, lit
+	}
+	if keywords[upper] {
+		return KEYWORD, pos, upper
+	}
+	return IDENT, pos, lit
+}
+
+func (s *scanner) scanQuoted(quote rune) (string, error) {
+	var buf bytes.Buffer
+	for {
+		ch := s.read()
+		switch ch {
+		case quote:
+			return buf.String(), nil
+		case 0:
+			if s.pos > len(s.src) {
+				return "", fmt.Errorf("unterminated quoted string")
+			}
+		case '\\':
+			next := s.read()
+			switch next {
+			case 'n':
+				buf.WriteRune('\n')
+			case '\\', '"', '\'':
+				buf.WriteRune(next)
+			default:
+				return "", fmt.Errorf("bad escape \\%c", next)
+			}
+			continue
+		}
+		buf.WriteRune(ch)
+	}
+}
+
+// scanNumber scans integers, floats and durations like 10s or 1h30m
+func (s *scanner) scanNumber(pos int) (Token, int, string) {
+	var buf bytes.Buffer
+	isFloat := false
+	for ch := s.peek(); unicode.IsDigit(ch) || ch == '.'; ch = s.peek() {
+		if ch == '.' {
+			if isFloat {
+				break
+			}
+			isFloat = true
+		}
+		buf.WriteRune(s.read())
+	}
+	if !isFloat && isDurationUnit(s.peek()) {
+		for {
+			for isDurationUnit(s.peek()) {
+				buf.WriteRune(s.read())
+			}
+			if !unicode.IsDigit(s.peek()) {
+				break
+			}
+			for unicode.IsDigit(s.peek()) {
+				buf.WriteRune(s.read())
+			}
+		}
+		return DURATION, pos, buf.String()
+	}
+	if ch := s.peek(); ch == 'e' || ch == 'E' {
+		s.read()
+		isFloat = true
+		buf.WriteRune(ch)
+		if ch := s.peek(); ch == '+' || ch == '-' {
+			buf.WriteRune(s.read())
+		}
+		for unicode.IsDigit(s.peek()) {
+			buf.WriteRune(s.read())
+		}
+	}
+	if isFloat {
+		return NUMBER, pos, buf.String()
+	}
+	return INTEGER, pos, buf.String()
+}
+
+// scanRegex scans a regex, the opening "/" already read
+func (s *scanner) scanRegex() (string, error) {
+	var buf bytes.Buffer
+	for {
+		ch := s.read()
+		switch ch {
+		case '/':
+			return buf.String(), nil
+		case 0:
+			if s.pos > len(s.src) {
+				return "", fmt.Errorf("unterminated regex")
+			}
+		case '\\':
+			// like influxdb, an escaped slash is a slash and other
+			// escapes are kept, the pair is read at once
+			next := s.read()
+			if next == 0 && s.pos > len(s.src) {
+				return "", fmt.Errorf("unterminated regex")
+			}
+			if next != '/' {
+				buf.WriteRune(ch)
+			}
+			buf.WriteRune(next)
+			continue
+		}
+		buf.WriteRune(ch)
+	}
+}
+
+func isDurationUnit(ch rune) bool {
+	switch ch {
+	case 'n', 'u', 'µ', 'm', 's', 'h', 'd', 'w':
+		return true
+	}
+	return false
+}
+
+func isIdentStart(ch rune) bool {
+	return unicode.IsLetter(ch) || ch == '_'
+}
+
+func isIdentChar(ch rune) bool {
+	return isIdentStart(ch) || unicode.IsDigit(ch)
+}
@@ -0,0 +1,389 @@
+// Package jobs runs maintenance operations, like dropping measurements or
+// deleting the points of a host, in the background. A job is a list of
+// statements, one per measurement, run with a limited concurrency per
+// influxdb cluster. Jobs are saved to disk and resumed after a restart.
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lodastack/router/config"
+	"github.com/lodastack/router/influx"
+	"github.com/lodastack/router/loda"
+
+	"github.com/lodastack/log"
+)
+
+// states of jobs and tasks
+const (
+	Queued   = "queued"
+	Running  = "running"
+	Done     = "done"
+	Failed   = "failed"
+	Canceled = "canceled"
+)
+
+const (
+	defaultClusterConcurrency = 2
+	defaultRetention          = 7 * 24 * time.Hour
+	purgeInterval             = time.Hour
+)
+
+// ErrNotFound is returned for unknown job ids
+var ErrNotFound = fmt.Errorf("job not found")
+
+// Task is a statement of a job on one measurement
+type Task struct {
+	Measurement string `json:"measurement"`
+	Query       string `json:"query"`
+	State       string `json:"state"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Job is a maintenance operation on a namespace
+type Job struct {
+	ID       string            `json:"id"`
+	Kind     string            `json:"kind"`
+	NS       string            `json:"ns"`
+	Params   map[string]string `json:"params,omitempty"`
+	State    string            `json:"state"`
+	Error    string            `json:"error,omitempty"`
+	Created  time.Time         `json:"created"`
+	Started  *time.Time        `json:"started,omitempty"`
+	Finished *time.Time        `json:"finished,omitempty"`
+	Total    int               `json:"total"`
+	Done     int               `json:"done"`
+	Failed   int               `json:"failed"`
+	Tasks    []*Task           `json:"tasks"`
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+}
+
+type jobJSON Job
+
+// MarshalJSON encodes the job under its lock
+func (j *Job) MarshalJSON() ([]byte, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return json.Marshal((*jobJSON)(j))
+}
+
+// finished reports whether the job is over
+func (j *Job) finished() bool {
+	return j.State == Done || j.State == Failed || j.State == Canceled
+}
+
+var (
+	mu    sync.RWMutex
+	jobs  = make(map[string]*Job)
+	store *jobStore
+
+	semMu sync.Mutex
+	sems  = make(map[string]chan struct{})
+
+	// influxDBs routes a namespace to its cluster
+	influxDBs = loda.InfluxDBs
+)
+
+// Init loads the saved jobs and resumes the unfinished ones
+func Init() {
+	c := config.GetConfig().Jobs
+	if c.Path != "" {
+		s, err := newJobStore(c.Path)
+		if err != nil {
+			log.Errorf("open jobs %s failed: %s", c.Path, err)
+		} else {
+			store = s
+		}
+	}
+	if store != nil {
+		loaded, err := store.load()
+		if err != nil {
+			log.Errorf("load jobs failed: %s", err)
+		}
+		for _, j := range loaded {
+			mu.Lock()
+			jobs[j.ID] = j
+			mu.Unlock()
+			if !j.finished() {
+				log.Infof("resume job %s %s on %s", j.ID, j.Kind, j.NS)
+				start(j)
+			}
+		}
+	}
+	go purge()
+}
+
+// Submit creates a job of kind running the statements of tasks on ns
+func Submit(kind, ns string, params map[string]string, tasks []Task) (*Job, error) {
+	if len(tasks) == 0 {
+		return nil, fmt.Errorf("nothing to do")
+	}
+	j := &Job{
+		ID:      newID(),
+		Kind:    kind,
+		NS:      ns,
+		Params:  params,
+		State:   Queued,
+		Created: time.Now(),
+		Total:   len(tasks),
+	}
+	for i := range tasks {
+		t := tasks[i]
+		t.State = Queued
+		j.Tasks = append(j.Tasks, &t)
+	}
+	mu.Lock()
+	jobs[j.ID] = j
+	mu.Unlock()
+	save(j)
+	start(j)
+	return j, nil
+}
+
+// Get returns the job of id
+func Get(id string) (*Job, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	j, ok := jobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return j, nil
+}
+
+// List returns the jobs of ns in state, the latest first, empty
+// arguments match all.
+func List(ns, state string) []*Job {
+	mu.RLock()
+	res := make([]*Job, 0, len(jobs))
+	for _, j := range jobs {
+		j.mu.Lock()
+		match := (ns == "" || j.NS == ns) && (state == "" || j.State == state)
+		j.mu.Unlock()
+		if match {
+			res = append(res, j)
+		}
+	}
+	mu.RUnlock()
+	sort.Slice(res, func(i, k int) bool { return res[i].Created.After(res[k].Created) })
+	return res
+}
+
+// Cancel stops a job, the running statement is killed
+func Cancel(id string) (*Job, error) {
+	j, err := Get(id)
+	if err != nil {
+		return nil, err
+	}
+	j.mu.Lock()
+	if j.finished() {
+		j.mu.Unlock()
+		return j, fmt.Errorf("job %s is %s", id, j.State)
+	}
+	cancel := j.cancel
+	j.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	return j, nil
+}
+
+func start(j *Job) {
+	ctx, cancel := context.WithCancel(context.Background())
+	j.mu.Lock()
+	j.cancel = cancel
+	j.mu.Unlock()
+	go run(ctx, j)
+}
+
+func run(ctx context.Context, j *Job) {
+	j.mu.Lock()
+	j.State = Running
+	if j.Started == nil {
+		now := time.Now()
+		j.Started = &now
+	}
+	j.mu.Unlock()
+	save(j)
+
+	// tasks run concurrently, as many at a time as their cluster allows
+	var wg sync.WaitGroup
+	for _, t := range j.Tasks {
+		if ctx.Err() != nil {
+			break
+		}
+		j.mu.Lock()
+		pending := t.State == Queued || t.State == Running
+		j.mu.Unlock()
+		if !pending {
+			continue
+		}
+		hosts, err := influxDBs(j.NS)
+		if err == nil && len(hosts) == 0 {
+			err = fmt.Errorf("%s has no route config", j.NS)
+		}
+		if err != nil {
+			finishTask(ctx, j, t, err)
+			continue
+		}
+		sem := clusterSem(hosts)
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			continue
+		}
+		j.mu.Lock()
+		t.State = Running
+		j.mu.Unlock()
+		wg.Add(1)
+		go func(t *Task) {
+			defer wg.Done()
+			err := runTask(ctx, j.NS, hosts, t)
+			<-sem
+			finishTask(ctx, j, t, err)
+		}(t)
+	}
+	wg.Wait()
+
+	j.mu.Lock()
+	switch {
+	case ctx.Err() != nil:
+		j.State = Canceled
+		for _, t := range j.Tasks {
+			if t.State == Queued || t.State == Running {
+				t.State = Canceled
+			}
+		}
+	case j.Failed > 0:
+		j.State = Failed
+		j.Error = fmt.Sprintf("%d of %d statements failed", j.Failed, j.Total)
+	default:
+		j.State = Done
+	}
+	now := time.Now()
+	j.Finished = &now
+	j.cancel = nil
+	state := j.State
+	j.mu.Unlock()
+	save(j)
+	log.Infof("job %s %s on %s %s", j.ID, j.Kind, j.NS, state)
+}
+
+// finishTask records the result of t
+func finishTask(ctx context.Context, j *Job, t *Task, err error) {
+	j.mu.Lock()
+	switch {
+	case ctx.Err() != nil:
+		t.State = Canceled
+	case err != nil:
+		t.State, t.Error = Failed, err.Error()
+		j.Failed++
+		j.Done++
+	default:
+		t.State = Done
+		j.Done++
+	}
+	j.mu.Unlock()
+	save(j)
+}
+
+// runTask runs the statement of t on hosts, the cluster of ns
+func runTask(ctx context.Context, ns string, hosts []string, t *Task) error {
+	resp, err := influx.QueryAllContext(ctx, hosts, map[string]string{"db": ns, "q": t.Query}, "")
+	if err != nil {
+		return err
+	}
+	return resultError(resp.Body)
+}
+
+// resultError returns the error of an influxdb response body
+func resultError(body []byte) error {
+	var rs struct {
+		Results []struct {
+			Error string `json:"error"`
+		} `json:"results"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &rs); err != nil {
+		return fmt.Errorf("invalid response: %s", err)
+	}
+	if rs.Error != "" {
+		return fmt.Errorf("%s", rs.Error)
+	}
+	for _, r := range rs.Results {
+		if r.Error != "" {
+			return fmt.Errorf("%s", r.Error)
+		}
+	}
+	return nil
+}
+
+// clusterSem returns the semaphore of the cluster of hosts
+func clusterSem(hosts []string) chan struct{} {
+	sorted := append([]string(nil), hosts...)
+	sort.Strings(sorted)
+	key := strings.Join(sorted, ",")
+
+	semMu.Lock()
+	defer semMu.Unlock()
+	sem, ok := sems[key]
+	if !ok {
+		n := config.GetConfig().Jobs.ClusterConcurrency
+		if n <= 0 {
+			n = defaultClusterConcurrency
+		}
+		sem = make(chan struct{}, n)
+		sems[key] = sem
+	}
+	return sem
+}
+
+func save(j *Job) {
+	if store == nil {
+		return
+	}
+	if err := store.save(j); err != nil {
+		log.Errorf("save job %s failed: %s", j.ID, err)
+	}
+}
+
+// purge removes the jobs finished before the retention
+func purge() {
+	retention := defaultRetention
+	if h := config.GetConfig().Jobs.Retention; h > 0 {
+		retention = time.Duration(h) * time.Hour
+	}
+	for range time.Tick(purgeInterval) {
+		deadline := time.Now().Add(-retention)
+		mu.Lock()
+		for id, j := range jobs {
+			j.mu.Lock()
+			old := j.finished() && j.Finished != nil && j.Finished.Before(deadline)
+			j.mu.Unlock()
+			if !old {
+				continue
+			}
+			delete(jobs, id)
+			if store != nil {
+				store.remove(id)
+			}
+		}
+		mu.Unlock()
+	}
+}
+
+func newID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%s", time.Now().Format("20060102150405"), hex.EncodeToString(b))
+}
@@ -0,0 +1,158 @@
+package jobs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lodastack/router/config"
+)
+
+func TestResultError(t *testing.T) {
+	tests := []struct {
+		body string
+		err  bool
+	}{
+		{body: `{"results":[{"statement_id":0}]}`},
+		{body: `{"results":[{"statement_id":0,"error":"measurement not found"}]}`, err: true},
+		{body: `{"error":"error parsing query"}`, err: true},
+		{body: `<html>502 Bad Gateway</html>`, err: true},
+		{body: ``, err: true},
+	}
+	for _, tt := range tests {
+		if err := resultError([]byte(tt.body)); (err != nil) != tt.err {
+			t.Errorf("resultError(%q) = %v, want error %v", tt.body, err, tt.err)
+		}
+	}
+}
+
+// loadConfig points the jobs at srv, queries of the query client time out
+// after 100ms
+func loadConfig(t *testing.T, srv *httptest.Server) {
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	f, err := ioutil.TempFile("", "router-*.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintf(f, "[common]\ninfluxdPort = %s\n[jobs]\nclusterConcurrency = 3\n[influxdb.query]\ntimeout = 100\n", port)
+	f.Close()
+	if err := config.LoadConfig(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	influxDBs = func(ns string) ([]string, error) { return []string{"127.0.0.1"}, nil }
+}
+
+// wait waits up to 2s for j to finish
+func wait(j *Job) {
+	for i := 0; i < 200; i++ {
+		j.mu.Lock()
+		finished := j.finished()
+		j.mu.Unlock()
+		if finished {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	var running, max int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		running++
+		if running > max {
+			max = running
+		}
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		if strings.Contains(r.FormValue("q"), "bad") {
+			fmt.Fprint(w, `{"results":[{"statement_id":0,"error":"bad statement"}]}`)
+			return
+		}
+		fmt.Fprint(w, `{"results":[{"statement_id":0}]}`)
+	}))
+	defer srv.Close()
+	loadConfig(t, srv)
+
+	var tasks []Task
+	for i := 0; i < 10; i++ {
+		tasks = append(tasks, Task{Measurement: fmt.Sprintf("m%d", i), Query: fmt.Sprintf(`DROP MEASUREMENT "m%d"`, i)})
+	}
+	tasks = append(tasks, Task{Measurement: "bad", Query: "DROP bad"})
+	j, err := Submit("drop", "collect.test", nil, tasks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait(j)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.State != Failed || j.Done != 11 || j.Failed != 1 {
+		t.Errorf("job %s, done %d, failed %d", j.State, j.Done, j.Failed)
+	}
+	for _, task := range j.Tasks {
+		want := Done
+		if task.Measurement == "bad" {
+			want = Failed
+		}
+		if task.State != want {
+			t.Errorf("task %s is %s, want %s", task.Measurement, task.State, want)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if max != 3 {
+		t.Errorf("%d statements at once, want 3", max)
+	}
+}
+
+func TestRunSlowStatement(t *testing.T) {
+	var mu sync.Mutex
+	var kills int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.FormValue("q")
+		if strings.HasPrefix(q, "SHOW QUERIES") || strings.HasPrefix(q, "KILL QUERY") {
+			mu.Lock()
+			kills++
+			mu.Unlock()
+			fmt.Fprint(w, `{"results":[{"statement_id":0}]}`)
+			return
+		}
+		// longer than the timeout of the query client
+		time.Sleep(300 * time.Millisecond)
+		fmt.Fprint(w, `{"results":[{"statement_id":0}]}`)
+	}))
+	defer srv.Close()
+	loadConfig(t, srv)
+
+	j, err := Submit("delete", "collect.test", nil, []Task{{Measurement: "cpu", Query: `DELETE FROM "cpu"`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait(j)
+
+	j.mu.Lock()
+	if j.State != Done || j.Done != 1 || j.Failed != 0 {
+		t.Errorf("job %s, done %d, failed %d", j.State, j.Done, j.Failed)
+	}
+	j.mu.Unlock()
+	// a kill runs in the background
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if kills != 0 {
+		t.Errorf("%d SHOW QUERIES or KILL QUERY sent", kills)
+	}
+}
@@ -0,0 +1,71 @@
+package jobs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// jobStore saves every job to a JSON file in dir
+type jobStore struct {
+	dir string
+	// the tasks of a job finish concurrently
+	mu sync.Mutex
+}
+
+func newJobStore(dir string) (*jobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &jobStore{dir: dir}, nil
+}
+
+func (s *jobStore) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// save replaces the file of j at once
+func (s *jobStore) save(j *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	tmp := s.path(j.ID) + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(j.ID))
+}
+
+func (s *jobStore) remove(id string) {
+	os.Remove(s.path(id))
+}
+
+// load reads all saved jobs, broken files are skipped
+func (s *jobStore) load() ([]*Job, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var res []*Job
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(s.dir, f.Name()))
+		if err != nil {
+			continue
+		}
+		j := &Job{}
+		if err := json.Unmarshal(b, (*jobJSON)(j)); err != nil || j.ID == "" {
+			continue
+		}
+		res = append(res, j)
+	}
+	return res, nil
+}
@@ -1,6 +1,7 @@
 package loda
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"strings"
@@ -28,12 +29,22 @@ var (
 	RegistryAddr string
 	// ExpireDur is expiire duration
 	ExpireDur int
+
+	httpClient *requests.Client
+
+	hooksMu sync.Mutex
+	hooks   []RouteChange
 )
 
+// RouteChange is called when registry routes ns from the old dbs to new
+type RouteChange func(ns string, old, new []string)
+
 type client struct {
 	// cache ns -> dbs in this map
 	db map[string][]string
-	mu sync.RWMutex
+	// last dbs seen of ns, kept when the cache is purged
+	last map[string][]string
+	mu   sync.RWMutex
 }
 
 type respNS struct {
@@ -56,11 +67,59 @@ func Init(regAddr string, expireDur int) {
 	RegistryAddr = regAddr
 	ExpireDur = expireDur
 	PurgeChan = make(chan string)
+	httpClient = requests.NewClient(config.GetConfig().Reg.HTTP.GetOptions())
 	Client = &client{
-		db: make(map[string][]string),
+		db:   make(map[string][]string),
+		last: make(map[string][]string),
 	}
 }
 
+// OnRouteChange registers f, it is called in its own goroutine when the
+// dbs of a namespace change
+func OnRouteChange(f RouteChange) {
+	hooksMu.Lock()
+	hooks = append(hooks, f)
+	hooksMu.Unlock()
+}
+
+// set caches the dbs of ns and calls the hooks if they changed
+func (c *client) set(ns string, dbs []string) {
+	c.mu.Lock()
+	old, known := c.last[ns]
+	c.db[ns] = dbs
+	if len(dbs) > 0 {
+		c.last[ns] = dbs
+	}
+	c.mu.Unlock()
+	if !known || len(old) == 0 || len(dbs) == 0 || sameHosts(old, dbs) {
+		return
+	}
+	log.Warningf("route of ns %s changed from %v to %v", ns, old, dbs)
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	for _, f := range hooks {
+		go f(ns, old, dbs)
+	}
+}
+
+// sameHosts reports whether a and b hold the same hosts in any order
+func sameHosts(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]int, len(a))
+	for _, h := range a {
+		seen[h]++
+	}
+	for _, h := range b {
+		if seen[h] == 0 {
+			return false
+		}
+		seen[h]--
+	}
+	return true
+}
+
 // PurgeAll clean all cache data
 func PurgeAll() {
 	var ticker *time.Ticker
@@ -73,15 +132,12 @@ func PurgeAll() {
 	for {
 		select {
 		case <-ticker.C:
-			url := fmt.Sprintf("%s/api/v1/router/ns?ns=&format=list", RegistryAddr)
-			res, err := allNS(url)
+			res, err := Namespaces()
 			if err == nil {
 				for _, ns := range res {
 					dbs, err := updateInfluxDBs(ns)
 					if err == nil {
-						Client.mu.Lock()
-						Client.db["collect."+ns] = dbs
-						Client.mu.Unlock()
+						Client.set(ns, dbs)
 					} else {
 						log.Errorf("update ns: %s cache failed: %s", ns, err)
 					}
@@ -98,6 +154,19 @@ func PurgeAll() {
 	}
 }
 
+// Namespaces lists the collect namespaces of the registry
+func Namespaces() ([]string, error) {
+	url := fmt.Sprintf("%s/api/v1/router/ns?ns=&format=list", RegistryAddr)
+	res, err := allNS(url)
+	if err != nil {
+		return nil, err
+	}
+	for i, ns := range res {
+		res[i] = "collect." + ns
+	}
+	return res, nil
+}
+
 func (c *client) purge(ns string) {
 	c.mu.Lock()
 	if _, ok := c.db[ns]; ok {
@@ -121,9 +190,7 @@ func InfluxDBs(ns string) ([]string, error) {
 	if err != nil {
 		return res, err
 	}
-	Client.mu.Lock()
-	Client.db[ns] = dbs
-	Client.mu.Unlock()
+	Client.set(ns, dbs)
 	return dbs, nil
 }
 
@@ -171,7 +238,7 @@ func servers(url string) ([]string, error) {
 	var res []string
 	var resdb respDB
 
-	resp, err := requests.Get(url)
+	resp, err := httpClient.Get(context.Background(), url)
 	if err != nil {
 		return res, err
 	}
@@ -193,7 +260,7 @@ func servers(url string) ([]string, error) {
 func allNS(url string) ([]string, error) {
 	var resNS respNS
 	var res []string
-	resp, err := requests.Get(url)
+	resp, err := httpClient.Get(context.Background(), url)
 	if err != nil {
 		return res, err
 	}
@@ -235,6 +302,11 @@ type CollectMetric struct {
 	Level           string `json:"level"`
 	Group           string `json:"group"`
 	PassLine        string `json:"passline"`
+
+	// metadata of the measurements named by Name
+	Unit       string `json:"unit"`
+	MetricType string `json:"metric_type"`
+	Category   string `json:"category"`
 }
 
 // RespCollect is http respon struct
@@ -253,7 +325,7 @@ func CollectMetrics(ns string) ([]CollectMetric, error) {
 
 	uri := fmt.Sprintf(CollectURI, ns)
 	url := fmt.Sprintf("%s%s", RegistryAddr, uri)
-	resp, err := requests.Get(url)
+	resp, err := httpClient.Get(context.Background(), url)
 	if err != nil {
 		return res, err
 	}
@@ -0,0 +1,268 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/lodastack/router/config"
+	"github.com/lodastack/router/influx"
+	"github.com/lodastack/router/influxql"
+	"github.com/lodastack/router/models"
+
+	"github.com/lodastack/log"
+)
+
+const (
+	// measurements are copied window by window, a checkpoint each
+	window = 6 * time.Hour
+	// a window is read as it is written, at the rate of the migration
+	windowTimeout = 30 * time.Minute
+	queryTimeout  = 2 * time.Minute
+	writeBatch    = 5000
+	retries       = 3
+	retryBackoff  = time.Second
+)
+
+// series is a series of an influxdb response
+type series struct {
+	Tags    map[string]string `json:"tags"`
+	Columns []string          `json:"columns"`
+	Values  [][]interface{}   `json:"values"`
+}
+
+type response struct {
+	Results []struct {
+		Series []series `json:"series"`
+		Error  string   `json:"error"`
+	} `json:"results"`
+	Error string `json:"error"`
+}
+
+// err returns the error of the response or of a statement
+func (rs *response) err() error {
+	if rs.Error != "" {
+		return fmt.Errorf("%s", rs.Error)
+	}
+	for _, r := range rs.Results {
+		if r.Error != "" {
+			return fmt.Errorf("%s", r.Error)
+		}
+	}
+	return nil
+}
+
+// limiter spaces writes to rate points per second
+type limiter struct {
+	rate  float64
+	start time.Time
+	sent  int64
+}
+
+func (l *limiter) wait(ctx context.Context, n int) error {
+	l.sent += int64(n)
+	expected := time.Duration(float64(l.sent) / l.rate * float64(time.Second))
+	if wait := expected - time.Since(l.start); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// copyHistory copies the measurements of m from their checkpoints up to
+// Until, after it passed.
+func copyHistory(ctx context.Context, m *Migration) error {
+	m.mu.Lock()
+	listed := len(m.Measurements) > 0
+	m.mu.Unlock()
+	if !listed {
+		names, err := measurements(ctx, m.NS, m.From)
+		if err != nil {
+			return fmt.Errorf("list measurements: %s", err)
+		}
+		m.mu.Lock()
+		if ctx.Err() != nil {
+			m.mu.Unlock()
+			return ctx.Err()
+		}
+		for _, name := range names {
+			m.Measurements = append(m.Measurements, &Measurement{Name: name, Checkpoint: m.Since})
+		}
+		m.mu.Unlock()
+		save(m)
+	}
+
+	if wait := time.Until(time.Unix(m.Until, 0)); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	rate := config.GetConfig().Migrate.Rate
+	if rate <= 0 {
+		rate = defaultRate
+	}
+	l := &limiter{rate: float64(rate), start: time.Now()}
+	for _, mt := range m.Measurements {
+		m.mu.Lock()
+		done, checkpoint := mt.Done, mt.Checkpoint
+		m.mu.Unlock()
+		for !done {
+			end := checkpoint + int64(window.Seconds())
+			if end > m.Until {
+				end = m.Until
+			}
+			n, err := copyWindowRetry(ctx, m, mt.Name, checkpoint, end, l)
+			if err != nil {
+				return fmt.Errorf("copy %s at %d: %s", mt.Name, checkpoint, err)
+			}
+			checkpoint = end
+			done = end >= m.Until
+
+			m.mu.Lock()
+			// stop saved the state of a canceled migration
+			if ctx.Err() != nil {
+				m.mu.Unlock()
+				return ctx.Err()
+			}
+			mt.Checkpoint, mt.Done = checkpoint, done
+			mt.Points += n
+			m.Points += n
+			m.mu.Unlock()
+			save(m)
+		}
+	}
+	return nil
+}
+
+func copyWindowRetry(ctx context.Context, m *Migration, name string, from, to int64, l *limiter) (int64, error) {
+	backoff := retryBackoff
+	for i := 0; ; i++ {
+		n, err := copyWindow(ctx, m, name, from, to, l)
+		if err == nil || i >= retries || ctx.Err() != nil {
+			return n, err
+		}
+		log.Warningf("copy %s of %s failed, retry: %s", name, m.NS, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// copyWindow copies the points of measurement name between from and to.
+// The window is read in chunks of writeBatch points, each written before
+// the next is read.
+func copyWindow(ctx context.Context, m *Migration, name string, from, to int64, l *limiter) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, windowTimeout)
+	defer cancel()
+	resp, err := influx.QueryStreamTimeout(ctx, m.From, map[string]string{
+		"db":         m.NS,
+		"q":          fmt.Sprintf("SELECT * FROM %s WHERE time >= %ds AND time < %ds GROUP BY *", influxql.QuoteIdent(name), from, to),
+		"epoch":      "s",
+		"chunked":    "true",
+		"chunk_size": strconv.Itoa(writeBatch),
+	}, "", windowTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var n int64
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var rs response
+		if err := dec.Decode(&rs); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		if err := rs.err(); err != nil {
+			return n, err
+		}
+
+		var buf bytes.Buffer
+		var lines int
+		for _, r := range rs.Results {
+			for _, s := range r.Series {
+				for _, v := range s.Values {
+					p := &models.Point{Measurement: name, Tags: s.Tags, Fields: make(map[string]interface{})}
+					for i, col := range s.Columns {
+						if i >= len(v) || v[i] == nil {
+							continue
+						}
+						if col == "time" {
+							if ts, ok := v[i].(float64); ok {
+								p.Timestamp = int64(ts)
+							}
+							continue
+						}
+						p.Fields[col] = v[i]
+					}
+					if len(p.Fields) == 0 {
+						continue
+					}
+					buf.WriteString(p.Line())
+					buf.WriteByte('\n')
+					lines++
+				}
+			}
+		}
+		if lines == 0 {
+			continue
+		}
+		if err := influx.WriteLines(m.To, m.NS, "s", buf.Bytes()); err != nil {
+			return n, err
+		}
+		n += int64(lines)
+		if err := l.wait(ctx, lines); err != nil {
+			return n, err
+		}
+	}
+}
+
+// measurements lists the measurements of ns on hosts
+func measurements(ctx context.Context, ns string, hosts []string) ([]string, error) {
+	rs, err := query(ctx, ns, hosts, "SHOW MEASUREMENTS")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, r := range rs.Results {
+		for _, s := range r.Series {
+			for _, v := range s.Values {
+				if len(v) > 0 {
+					if name, ok := v[0].(string); ok {
+						names = append(names, name)
+					}
+				}
+			}
+		}
+	}
+	return names, nil
+}
+
+func query(ctx context.Context, ns string, hosts []string, q string) (*response, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	resp, err := influx.QueryRaw(ctx, hosts, map[string]string{"db": ns, "q": q, "epoch": "s"}, "")
+	if err != nil {
+		return nil, err
+	}
+	var rs response
+	if err := json.Unmarshal(resp.Body, &rs); err != nil {
+		return nil, err
+	}
+	return &rs, rs.err()
+}
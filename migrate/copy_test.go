@@ -0,0 +1,321 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lodastack/router/config"
+)
+
+const (
+	testNS    = "collect.a"
+	testUntil = int64(1600000000)
+	// three windows, the last one shorter
+	testSince = testUntil - 13*3600
+)
+
+var (
+	testFrom = []string{"127.0.0.1"}
+	testTo   = []string{"localhost"}
+)
+
+var windowRe = regexp.MustCompile(`FROM "?(\w+)"? WHERE time >= (\d+)s AND time < (\d+)s`)
+
+// fakeInfluxDB is the old cluster on 127.0.0.1 and the new one on
+// localhost. It answers SELECT with a chunk a point and records the
+// windows read and the lines written.
+type fakeInfluxDB struct {
+	points map[string][]int64
+	// block holds the SELECTs until it is closed
+	block chan struct{}
+
+	mu      sync.Mutex
+	windows []string
+	written map[string][]string
+	aborted int
+}
+
+func newFakeInfluxDB(t *testing.T, points map[string][]int64) (*fakeInfluxDB, *httptest.Server) {
+	db := &fakeInfluxDB{points: points, written: make(map[string][]string)}
+	srv := httptest.NewServer(db)
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.GetConfig().Com.InfluxdPort = p
+	return db, srv
+}
+
+func (db *fakeInfluxDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host, _, _ := net.SplitHostPort(r.Host)
+	if r.URL.Path == "/write" {
+		b, _ := ioutil.ReadAll(r.Body)
+		db.mu.Lock()
+		db.written[host] = append(db.written[host], strings.Fields(strings.Replace(string(b), " ", "_", -1))...)
+		db.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	q := r.FormValue("q")
+	switch {
+	case q == "SHOW MEASUREMENTS":
+		var names [][]interface{}
+		for name := range db.points {
+			names = append(names, []interface{}{name})
+		}
+		sort.Slice(names, func(i, j int) bool { return names[i][0].(string) < names[j][0].(string) })
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": []interface{}{map[string]interface{}{
+			"series": []interface{}{map[string]interface{}{"name": "measurements", "columns": []string{"name"}, "values": names}},
+		}}})
+	case strings.HasPrefix(q, "SELECT"):
+		m := windowRe.FindStringSubmatch(q)
+		if m == nil || host != "127.0.0.1" {
+			http.Error(w, `{"error":"unexpected query"}`, http.StatusBadRequest)
+			return
+		}
+		db.mu.Lock()
+		db.windows = append(db.windows, m[1]+" "+m[2])
+		db.mu.Unlock()
+		if db.block != nil {
+			select {
+			case <-db.block:
+			case <-r.Context().Done():
+				db.mu.Lock()
+				db.aborted++
+				db.mu.Unlock()
+				return
+			}
+		}
+		from, _ := strconv.ParseInt(m[2], 10, 64)
+		to, _ := strconv.ParseInt(m[3], 10, 64)
+		for _, ts := range db.points[m[1]] {
+			if ts >= from && ts < to {
+				fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[{"name":%q,"tags":{"host":"a"},"columns":["time","value"],"values":[[%d,1]]}],"partial":true}]}`+"\n", m[1], ts)
+			}
+		}
+	default:
+		// SHOW QUERIES and KILL QUERY of a canceled copy
+		fmt.Fprint(w, `{"results":[{"statement_id":0}]}`)
+	}
+}
+
+func (db *fakeInfluxDB) copied(host string) []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append([]string(nil), db.written[host]...)
+}
+
+func (db *fakeInfluxDB) read() []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append([]string(nil), db.windows...)
+}
+
+// useStore saves the migrations to a temp dir and forgets them after the
+// test
+func useStore(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newMigrationStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	store, migrations = s, make(map[string]*Migration)
+	mu.Unlock()
+	return func() {
+		mu.Lock()
+		store, migrations = nil, make(map[string]*Migration)
+		mu.Unlock()
+		os.RemoveAll(dir)
+	}
+}
+
+func testPoints() map[string][]int64 {
+	return map[string][]int64{
+		"cpu": {testSince - 1, testSince, testSince + 6*3600 + 5, testUntil - 1, testUntil},
+		"mem": {testSince + 100},
+	}
+}
+
+func newTestMigration() *Migration {
+	m := &Migration{NS: testNS, From: testFrom, To: testTo, State: Copying, Since: testSince, Until: testUntil}
+	mu.Lock()
+	migrations[testNS] = m
+	mu.Unlock()
+	return m
+}
+
+// waitState waits up to 2s for m to be in state
+func waitState(t *testing.T, m *Migration, state string) {
+	for i := 0; i < 200; i++ {
+		m.mu.Lock()
+		s := m.State
+		m.mu.Unlock()
+		if s == state {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("migration is %s, want %s", m.State, state)
+}
+
+func TestCopyHistory(t *testing.T) {
+	defer useStore(t)()
+	db, srv := newFakeInfluxDB(t, testPoints())
+	defer srv.Close()
+
+	m := newTestMigration()
+	if err := copyHistory(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		fmt.Sprintf("cpu %d", testSince), fmt.Sprintf("cpu %d", testSince+6*3600), fmt.Sprintf("cpu %d", testSince+12*3600),
+		fmt.Sprintf("mem %d", testSince), fmt.Sprintf("mem %d", testSince+6*3600), fmt.Sprintf("mem %d", testSince+12*3600),
+	}
+	if got := db.read(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("windows %v, want %v", got, want)
+	}
+	lines := db.copied("localhost")
+	wantLines := []string{
+		fmt.Sprintf("cpu,host=a_value=1_%d", testSince),
+		fmt.Sprintf("cpu,host=a_value=1_%d", testSince+6*3600+5),
+		fmt.Sprintf("cpu,host=a_value=1_%d", testUntil-1),
+		fmt.Sprintf("mem,host=a_value=1_%d", testSince+100),
+	}
+	if strings.Join(lines, ",") != strings.Join(wantLines, ",") {
+		t.Errorf("copied %v, want %v", lines, wantLines)
+	}
+	if n := len(db.copied("127.0.0.1")); n != 0 {
+		t.Errorf("%d lines written to the old cluster", n)
+	}
+
+	if m.Points != 4 || len(m.Measurements) != 2 {
+		t.Fatalf("%d points, measurements %v", m.Points, m.Measurements)
+	}
+	for _, mt := range m.Measurements {
+		if !mt.Done || mt.Checkpoint != testUntil {
+			t.Errorf("%s: done %v at %d, want done at %d", mt.Name, mt.Done, mt.Checkpoint, testUntil)
+		}
+	}
+	loaded, err := store.load()
+	if err != nil || len(loaded) != 1 || loaded[0].Points != 4 || loaded[0].Measurements[0].Checkpoint != testUntil {
+		t.Errorf("saved %v, error %v", loaded, err)
+	}
+}
+
+func TestResumeFromCheckpoint(t *testing.T) {
+	defer useStore(t)()
+	db, srv := newFakeInfluxDB(t, testPoints())
+	defer srv.Close()
+
+	m := newTestMigration()
+	m.State, m.Error = Failed, "copy cpu: timeout"
+	m.Measurements = []*Measurement{
+		{Name: "cpu", Checkpoint: testSince + 6*3600, Points: 1},
+		{Name: "mem", Checkpoint: testUntil, Points: 1, Done: true},
+	}
+	m.Points = 2
+	if _, err := Resume(testNS); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, m, Done)
+
+	want := []string{fmt.Sprintf("cpu %d", testSince+6*3600), fmt.Sprintf("cpu %d", testSince+12*3600)}
+	if got := db.read(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("windows %v, want %v", got, want)
+	}
+	if lines := db.copied("localhost"); len(lines) != 2 {
+		t.Errorf("copied %v, want the points after the checkpoint", lines)
+	}
+	if m.Points != 4 || m.Error != "" || m.Finished == nil {
+		t.Errorf("%d points, error %q, finished %v", m.Points, m.Error, m.Finished)
+	}
+	if _, err := Resume(testNS); err == nil {
+		t.Error("resumed a finished migration")
+	}
+}
+
+func TestCancelDuringCopy(t *testing.T) {
+	defer useStore(t)()
+	db, srv := newFakeInfluxDB(t, testPoints())
+	defer srv.Close()
+	db.block = make(chan struct{})
+	defer close(db.block)
+
+	m := newTestMigration()
+	m.Measurements = []*Measurement{{Name: "cpu", Checkpoint: testSince}}
+	start(m)
+	for i := 0; i < 200 && len(db.read()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := Cancel(testNS); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		db.mu.Lock()
+		aborted := db.aborted
+		db.mu.Unlock()
+		if aborted > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// let the copy return
+	time.Sleep(50 * time.Millisecond)
+
+	m.mu.Lock()
+	state, checkpoint := m.State, m.Measurements[0].Checkpoint
+	m.mu.Unlock()
+	if state != Canceled || checkpoint != testSince {
+		t.Errorf("migration %s at %d, want canceled at %d", state, checkpoint, testSince)
+	}
+	if n := len(db.copied("localhost")); n != 0 {
+		t.Errorf("%d lines copied after the cancel", n)
+	}
+	loaded, err := store.load()
+	if err != nil || len(loaded) != 1 || loaded[0].State != Canceled {
+		t.Errorf("saved %v, error %v", loaded, err)
+	}
+	if Source(testNS) != nil {
+		t.Error("canceled migration still has a source")
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := &limiter{rate: 1000, start: time.Now()}
+	if err := l.wait(context.Background(), 100); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(l.start); d < 90*time.Millisecond {
+		t.Errorf("100 points at 1000/s after %s", d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if err := l.wait(ctx, 1000); err != context.Canceled {
+		t.Errorf("error %v, want %v", err, context.Canceled)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("canceled wait took %s", d)
+	}
+}
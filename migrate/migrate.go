@@ -0,0 +1,300 @@
+// Package migrate moves the history of a namespace when registry routes it
+// to another influxdb cluster. The history is copied in the background,
+// a window of a measurement at a time with checkpoints saved to disk.
+// Until the copy is done points are written to both clusters and reads
+// are merged from both, so that queries see the whole history.
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lodastack/router/config"
+	"github.com/lodastack/router/loda"
+
+	"github.com/lodastack/log"
+)
+
+// states of migrations
+const (
+	Copying  = "copying"
+	Done     = "done"
+	Failed   = "failed"
+	Canceled = "canceled"
+)
+
+const (
+	defaultHistory = 90 * 24 * time.Hour
+	defaultRate    = 10000
+	// points written by agents with the old route are copied too
+	routeMargin = 5 * time.Minute
+)
+
+// ErrNotFound is returned for namespaces without migration
+var ErrNotFound = fmt.Errorf("migration not found")
+
+// Measurement is the progress of the copy of a measurement, Checkpoint
+// is the time in seconds it is copied up to.
+type Measurement struct {
+	Name       string `json:"name"`
+	Checkpoint int64  `json:"checkpoint"`
+	Points     int64  `json:"points"`
+	Done       bool   `json:"done"`
+}
+
+// Migration copies the history of NS from the From cluster to To, between
+// Since and Until in seconds.
+type Migration struct {
+	NS           string         `json:"ns"`
+	From         []string       `json:"from"`
+	To           []string       `json:"to"`
+	State        string         `json:"state"`
+	Error        string         `json:"error,omitempty"`
+	Since        int64          `json:"since"`
+	Until        int64          `json:"until"`
+	Created      time.Time      `json:"created"`
+	Finished     *time.Time     `json:"finished,omitempty"`
+	Points       int64          `json:"points"`
+	Measurements []*Measurement `json:"measurements"`
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+}
+
+type migrationJSON Migration
+
+// MarshalJSON encodes the migration under its lock
+func (m *Migration) MarshalJSON() ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return json.Marshal((*migrationJSON)(m))
+}
+
+// active reports whether writes and reads still use both clusters, a
+// failed copy keeps them until it is resumed or canceled.
+func (m *Migration) active() bool {
+	return m.State == Copying || m.State == Failed
+}
+
+var (
+	mu         sync.RWMutex
+	migrations = make(map[string]*Migration)
+	store      *migrationStore
+	// saveMu serializes the saves, the file of a namespace is only
+	// written by its current migration
+	saveMu sync.Mutex
+)
+
+// Init loads the saved migrations, resumes the unfinished ones and
+// starts one on every route change.
+func Init() {
+	c := config.GetConfig().Migrate
+	if !c.Enable {
+		return
+	}
+	if c.Path != "" {
+		s, err := newMigrationStore(c.Path)
+		if err != nil {
+			log.Errorf("open migrations %s failed: %s", c.Path, err)
+		} else {
+			store = s
+		}
+	}
+	if store != nil {
+		loaded, err := store.load()
+		if err != nil {
+			log.Errorf("load migrations failed: %s", err)
+		}
+		for _, m := range loaded {
+			mu.Lock()
+			migrations[m.NS] = m
+			mu.Unlock()
+			if m.State == Copying {
+				log.Infof("resume migration of %s from %v to %v", m.NS, m.From, m.To)
+				start(m)
+			}
+		}
+	}
+	loda.OnRouteChange(func(ns string, old, new []string) {
+		if _, err := Start(ns, old, new); err != nil {
+			log.Errorf("start migration of %s failed: %s", ns, err)
+		}
+	})
+}
+
+// Start copies the history of ns from the cluster from to the cluster to,
+// a migration of ns in progress is canceled.
+func Start(ns string, from, to []string) (*Migration, error) {
+	if ns == "" || len(from) == 0 || len(to) == 0 {
+		return nil, fmt.Errorf("need ns, from and to")
+	}
+	now := time.Now()
+	history := defaultHistory
+	if h := config.GetConfig().Migrate.History; h > 0 {
+		history = time.Duration(h) * time.Hour
+	}
+	m := &Migration{
+		NS:      ns,
+		From:    from,
+		To:      to,
+		State:   Copying,
+		Since:   now.Add(-history).Unix(),
+		Until:   now.Add(routeMargin).Unix(),
+		Created: now,
+	}
+
+	mu.Lock()
+	prev := migrations[ns]
+	migrations[ns] = m
+	mu.Unlock()
+	if prev != nil {
+		prev.stop()
+	}
+	log.Infof("migrate %s from %v to %v", ns, from, to)
+	save(m)
+	start(m)
+	return m, nil
+}
+
+// Get returns the migration of ns
+func Get(ns string) (*Migration, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	m, ok := migrations[ns]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return m, nil
+}
+
+// List returns the migrations sorted by namespace
+func List() []*Migration {
+	mu.RLock()
+	res := make([]*Migration, 0, len(migrations))
+	for _, m := range migrations {
+		res = append(res, m)
+	}
+	mu.RUnlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].NS < res[j].NS })
+	return res
+}
+
+// Cancel stops the migration of ns, writes and reads only use the new
+// cluster from then on.
+func Cancel(ns string) (*Migration, error) {
+	m, err := Get(ns)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	if !m.active() {
+		m.mu.Unlock()
+		return m, fmt.Errorf("migration of %s is %s", ns, m.State)
+	}
+	m.mu.Unlock()
+	m.stop()
+	return m, nil
+}
+
+// Resume restarts a failed migration of ns from its checkpoints
+func Resume(ns string) (*Migration, error) {
+	m, err := Get(ns)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	if m.State != Failed {
+		m.mu.Unlock()
+		return m, fmt.Errorf("migration of %s is %s", ns, m.State)
+	}
+	m.State, m.Error = Copying, ""
+	m.mu.Unlock()
+	save(m)
+	start(m)
+	return m, nil
+}
+
+// Source returns the hosts of the cluster ns is migrated from, nil if
+// it is not migrated. Points are written there too and reads merged.
+func Source(ns string) []string {
+	mu.RLock()
+	m, ok := migrations[ns]
+	mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.active() {
+		return nil
+	}
+	return m.From
+}
+
+// stop cancels the copy of m and marks it canceled
+func (m *Migration) stop() {
+	m.mu.Lock()
+	if m.cancel != nil {
+		m.cancel()
+		m.cancel = nil
+	}
+	if m.active() {
+		m.State = Canceled
+		now := time.Now()
+		m.Finished = &now
+	}
+	m.mu.Unlock()
+	save(m)
+}
+
+func start(m *Migration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.mu.Lock()
+	m.cancel = cancel
+	m.mu.Unlock()
+	go run(ctx, m)
+}
+
+func run(ctx context.Context, m *Migration) {
+	err := copyHistory(ctx, m)
+
+	m.mu.Lock()
+	if ctx.Err() != nil || m.State != Copying {
+		// canceled, stop saved the state
+		m.mu.Unlock()
+		return
+	}
+	if err != nil {
+		m.State, m.Error = Failed, err.Error()
+	} else {
+		m.State = Done
+		now := time.Now()
+		m.Finished = &now
+	}
+	m.cancel = nil
+	state := m.State
+	m.mu.Unlock()
+	save(m)
+	log.Infof("migration of %s from %v to %v %s", m.NS, m.From, m.To, state)
+}
+
+func save(m *Migration) {
+	if store == nil {
+		return
+	}
+	saveMu.Lock()
+	defer saveMu.Unlock()
+	mu.RLock()
+	replaced := migrations[m.NS] != m
+	mu.RUnlock()
+	if replaced {
+		return
+	}
+	if err := store.save(m); err != nil {
+		log.Errorf("save migration of %s failed: %s", m.NS, err)
+	}
+}
@@ -0,0 +1,67 @@
+package migrate
+
+import (
+	"testing"
+)
+
+func TestTransitions(t *testing.T) {
+	defer useStore(t)()
+	_, srv := newFakeInfluxDB(t, testPoints())
+	defer srv.Close()
+
+	if Source(testNS) != nil {
+		t.Error("source of a namespace without migration")
+	}
+	m := newTestMigration()
+	for _, tt := range []struct {
+		state  string
+		source bool
+	}{
+		{state: Copying, source: true},
+		{state: Failed, source: true},
+		{state: Done},
+		{state: Canceled},
+	} {
+		m.State = tt.state
+		if got := Source(testNS) != nil; got != tt.source {
+			t.Errorf("%s: source %v, want %v", tt.state, got, tt.source)
+		}
+	}
+	m.State = Done
+	if _, err := Cancel(testNS); err == nil {
+		t.Error("canceled a finished migration")
+	}
+
+	// a new route cancels the migration in progress, its copy waits for
+	// the agents to use the new route
+	m.State = Copying
+	next, err := Start(testNS, testTo, []string{"127.0.0.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.State != Canceled || m.Finished == nil {
+		t.Errorf("replaced migration is %s", m.State)
+	}
+	if src := Source(testNS); len(src) != 1 || src[0] != testTo[0] {
+		t.Errorf("source %v, want %v", src, testTo)
+	}
+	// the replaced migration does not overwrite the file of the new one
+	save(m)
+	loaded, err := store.load()
+	if err != nil || len(loaded) != 1 || loaded[0].To[0] != "127.0.0.2" || loaded[0].State != Copying {
+		t.Errorf("saved %v, error %v", loaded, err)
+	}
+
+	if _, err := Resume(testNS); err == nil {
+		t.Error("resumed a migration in progress")
+	}
+	if _, err := Cancel(testNS); err != nil {
+		t.Fatal(err)
+	}
+	if next.State != Canceled || Source(testNS) != nil {
+		t.Errorf("canceled migration is %s with source %v", next.State, Source(testNS))
+	}
+	if _, err := Get("collect.b"); err != ErrNotFound {
+		t.Errorf("error %v, want %v", err, ErrNotFound)
+	}
+}
@@ -0,0 +1,63 @@
+package migrate
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// migrationStore saves every migration to a JSON file named by its
+// namespace in dir
+type migrationStore struct {
+	dir string
+}
+
+func newMigrationStore(dir string) (*migrationStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &migrationStore{dir: dir}, nil
+}
+
+func (s *migrationStore) path(ns string) string {
+	return filepath.Join(s.dir, ns+".json")
+}
+
+// save replaces the file of m at once
+func (s *migrationStore) save(m *Migration) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp := s.path(m.NS) + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(m.NS))
+}
+
+// load reads all saved migrations, broken files are skipped
+func (s *migrationStore) load() ([]*Migration, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var res []*Migration
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(s.dir, f.Name()))
+		if err != nil {
+			continue
+		}
+		m := &Migration{}
+		if err := json.Unmarshal(b, (*migrationJSON)(m)); err != nil || m.NS == "" {
+			continue
+		}
+		res = append(res, m)
+	}
+	return res, nil
+}
@@ -0,0 +1,58 @@
+package migrate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := newMigrationStore(filepath.Join(dir, "sub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finished := time.Unix(1600000000, 0).UTC()
+	saved := []*Migration{
+		{NS: "collect.a", From: testFrom, To: testTo, State: Copying, Since: testSince, Until: testUntil,
+			Created: finished, Measurements: []*Measurement{{Name: "cpu", Checkpoint: testSince + 3600, Points: 5}}},
+		{NS: "collect.b", From: testFrom, To: testTo, State: Done, Error: "", Finished: &finished, Points: 7},
+	}
+	for _, m := range saved {
+		if err := s.save(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saved[0].Measurements[0].Checkpoint += 3600
+	if err := s.save(saved[0]); err != nil {
+		t.Fatal(err)
+	}
+	// broken files, temp files and dirs are skipped
+	ioutil.WriteFile(filepath.Join(s.dir, "broken.json"), []byte("{"), 0644)
+	ioutil.WriteFile(filepath.Join(s.dir, "nons.json"), []byte("{}"), 0644)
+	ioutil.WriteFile(filepath.Join(s.dir, "collect.c.json.tmp"), []byte(`{"ns":"collect.c"}`), 0644)
+	os.Mkdir(filepath.Join(s.dir, "collect.d.json"), 0755)
+
+	loaded, err := s.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != len(saved) {
+		t.Fatalf("loaded %d migrations, want %d", len(loaded), len(saved))
+	}
+	for i, m := range loaded {
+		want := saved[i]
+		if m.NS != want.NS || m.State != want.State || m.Points != want.Points ||
+			!reflect.DeepEqual(m.Measurements, want.Measurements) || (m.Finished == nil) != (want.Finished == nil) {
+			t.Errorf("loaded %+v, want %+v", m, want)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseLine parses one line of InfluxDB line protocol. The timestamp is
+// read in precision (n, u, ms, s, m or h, default n) and converted to
+// seconds, the unit of Point.Timestamp. A missing timestamp means now.
+func ParseLine(line string, precision string) (*Point, error) {
+	line = strings.TrimSpace(line)
+	// quotes are only special in fields, tag values may hold them
+	head := splitUnescaped(line, ' ', false)[0]
+	if len(head) == len(line) {
+		return nil, fmt.Errorf("invalid line: %s", line)
+	}
+	sections := append([]string{head}, splitUnescaped(line[len(head)+1:], ' ', true)...)
+	if len(sections) < 2 || len(sections) > 3 {
+		return nil, fmt.Errorf("invalid line: %s", line)
+	}
+
+	keys := splitUnescaped(sections[0], ',', false)
+	p := &Point{
+		Measurement: unescape(keys[0]),
+		Tags:        make(map[string]string),
+		Fields:      make(map[string]interface{}),
+	}
+	if p.Measurement == "" {
+		return nil, fmt.Errorf("missing measurement: %s", line)
+	}
+	for _, kv := range keys[1:] {
+		k, v, err := splitPair(kv)
+		if err != nil {
+			return nil, err
+		}
+		p.Tags[k] = v
+	}
+
+	for _, kv := range splitUnescaped(sections[1], ',', true) {
+		k, raw, err := splitPair(kv)
+		if err != nil {
+			return nil, err
+		}
+		if p.Fields[k], err = parseFieldValue(raw); err != nil {
+			return nil, fmt.Errorf("invalid field %s: %s", k, err)
+		}
+	}
+
+	p.Timestamp = time.Now().Unix()
+	if len(sections) == 3 {
+		ts, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp: %s", sections[2])
+		}
+		p.Timestamp = toSeconds(ts, precision)
+	}
+	return p, nil
+}
+
+func toSeconds(ts int64, precision string) int64 {
+	switch precision {
+	case "h":
+		return ts * 3600
+	case "m":
+		return ts * 60
+	case "s":
+		return ts
+	case "ms":
+		return ts / 1e3
+	case "u":
+		return ts / 1e6
+	default:
+		return ts / 1e9
+	}
+}
+
+func parseFieldValue(raw string) (interface{}, error) {
+	if raw == "" {
+		return nil, fmt.Errorf("empty value")
+	}
+	if raw[0] == '"' {
+		if len(raw) < 2 || raw[len(raw)-1] != '"' {
+			return nil, fmt.Errorf("unterminated string %s", raw)
+		}
+		return strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(raw[1 : len(raw)-1]), nil
+	}
+	switch raw {
+	case "t", "T", "true", "True", "TRUE":
+		return true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return false, nil
+	}
+	if last := raw[len(raw)-1]; last == 'i' || last == 'u' {
+		return strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+	}
+	return strconv.ParseFloat(raw, 64)
+}
+
+func splitPair(kv string) (string, string, error) {
+	parts := splitUnescaped(kv, '=', false)
+	if len(parts) < 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("invalid pair: %s", kv)
+	}
+	// only the first unescaped "=" separates key and value
+	return unescape(parts[0]), unescape(kv[len(parts[0])+1:]), nil
+}
+
+// splitUnescaped splits s on sep, skipping separators escaped by a
+// backslash and, if quoted is set, those inside double quotes.
+func splitUnescaped(s string, sep byte, quoted bool) []string {
+	var parts []string
+	var inQuote bool
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quoted && s[i] == '"':
+			inQuote = !inQuote
+		case s[i] == sep && !inQuote:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	return strings.NewReplacer(`\,`, `,`, `\=`, `=`, `\ `, ` `).Replace(s)
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `)
+	keyEscaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+	stringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// Line formats p as line protocol, tags and fields sorted and the
+// timestamp in seconds, ParseLine with precision s reads it back.
+func (p *Point) Line() string {
+	var b strings.Builder
+	b.WriteString(measurementEscaper.Replace(p.Measurement))
+	for _, k := range sortedKeys(p.Tags) {
+		if p.Tags[k] == "" {
+			continue
+		}
+		b.WriteString("," + keyEscaper.Replace(k) + "=" + keyEscaper.Replace(p.Tags[k]))
+	}
+	sep := " "
+	for _, k := range sortedFields(p.Fields) {
+		var v string
+		switch f := p.Fields[k].(type) {
+		case string:
+			v = `"` + stringEscaper.Replace(f) + `"`
+		case float64:
+			v = strconv.FormatFloat(f, 'g', -1, 64)
+		case int64:
+			v = strconv.FormatInt(f, 10) + "i"
+		case int:
+			v = strconv.Itoa(f) + "i"
+		case bool:
+			v = strconv.FormatBool(f)
+		case nil:
+			continue
+		default:
+			v = fmt.Sprintf("%v", f)
+		}
+		b.WriteString(sep + keyEscaper.Replace(k) + "=" + v)
+		sep = ","
+	}
+	b.WriteString(" " + strconv.FormatInt(p.Timestamp, 10))
+	return b.String()
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedFields(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
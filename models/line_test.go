@@ -0,0 +1,95 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line      string
+		precision string
+		want      *Point
+		err       bool
+	}{
+		{
+			line: "cpu,host=a value=1.5 1600000000000000000",
+			want: &Point{Measurement: "cpu", Timestamp: 1600000000, Tags: map[string]string{"host": "a"}, Fields: map[string]interface{}{"value": 1.5}},
+		},
+		{
+			line:      "cpu value=1i,ok=t,msg=\"a b\" 1600000000000",
+			precision: "ms",
+			want:      &Point{Measurement: "cpu", Timestamp: 1600000000, Tags: map[string]string{}, Fields: map[string]interface{}{"value": int64(1), "ok": true, "msg": "a b"}},
+		},
+		{
+			line:      `cpu\,idle,host\ name=a\,b\=c value=1 1600000000`,
+			precision: "s",
+			want:      &Point{Measurement: "cpu,idle", Timestamp: 1600000000, Tags: map[string]string{"host name": "a,b=c"}, Fields: map[string]interface{}{"value": 1.0}},
+		},
+		{
+			line:      `log,q="x msg="say \"hi\", \\o/" 1600000000`,
+			precision: "s",
+			want:      &Point{Measurement: "log", Timestamp: 1600000000, Tags: map[string]string{"q": `"x`}, Fields: map[string]interface{}{"msg": `say "hi", \o/`}},
+		},
+		{line: "cpu", err: true},
+		{line: "cpu,host value=1", err: true},
+		{line: "cpu value= 1", err: true},
+		{line: `cpu msg="open 1`, err: true},
+		{line: "cpu value=x", err: true},
+		{line: "cpu value=1 now", err: true},
+		{line: "cpu value=1 1 2", err: true},
+		{line: ",host=a value=1", err: true},
+	}
+	for _, tt := range tests {
+		p, err := ParseLine(tt.line, tt.precision)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseLine(%q) = %+v, want error", tt.line, p)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseLine(%q): %s", tt.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(p, tt.want) {
+			t.Errorf("ParseLine(%q) = %+v, want %+v", tt.line, p, tt.want)
+		}
+	}
+}
+
+func TestLineRoundTrip(t *testing.T) {
+	points := []*Point{
+		{Measurement: "cpu", Timestamp: 1600000000, Tags: map[string]string{"host": "a"}, Fields: map[string]interface{}{"value": 1.5}},
+		{Measurement: "cpu idle,total", Timestamp: 1, Tags: map[string]string{"host name": "a=b, c", "q": `"x"`}, Fields: map[string]interface{}{"the value": 2.0}},
+		{Measurement: "router.audit", Timestamp: 1600000000, Tags: map[string]string{"ip": "10.0.0.1, 10.0.0.2"}, Fields: map[string]interface{}{
+			"query": `SELECT "value" FROM "cpu" WHERE host = 'a\b', x = "y z"`,
+			"rows":  int64(3),
+			"ok":    false,
+		}},
+		{Measurement: "m", Timestamp: 1, Tags: map[string]string{}, Fields: map[string]interface{}{"s": `\`, "t": `"`, "u": ""}},
+	}
+	for _, p := range points {
+		line := p.Line()
+		got, err := ParseLine(line, "s")
+		if err != nil {
+			t.Errorf("ParseLine(%q): %s", line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, p) {
+			t.Errorf("ParseLine(%q) = %+v, want %+v", line, got, p)
+		}
+	}
+}
+
+func TestLine(t *testing.T) {
+	p := &Point{
+		Measurement: "cpu",
+		Timestamp:   1600000000,
+		Tags:        map[string]string{"b": "2", "a": "1", "empty": ""},
+		Fields:      map[string]interface{}{"y": int64(1), "x": "s", "n": nil},
+	}
+	if got, want := p.Line(), `cpu,a=1,b=2 x="s",y=1i 1600000000`; got != want {
+		t.Errorf("Line() = %s, want %s", got, want)
+	}
+}
@@ -2,56 +2,215 @@
 package query
 
 import (
+	"container/list"
+	"net/url"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/lodastack/router/config"
+	"github.com/lodastack/router/influxql"
+)
+
+const (
+	defaultCacheSize = 10000
+	defaultCacheTTL  = 300
+	defaultRecentTTL = 10
+	defaultRecentWin = 600
+
+	// SA results only cover closed ranges
+	saCacheTTL = 6 * time.Hour
 )
 
-// Cache module in HTTP service
+// Cache module in HTTP service, a size bounded LRU with per entry TTL
 type Cache struct {
-	item map[string]interface{}
-	mu   sync.RWMutex
+	size  int
+	item  map[string]*list.Element
+	lru   *list.List
+	mu    sync.Mutex
+	stats CacheStats
+}
+
+// CacheStats counts cache lookups
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Items     int    `json:"items"`
+	Size      int    `json:"size"`
 }
 
-// NewCache service
-func NewCache() *Cache {
+type cacheEntry struct {
+	key    string
+	value  interface{}
+	expire time.Time
+}
+
+// NewCache service, holds at most size items
+func NewCache(size int) *Cache {
+	if size <= 0 {
+		size = defaultCacheSize
+	}
 	c := &Cache{
-		item: make(map[string]interface{}),
+		size: size,
+		item: make(map[string]*list.Element),
+		lru:  list.New(),
 	}
 	return c
 }
 
-// Set sets cache data value
-func (c *Cache) Set(key string, v interface{}) {
+// Set sets cache data value, which expires after ttl
+func (c *Cache) Set(key string, v interface{}, ttl time.Duration) {
 	c.mu.Lock()
-	c.item[key] = v
-	c.mu.Unlock()
+	defer c.mu.Unlock()
+	expire := time.Now().Add(ttl)
+	if e, ok := c.item[key]; ok {
+		entry := e.Value.(*cacheEntry)
+		entry.value, entry.expire = v, expire
+		c.lru.MoveToFront(e)
+		return
+	}
+	for c.lru.Len() >= c.size {
+		c.remove(c.lru.Back())
+		atomic.AddUint64(&c.stats.Evictions, 1)
+	}
+	c.item[key] = c.lru.PushFront(&cacheEntry{key: key, value: v, expire: expire})
 }
 
 // Get gets cache data value via key
 func (c *Cache) Get(key string) interface{} {
-	c.mu.RLock()
-	v, ok := c.item[key]
-	c.mu.RUnlock()
-	if ok {
-		return v
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.item[key]
+	if !ok {
+		atomic.AddUint64(&c.stats.Misses, 1)
+		return nil
+	}
+	entry := e.Value.(*cacheEntry)
+	if time.Now().After(entry.expire) {
+		c.remove(e)
+		atomic.AddUint64(&c.stats.Misses, 1)
+		return nil
 	}
-	return nil
+	c.lru.MoveToFront(e)
+	atomic.AddUint64(&c.stats.Hits, 1)
+	return entry.value
 }
 
 // Purge remove all cache data
 func (c *Cache) Purge() {
 	c.mu.Lock()
-	c.item = make(map[string]interface{})
+	c.item = make(map[string]*list.Element)
+	c.lru.Init()
+	c.mu.Unlock()
+}
+
+// Stats returns the lookup counters
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	items := c.lru.Len()
+	c.mu.Unlock()
+	return CacheStats{
+		Hits:      atomic.LoadUint64(&c.stats.Hits),
+		Misses:    atomic.LoadUint64(&c.stats.Misses),
+		Evictions: atomic.LoadUint64(&c.stats.Evictions),
+		Items:     items,
+		Size:      c.size,
+	}
+}
+
+func (c *Cache) remove(e *list.Element) {
+	delete(c.item, e.Value.(*cacheEntry).key)
+	c.lru.Remove(e)
+}
+
+// purgeExpired removes the expired items, which would otherwise only go
+// when looked up or evicted
+func (c *Cache) purgeExpired() {
+	now := time.Now()
+	c.mu.Lock()
+	for e := c.lru.Back(); e != nil; {
+		prev := e.Prev()
+		if now.After(e.Value.(*cacheEntry).expire) {
+			c.remove(e)
+		}
+		e = prev
+	}
 	c.mu.Unlock()
 }
 
 func (c *Cache) purgeTimer() {
-	// cache 6 hours
-	ticker := time.NewTicker(time.Duration(360) * time.Minute)
+	ticker := time.NewTicker(time.Minute)
 	for {
 		select {
 		case <-ticker.C:
-			c.Purge()
+			c.purgeExpired()
 		}
 	}
 }
+
+// resultTTL returns how long a result whose range ends at end is cached,
+// open ended ranges pass the zero time.
+func resultTTL(end time.Time) time.Duration {
+	c := config.GetConfig().Cache
+	ttl, recentTTL, recentWin := c.TTL, c.RecentTTL, c.RecentWindow
+	if ttl <= 0 {
+		ttl = defaultCacheTTL
+	}
+	if recentTTL <= 0 {
+		recentTTL = defaultRecentTTL
+	}
+	if recentWin <= 0 {
+		recentWin = defaultRecentWin
+	}
+	if end.IsZero() || time.Since(end) < time.Duration(recentWin)*time.Second {
+		return time.Duration(recentTTL) * time.Second
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// rawQueryTTL caches a raw query by the latest upper time bound of its
+// SELECTs, the results of other statements change any time
+func rawQueryTTL(q *influxql.Query) time.Duration {
+	var end time.Time
+	for _, stmt := range q.Statements {
+		s, ok := stmt.(*influxql.SelectStatement)
+		if !ok {
+			return resultTTL(time.Time{})
+		}
+		_, max := s.TimeRange(time.Now())
+		if max.IsZero() {
+			return resultTTL(time.Time{})
+		}
+		if max.After(end) {
+			end = max
+		}
+	}
+	return resultTTL(end)
+}
+
+// rawQueryKey normalizes the params of a /query request into a cache key
+func rawQueryKey(ns string, params url.Values) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := []string{"query", ns}
+	for _, k := range keys {
+		v := params.Get(k)
+		if k == "q" {
+			v = strings.TrimRight(strings.Join(strings.Fields(v), " "), ";")
+		}
+		parts = append(parts, k+"="+v)
+	}
+	return strings.Join(parts, "|")
+}
+
+type rawResult struct {
+	status int
+	body   []byte
+}
@@ -0,0 +1,74 @@
+package query
+
+import (
+	"net/http"
+
+	"github.com/lodastack/router/catalog"
+	"github.com/lodastack/router/loda"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/lodastack/log"
+)
+
+// catalogHandler returns the catalog, or the metadata of one measurement
+// with name and ns.
+func (s *Service) catalogHandler(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	name := req.FormValue("name")
+	if name == "" {
+		c := catalog.Get()
+		c.Entries = c.Sorted()
+		succResp(resp, "OK", c)
+		return
+	}
+	var ms []loda.CollectMetric
+	if ns := req.FormValue("ns"); ns != "" {
+		var err error
+		if ms, err = loda.CollectMetrics(ns); err != nil {
+			log.Error(err)
+		}
+	}
+	succResp(resp, "OK", catalog.Lookup(name, ms))
+}
+
+// putCatalogHandler adds or replaces an entry
+func (s *Service) putCatalogHandler(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var e catalog.Entry
+	if err := decodeBody(req, &e); err != nil {
+		errResp(resp, http.StatusBadRequest, err.Error())
+		return
+	}
+	if e.Fill != "" {
+		if err := validFill(e.Fill); err != nil {
+			errResp(resp, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if err := catalog.Put(e); err != nil {
+		errResp(resp, http.StatusBadRequest, err.Error())
+		return
+	}
+	succResp(resp, "OK", e)
+}
+
+// removeCatalogHandler removes the entry of pattern
+func (s *Service) removeCatalogHandler(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	pattern := req.FormValue("pattern")
+	if pattern == "" {
+		errResp(resp, http.StatusBadRequest, "need pattern")
+		return
+	}
+	if err := catalog.Delete(pattern); err != nil {
+		errResp(resp, http.StatusBadRequest, err.Error())
+		return
+	}
+	succResp(resp, "OK", nil)
+}
+
+// putCategoryHandler maps a name prefix to a category, none if empty
+func (s *Service) putCategoryHandler(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if err := catalog.PutCategory(req.FormValue("prefix"), req.FormValue("category")); err != nil {
+		errResp(resp, http.StatusBadRequest, err.Error())
+		return
+	}
+	succResp(resp, "OK", nil)
+}
@@ -0,0 +1,152 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lodastack/router/influxql"
+)
+
+const (
+	maxCompareShifts = 4
+	maxCompareShift  = 366 * 24 * time.Hour
+	// tag labelling the series of a compare query
+	compareTag     = "compare"
+	compareCurrent = "now"
+)
+
+// compareShift is a time shift of compare, like 1d or 7d
+type compareShift struct {
+	label string
+	shift time.Duration
+}
+
+// compareParam reads the compare param: a comma separated list of shifts
+func compareParam(req *http.Request) ([]compareShift, error) {
+	param := req.FormValue("compare")
+	if param == "" {
+		return nil, nil
+	}
+	var shifts []compareShift
+	for _, label := range strings.Split(param, ",") {
+		label = strings.TrimSpace(label)
+		d, err := influxql.ParseDuration(label)
+		if err != nil || d <= 0 || d > maxCompareShift {
+			return nil, fmt.Errorf("invalid compare %s", label)
+		}
+		shifts = append(shifts, compareShift{label: label, shift: d})
+	}
+	if len(shifts) > maxCompareShifts {
+		return nil, fmt.Errorf("compare takes at most %d shifts", maxCompareShifts)
+	}
+	return shifts, nil
+}
+
+// shiftRange moves a ms range back by d
+func shiftRange(start, end string, d time.Duration) (string, string, error) {
+	st, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid starttime %s", start)
+	}
+	et, err := strconv.ParseInt(end, 10, 64)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid endtime %s", end)
+	}
+	ms := int64(d / time.Millisecond)
+	return strconv.FormatInt(st-ms, 10), strconv.FormatInt(et-ms, 10), nil
+}
+
+// rangeFetcher returns the results of the query between start and end
+type rangeFetcher func(ctx context.Context, start, end string) (Results, error)
+
+// compareResults fetches the shifted windows of rs and moves them onto the
+// current window, snapped to the GROUP BY interval. The series are tagged
+// with their shift, and every shifted value comes with its delta and
+// percent change to the current value of the same tags.
+func compareResults(ctx context.Context, rs Results, shifts []compareShift, interval, start, end string, fetch rangeFetcher) (Results, error) {
+	step, err := influxql.ParseDuration(interval)
+	if err != nil || step < time.Second {
+		step = time.Second
+	}
+	stepSecs := int64(step / time.Second)
+
+	// the current values by series and time
+	current := make(map[string]map[int64]float64)
+	var rows []Row
+	for _, r := range rs.Results {
+		for _, row := range r.Series {
+			values := make(map[int64]float64, len(row.Values))
+			for _, v := range row.Values {
+				if t, val, ok := timeValue(v); ok {
+					values[t] = val
+				}
+			}
+			current[tagString(row.Tags)] = values
+			row.Tags = withTag(row.Tags, compareTag, compareCurrent)
+			rows = append(rows, row)
+		}
+	}
+
+	for _, cs := range shifts {
+		st, et, err := shiftRange(start, end, cs.shift)
+		if err != nil {
+			return rs, err
+		}
+		shifted, err := fetch(ctx, st, et)
+		if err != nil {
+			return rs, fmt.Errorf("compare %s: %s", cs.label, err)
+		}
+		secs := int64(cs.shift / time.Second)
+		offset := secs / stepSecs * stepSecs
+		for _, r := range shifted.Results {
+			for _, row := range r.Series {
+				cur := current[tagString(row.Tags)]
+				out := Row{
+					Name:    row.Name,
+					Tags:    withTag(row.Tags, compareTag, cs.label),
+					Columns: []string{"time", "value", "delta", "percent"},
+				}
+				for _, v := range row.Values {
+					t, val, ok := timeValue(v)
+					if !ok {
+						continue
+					}
+					t += offset
+					var delta, percent interface{}
+					if c, ok := cur[t]; ok {
+						delta = SetPrecision(c-val, 4)
+						if val != 0 {
+							percent = SetPrecision((c-val)/val*100, 4)
+						}
+					}
+					out.Values = append(out.Values, []interface{}{float64(t), val, delta, percent})
+				}
+				rows = append(rows, out)
+			}
+		}
+	}
+	return Results{Results: []Result{{Series: rows}}}, nil
+}
+
+func timeValue(v []interface{}) (int64, float64, bool) {
+	if len(v) < 2 {
+		return 0, 0, false
+	}
+	t, ok := v[0].(float64)
+	val, vok := v[1].(float64)
+	return int64(t), val, ok && vok
+}
+
+// withTag returns a copy of tags with k set to v
+func withTag(tags map[string]string, k, v string) map[string]string {
+	res := make(map[string]string, len(tags)+1)
+	for tk, tv := range tags {
+		res[tk] = tv
+	}
+	res[k] = v
+	return res
+}
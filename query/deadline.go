@@ -0,0 +1,49 @@
+package query
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/lodastack/router/config"
+	"github.com/lodastack/router/influx"
+
+	"github.com/lodastack/log"
+)
+
+const defaultQueryTimeout = 60 * time.Second
+
+// queryTimeout is the timeout of queries of endpoint on ns, the
+// namespace timeout wins over the endpoint one
+func queryTimeout(endpoint, ns string) time.Duration {
+	c := config.GetConfig().Query
+	if ms, ok := c.NSTimeouts[ns]; ok && ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	if ms, ok := c.EndpointTimeouts[endpoint]; ok && ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	if c.Timeout > 0 {
+		return time.Duration(c.Timeout) * time.Millisecond
+	}
+	return defaultQueryTimeout
+}
+
+// queryContext bounds a query of req by the timeout of endpoint on ns,
+// it is also canceled when the client goes away
+func queryContext(req *http.Request, endpoint, ns string) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(req.Context(), queryTimeout(endpoint, ns))
+}
+
+// queryErrResp answers a failed query, 504 if it timed out and nothing
+// if the client went away
+func queryErrResp(resp http.ResponseWriter, ctx context.Context, err error) {
+	switch {
+	case ctx.Err() == context.DeadlineExceeded, err == influx.ErrTimeout:
+		errResp(resp, http.StatusGatewayTimeout, "query timeout, canceled on influxdb")
+	case ctx.Err() == context.Canceled:
+		log.Infof("query canceled by client: %s", err)
+	default:
+		errResp(resp, http.StatusInternalServerError, err.Error())
+	}
+}
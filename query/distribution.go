@@ -0,0 +1,244 @@
+package query
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lodastack/router/audit"
+	"github.com/lodastack/router/influxql"
+	"github.com/lodastack/router/loda"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	defaultHeatmapBuckets = 10
+	maxHeatmapBuckets     = 100
+)
+
+var defaultPercentiles = []string{"p50", "p90", "p99"}
+
+// Distribution is the spread of the series of a measurement per time bucket
+type Distribution struct {
+	Measurement string             `json:"measurement"`
+	Interval    string             `json:"interval"`
+	Series      int                `json:"series"`
+	Percentiles []PercentileSeries `json:"percentiles"`
+	Heatmap     Heatmap            `json:"heatmap"`
+}
+
+// PercentileSeries is a percentile across series, Values holds [time, value]
+type PercentileSeries struct {
+	Name   string          `json:"name"`
+	Values [][]interface{} `json:"values"`
+}
+
+// Heatmap counts the series per value range and time bucket: Counts[i][j]
+// is the number of series at Times[i] between Bounds[j] and Bounds[j+1].
+type Heatmap struct {
+	Bounds []float64 `json:"bounds"`
+	Times  []int64   `json:"times"`
+	Counts [][]int   `json:"counts"`
+}
+
+// distributionHandler computes percentiles across the series of a
+// measurement and a heatmap of their values, per time bucket. Every series
+// is aggregated per bucket by fn first.
+func (s *Service) distributionHandler(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ns := req.FormValue("ns")
+	measurement := req.FormValue("measurement")
+	starttime := req.FormValue("starttime")
+	endtime := req.FormValue("endtime")
+	where := req.FormValue("where")
+	if len(ns) == 0 || len(measurement) == 0 || len(starttime) == 0 || len(endtime) == 0 {
+		errResp(resp, http.StatusBadRequest, "need params")
+		return
+	}
+	fn := req.FormValue("fn")
+	if fn == "" {
+		fn = "mean"
+	}
+	call, err := validFn(fn)
+	if err != nil {
+		errResp(resp, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	percentiles := defaultPercentiles
+	if p := req.FormValue("p"); p != "" {
+		percentiles = strings.Split(p, ",")
+	}
+	ranks := make([]float64, len(percentiles))
+	for i, p := range percentiles {
+		if !percentileFn.MatchString(p) {
+			errResp(resp, http.StatusBadRequest, "invalid percentile "+p)
+			return
+		}
+		ranks[i], _ = strconv.ParseFloat(p[1:], 64)
+	}
+	var bounds []float64
+	if b := req.FormValue("bounds"); b != "" {
+		for _, v := range strings.Split(b, ",") {
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil || (len(bounds) > 0 && f <= bounds[len(bounds)-1]) {
+				errResp(resp, http.StatusBadRequest, "bounds must be increasing numbers")
+				return
+			}
+			bounds = append(bounds, f)
+		}
+		if len(bounds) < 2 || len(bounds) > maxHeatmapBuckets+1 {
+			errResp(resp, http.StatusBadRequest, fmt.Sprintf("bounds must have 2 to %d numbers", maxHeatmapBuckets+1))
+			return
+		}
+	}
+	buckets, err := intParam(req, "buckets", defaultHeatmapBuckets, 1, maxHeatmapBuckets)
+	if err != nil {
+		errResp(resp, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	influxdbs, err := loda.InfluxDBs(ns)
+	if err != nil {
+		errResp(resp, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(influxdbs) == 0 {
+		errResp(resp, 400, ns+" has no influxdb route config")
+		return
+	}
+
+	starttime, endtime = alignRange(starttime, endtime)
+	interval := defaultInterval(starttime, endtime)
+	cond := fmt.Sprintf("time > %sms and time < %sms", starttime, endtime)
+	if where != "" {
+		cond = "(" + where + ") AND " + cond
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s GROUP BY time(%s), * fill(none)",
+		call, influxql.QuoteIdent(measurement), cond, interval)
+	if q, err := parseQuery(query); err != nil || len(q.Statements) != 1 {
+		errResp(resp, http.StatusBadRequest, "invalid query")
+		return
+	}
+
+	rec := audit.FromContext(req.Context())
+	rec.SetNS(ns, query)
+	ctx, cancel := queryContext(req, "distribution", ns)
+	defer cancel()
+	p := url.Values{}
+	p.Set("q", query)
+	p.Set("db", ns)
+	p.Set("epoch", "s")
+	_, rs, err := queryInfluxDB(ctx, influxdbs, p, req.Header.Get("X-Real-IP"), true)
+	if err != nil {
+		queryErrResp(resp, ctx, err)
+		return
+	}
+	if lerr := checkResults(rs, queryLimits(req, ns)); lerr != nil {
+		limitErrResp(resp, lerr)
+		return
+	}
+	_, points := resultsRows(rs)
+	rec.AddRows(points)
+
+	// the values of all series by time
+	byTime := make(map[int64][]float64)
+	series := 0
+	for _, r := range rs.Results {
+		series += len(r.Series)
+		for _, row := range r.Series {
+			for _, v := range row.Values {
+				if t, val, ok := timeValue(v); ok {
+					byTime[t] = append(byTime[t], val)
+				}
+			}
+		}
+	}
+	times := make([]int64, 0, len(byTime))
+	for t, vals := range byTime {
+		times = append(times, t)
+		sort.Float64s(vals)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+
+	res := Distribution{Measurement: measurement, Interval: interval, Series: series}
+	for i, name := range percentiles {
+		ps := PercentileSeries{Name: name, Values: make([][]interface{}, 0, len(times))}
+		for _, t := range times {
+			ps.Values = append(ps.Values, []interface{}{t, SetPrecision(percentile(byTime[t], ranks[i]), 4)})
+		}
+		res.Percentiles = append(res.Percentiles, ps)
+	}
+	if bounds == nil {
+		bounds = linearBounds(byTime, buckets)
+	}
+	res.Heatmap = heatmap(byTime, times, bounds)
+	succResp(resp, "OK", res)
+}
+
+// percentile of sorted values, linearly interpolated between ranks
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	return sorted[lo] + (sorted[hi]-sorted[lo])*(rank-float64(lo))
+}
+
+// linearBounds splits the range of all values into n equal buckets
+func linearBounds(byTime map[int64][]float64, n int) []float64 {
+	min, max := math.Inf(1), math.Inf(-1)
+	for _, vals := range byTime {
+		if len(vals) == 0 {
+			continue
+		}
+		min = math.Min(min, vals[0])
+		max = math.Max(max, vals[len(vals)-1])
+	}
+	if math.IsInf(min, 0) {
+		return []float64{0, 1}
+	}
+	if max == min {
+		max = min + 1
+	}
+	bounds := make([]float64, n+1)
+	for i := range bounds {
+		bounds[i] = SetPrecision(min+(max-min)*float64(i)/float64(n), 4)
+	}
+	bounds[n] = max
+	return bounds
+}
+
+// heatmap counts the values per bucket, values out of the bounds go to
+// the first or last bucket.
+func heatmap(byTime map[int64][]float64, times []int64, bounds []float64) Heatmap {
+	h := Heatmap{Bounds: bounds, Times: times, Counts: make([][]int, len(times))}
+	n := len(bounds) - 1
+	for i, t := range times {
+		counts := make([]int, n)
+		for _, v := range byTime[t] {
+			b := sort.SearchFloat64s(bounds, v)
+			// bounds[b-1] < v <= bounds[b] is bucket b-1, the lower bound
+			// of a bucket is inclusive
+			if b < len(bounds) && bounds[b] == v {
+				b++
+			}
+			b--
+			if b < 0 {
+				b = 0
+			}
+			if b >= n {
+				b = n - 1
+			}
+			counts[b]++
+		}
+		h.Counts[i] = counts
+	}
+	return h
+}
@@ -0,0 +1,215 @@
+package query
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+const (
+	defaultDownsamplePoints = 1500
+	maxDownsamplePoints     = 10000
+	// the finer resolution fetched has this many buckets per output point
+	downsampleFactor = 8
+)
+
+// downsamplers reduce the values of a series to about n points, the
+// values are sorted by time with the time at 0 and the value at 1.
+var downsamplers = map[string]func(values [][]interface{}, n int) [][]interface{}{
+	"lttb":   lttb,
+	"minmax": minmax,
+	"m4":     m4,
+}
+
+// downsampleParams reads the downsample and points params, method is
+// empty when the request does not downsample.
+func downsampleParams(req *http.Request) (method string, points int, err error) {
+	method = req.FormValue("downsample")
+	if method == "" {
+		return "", 0, nil
+	}
+	if _, ok := downsamplers[method]; !ok {
+		return "", 0, fmt.Errorf("unknown downsample %s, use lttb, minmax or m4", method)
+	}
+	points = defaultDownsamplePoints
+	if p := req.FormValue("points"); p != "" {
+		if points, err = strconv.Atoi(p); err != nil || points < 4 || points > maxDownsamplePoints {
+			return "", 0, fmt.Errorf("points must be between 4 and %d", maxDownsamplePoints)
+		}
+	}
+	return method, points, nil
+}
+
+// downsampleInterval is the GROUP BY interval fetching downsampleFactor
+// buckets per output point between start and end in ms, at least 1s.
+func downsampleInterval(start, end string, points int) (string, error) {
+	st, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid starttime %s", start)
+	}
+	et, err := strconv.ParseInt(end, 10, 64)
+	if err != nil || et <= st {
+		return "", fmt.Errorf("invalid endtime %s", end)
+	}
+	secs := (et - st) / 1000 / int64(points*downsampleFactor)
+	if secs < 1 {
+		secs = 1
+	}
+	return strconv.FormatInt(secs, 10) + "s", nil
+}
+
+// downsampleResults reduces every series of rs with method
+func downsampleResults(rs Results, method string, points int) Results {
+	f := downsamplers[method]
+	for i := range rs.Results {
+		for j := range rs.Results[i].Series {
+			s := &rs.Results[i].Series[j]
+			s.Values = numericValues(s.Values)
+			if len(s.Values) > points {
+				s.Values = f(s.Values, points)
+			}
+		}
+	}
+	return rs
+}
+
+// numericValues drops the rows without a time and a number, like the
+// null buckets of fill(null), which the downsamplers can not place.
+func numericValues(values [][]interface{}) [][]interface{} {
+	res := values[:0]
+	for _, v := range values {
+		if len(v) < 2 {
+			continue
+		}
+		_, xok := v[0].(float64)
+		_, yok := v[1].(float64)
+		if xok && yok {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func pointXY(v []interface{}) (float64, float64) {
+	x, _ := v[0].(float64)
+	y, _ := v[1].(float64)
+	return x, y
+}
+
+// lttb is Largest-Triangle-Three-Buckets: it keeps the first and last
+// points and from every bucket the point with the largest triangle formed
+// with the point kept before it and the average of the next bucket.
+func lttb(values [][]interface{}, n int) [][]interface{} {
+	if n >= len(values) || n < 3 {
+		return values
+	}
+	res := make([][]interface{}, 0, n)
+	res = append(res, values[0])
+	every := float64(len(values)-2) / float64(n-2)
+	a := 0
+	for i := 0; i < n-2; i++ {
+		// the average of the next bucket
+		avgStart := int(float64(i+1)*every) + 1
+		avgEnd := int(float64(i+2)*every) + 1
+		if avgEnd > len(values) {
+			avgEnd = len(values)
+		}
+		var avgX, avgY float64
+		for _, v := range values[avgStart:avgEnd] {
+			x, y := pointXY(v)
+			avgX += x
+			avgY += y
+		}
+		if cnt := float64(avgEnd - avgStart); cnt > 0 {
+			avgX /= cnt
+			avgY /= cnt
+		}
+
+		ax, ay := pointXY(values[a])
+		from, to := int(float64(i)*every)+1, int(float64(i+1)*every)+1
+		maxArea, next := -1.0, from
+		for k := from; k < to; k++ {
+			x, y := pointXY(values[k])
+			area := math.Abs((ax-avgX)*(y-ay) - (ax-x)*(avgY-ay))
+			if area > maxArea {
+				maxArea, next = area, k
+			}
+		}
+		res = append(res, values[next])
+		a = next
+	}
+	return append(res, values[len(values)-1])
+}
+
+// minmax keeps the minimum and maximum of n/2 buckets
+func minmax(values [][]interface{}, n int) [][]interface{} {
+	return bucketReduce(values, n/2, false)
+}
+
+// m4 keeps the first, minimum, maximum and last points of n/4 buckets
+func m4(values [][]interface{}, n int) [][]interface{} {
+	return bucketReduce(values, n/4, true)
+}
+
+// bucketReduce splits values into buckets of equal time and keeps the
+// extremes of each, with the first and last points when edges is set.
+func bucketReduce(values [][]interface{}, buckets int, edges bool) [][]interface{} {
+	if buckets < 1 || len(values) == 0 {
+		return values
+	}
+	first, _ := pointXY(values[0])
+	last, _ := pointXY(values[len(values)-1])
+	width := (last - first) / float64(buckets)
+	if width <= 0 {
+		return values
+	}
+
+	res := make([][]interface{}, 0, buckets*4)
+	flush := func(bucket []int) {
+		if len(bucket) == 0 {
+			return
+		}
+		lo, hi := bucket[0], bucket[0]
+		_, loY := pointXY(values[lo])
+		hiY := loY
+		for _, k := range bucket[1:] {
+			_, y := pointXY(values[k])
+			if y < loY {
+				lo, loY = k, y
+			}
+			if y > hiY {
+				hi, hiY = k, y
+			}
+		}
+		keep := []int{lo, hi}
+		if edges {
+			keep = append(keep, bucket[0], bucket[len(bucket)-1])
+		}
+		// emit in time order without duplicates
+		sort.Ints(keep)
+		for i, k := range keep {
+			if i == 0 || k != keep[i-1] {
+				res = append(res, values[k])
+			}
+		}
+	}
+
+	var bucket []int
+	current := 0
+	for k, v := range values {
+		x, _ := pointXY(v)
+		b := int((x - first) / width)
+		if b >= buckets {
+			b = buckets - 1
+		}
+		if b != current {
+			flush(bucket)
+			bucket, current = bucket[:0], b
+		}
+		bucket = append(bucket, k)
+	}
+	flush(bucket)
+	return res
+}
@@ -0,0 +1,108 @@
+package query
+
+import (
+	"math"
+	"net/http/httptest"
+	"testing"
+)
+
+// sine returns n rows one second apart, every nullEvery-th value null
+func sine(n, nullEvery int) [][]interface{} {
+	values := make([][]interface{}, n)
+	for i := range values {
+		var v interface{} = math.Sin(float64(i) / 10)
+		if nullEvery > 0 && i%nullEvery == 0 {
+			v = nil
+		}
+		values[i] = []interface{}{float64(i), v}
+	}
+	return values
+}
+
+func TestDownsampleResults(t *testing.T) {
+	for method := range downsamplers {
+		for _, nullEvery := range []int{0, 3} {
+			rs := Results{Results: []Result{{Series: []Row{{Name: "cpu", Columns: []string{"time", "value"}, Values: sine(1000, nullEvery)}}}}}
+			values := downsampleResults(rs, method, 100).Results[0].Series[0].Values
+			if len(values) > 100 || len(values) < 10 {
+				t.Errorf("%s: %d points, want about 100", method, len(values))
+			}
+			prev := -1.0
+			for _, v := range values {
+				x, ok := v[0].(float64)
+				if !ok || x <= prev {
+					t.Errorf("%s: times not increasing at %v", method, v)
+				}
+				prev = x
+				if _, ok := v[1].(float64); !ok {
+					t.Errorf("%s: kept a null value at %v", method, v[0])
+				}
+			}
+		}
+	}
+}
+
+func TestDownsampleKeepsExtremes(t *testing.T) {
+	values := sine(1000, 0)
+	values[500][1] = 10.0
+	values[501][1] = nil
+	values[700][1] = -10.0
+	for method, f := range downsamplers {
+		got := f(numericValues(append([][]interface{}(nil), values...)), 100)
+		var min, max float64
+		for _, v := range got {
+			y := v[1].(float64)
+			min, max = math.Min(min, y), math.Max(max, y)
+		}
+		if min != -10 || max != 10 {
+			t.Errorf("%s: extremes %g %g, want -10 10", method, min, max)
+		}
+		if method != "minmax" && (got[0][0] != 0.0 || got[len(got)-1][0] != 999.0) {
+			t.Errorf("%s: edges %v %v not kept", method, got[0][0], got[len(got)-1][0])
+		}
+	}
+}
+
+func TestDownsampleParams(t *testing.T) {
+	tests := []struct {
+		query  string
+		method string
+		points int
+		err    bool
+	}{
+		{query: "", method: "", points: 0},
+		{query: "downsample=lttb", method: "lttb", points: defaultDownsamplePoints},
+		{query: "downsample=m4&points=400", method: "m4", points: 400},
+		{query: "downsample=avg", err: true},
+		{query: "downsample=lttb&points=3", err: true},
+		{query: "downsample=lttb&points=100000", err: true},
+		{query: "downsample=lttb&points=x", err: true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/query2?"+tt.query, nil)
+		method, points, err := downsampleParams(req)
+		if (err != nil) != tt.err || method != tt.method || points != tt.points {
+			t.Errorf("%s: got %q %d %v", tt.query, method, points, err)
+		}
+	}
+}
+
+func TestDownsampleInterval(t *testing.T) {
+	tests := []struct {
+		start, end string
+		points     int
+		want       string
+		err        bool
+	}{
+		{start: "0", end: "86400000", points: 1500, want: "7s"},
+		{start: "0", end: "60000", points: 1500, want: "1s"},
+		{start: "0", end: "0", points: 1500, err: true},
+		{start: "x", end: "1000", points: 1500, err: true},
+	}
+	for _, tt := range tests {
+		got, err := downsampleInterval(tt.start, tt.end, tt.points)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("downsampleInterval(%s, %s, %d) = %q, %v", tt.start, tt.end, tt.points, got, err)
+		}
+	}
+}
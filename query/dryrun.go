@@ -0,0 +1,267 @@
+package query
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lodastack/router/config"
+	"github.com/lodastack/router/influxql"
+	"github.com/lodastack/router/jobs"
+	"github.com/lodastack/router/loda"
+)
+
+const (
+	// confirm tokens of dry runs expire after confirmTTL
+	confirmTTL = 10 * time.Minute
+	// measurements counted by a dry run, the others are only listed
+	maxPreviewCounts    = 50
+	previewConcurrency  = 4
+	defaultPreviewRange = "1d"
+)
+
+// Preview is what a delete would remove. Points are counted in the last
+// Range unless the where of the delete bounds the time itself.
+type Preview struct {
+	Kind         string         `json:"kind"`
+	NS           string         `json:"ns"`
+	Range        string         `json:"range,omitempty"`
+	Measurements []PreviewEntry `json:"measurements"`
+	Series       int64          `json:"series"`
+	Points       int64          `json:"points"`
+	// Truncated is set when only the first measurements were counted
+	Truncated bool       `json:"truncated,omitempty"`
+	Confirm   string     `json:"confirm,omitempty"`
+	Expires   *time.Time `json:"expires,omitempty"`
+}
+
+// PreviewEntry is a measurement a delete would touch, Series and Points
+// are -1 when not counted.
+type PreviewEntry struct {
+	Measurement string `json:"measurement"`
+	Query       string `json:"query"`
+	Series      int64  `json:"series"`
+	Points      int64  `json:"points"`
+	Error       string `json:"error,omitempty"`
+}
+
+// needsConfirm reports whether r must present the token of a dry run:
+// every delete but dropping a measurement by its name.
+func needsConfirm(r jobRequest) bool {
+	return !(r.Kind == jobDropMeasurement && !r.Regexp)
+}
+
+var (
+	secretOnce sync.Once
+	secret     []byte
+)
+
+// confirmSecret signs the tokens, random per process if not configured
+func confirmSecret() []byte {
+	secretOnce.Do(func() {
+		if s := config.GetConfig().Jobs.ConfirmSecret; s != "" {
+			secret = []byte(s)
+			return
+		}
+		secret = make([]byte, 32)
+		rand.Read(secret)
+	})
+	return secret
+}
+
+// fingerprint identifies the delete of r and the statements it runs,
+// so that a token does not confirm measurements the dry run did not list
+func (r jobRequest) fingerprint(tasks []jobs.Task) string {
+	params := r.params()
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{r.Kind, r.NS}
+	for _, k := range keys {
+		parts = append(parts, k+"="+params[k])
+	}
+	queries := make([]string, len(tasks))
+	for i, t := range tasks {
+		queries[i] = t.Query
+	}
+	sort.Strings(queries)
+	sum := sha256.Sum256([]byte(strings.Join(queries, "\x00")))
+	parts = append(parts, hex.EncodeToString(sum[:]))
+	return strings.Join(parts, "\x00")
+}
+
+func confirmSign(r jobRequest, tasks []jobs.Task, expires int64) string {
+	mac := hmac.New(sha256.New, confirmSecret())
+	mac.Write([]byte(r.fingerprint(tasks)))
+	mac.Write([]byte(strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// confirmToken is "expires.signature", valid for the same request on
+// the same measurements only
+func confirmToken(r jobRequest, tasks []jobs.Task, expires time.Time) string {
+	exp := expires.Unix()
+	return strconv.FormatInt(exp, 10) + "." + confirmSign(r, tasks, exp)
+}
+
+func checkConfirm(r jobRequest, tasks []jobs.Task, token string) error {
+	if token == "" {
+		return fmt.Errorf("dry run the delete first and send its confirm token")
+	}
+	parts := strings.SplitN(token, ".", 2)
+	exp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) != 2 {
+		return fmt.Errorf("invalid confirm token")
+	}
+	if !hmac.Equal([]byte(parts[1]), []byte(confirmSign(r, tasks, exp))) {
+		return fmt.Errorf("confirm token is not for this delete or its measurements changed, dry run again")
+	}
+	if time.Now().Unix() > exp {
+		return fmt.Errorf("confirm token expired, dry run again")
+	}
+	return nil
+}
+
+// taskWhere is the condition of the delete of r, the series it touches
+func taskWhere(r jobRequest) string {
+	switch r.Kind {
+	case jobRemoveHost:
+		return fmt.Sprintf("%s = %s", influxql.QuoteIdent("host"), influxql.QuoteString(r.Value))
+	case jobDelete:
+		return r.Where
+	}
+	return ""
+}
+
+// timeBounded reports whether the condition where bounds the time
+func timeBounded(where string) bool {
+	q, err := influxql.ParseQuery("SELECT * FROM m WHERE " + where)
+	if err != nil || len(q.Statements) != 1 {
+		return false
+	}
+	s, ok := q.Statements[0].(*influxql.SelectStatement)
+	if !ok {
+		return false
+	}
+	min, max := s.TimeRange(time.Now())
+	return !min.IsZero() || !max.IsZero()
+}
+
+// previewJob counts the series and points the tasks of r would delete
+func previewJob(ctx context.Context, r jobRequest, tasks []jobs.Task, ip string) (Preview, error) {
+	p := Preview{Kind: r.Kind, NS: r.NS, Measurements: make([]PreviewEntry, len(tasks))}
+	influxdbs, err := loda.InfluxDBs(r.NS)
+	if err != nil {
+		return p, err
+	}
+	if len(influxdbs) == 0 {
+		return p, fmt.Errorf("%s has no route config", r.NS)
+	}
+
+	where := taskWhere(r)
+	pointsWhere := where
+	// the where of a delete bounding time needs no range
+	if r.Kind != jobDelete || !timeBounded(r.Where) {
+		p.Range = r.Range
+		if p.Range == "" {
+			p.Range = defaultPreviewRange
+		}
+		if d, err := influxql.ParseDuration(p.Range); err != nil || d <= 0 {
+			return p, fmt.Errorf("invalid range %s", p.Range)
+		}
+		cond := "time > now() - " + p.Range
+		if pointsWhere != "" {
+			pointsWhere = "(" + pointsWhere + ") AND " + cond
+		} else {
+			pointsWhere = cond
+		}
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, previewConcurrency)
+	for i, t := range tasks {
+		p.Measurements[i] = PreviewEntry{Measurement: t.Measurement, Query: t.Query, Series: -1, Points: -1}
+		if i >= maxPreviewCounts {
+			p.Truncated = true
+			continue
+		}
+		wg.Add(1)
+		go func(e *PreviewEntry) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			mt := influxql.QuoteIdent(e.Measurement)
+			q := "SHOW SERIES EXACT CARDINALITY FROM " + mt
+			if where != "" {
+				q += " WHERE " + where
+			}
+			series, err := countQuery(ctx, influxdbs, r.NS, q, ip)
+			if err != nil {
+				e.Error = err.Error()
+				return
+			}
+			points, err := countQuery(ctx, influxdbs, r.NS, "SELECT count(\"value\") FROM "+mt+" WHERE "+pointsWhere, ip)
+			if err != nil {
+				e.Error = err.Error()
+				return
+			}
+			e.Series, e.Points = series, points
+		}(&p.Measurements[i])
+	}
+	wg.Wait()
+
+	for _, e := range p.Measurements {
+		if e.Series > 0 {
+			p.Series += e.Series
+		}
+		if e.Points > 0 {
+			p.Points += e.Points
+		}
+	}
+	if needsConfirm(r) {
+		expires := time.Now().Add(confirmTTL)
+		p.Expires = &expires
+		p.Confirm = confirmToken(r, tasks, expires)
+	}
+	return p, nil
+}
+
+// countQuery sums the numbers in the results of q
+func countQuery(ctx context.Context, influxdbs []string, ns, q, ip string) (int64, error) {
+	params := url.Values{}
+	params.Set("q", q)
+	params.Set("db", ns)
+	params.Set("epoch", "s")
+	_, rs, err := queryInfluxDB(ctx, influxdbs, params, ip, false)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, r := range rs.Results {
+		if r.Error != "" {
+			return 0, fmt.Errorf("%s", r.Error)
+		}
+		for _, row := range r.Series {
+			for _, v := range row.Values {
+				// the count is the last column, after time if any
+				if len(v) > 0 {
+					if f, ok := v[len(v)-1].(float64); ok {
+						n += int64(f)
+					}
+				}
+			}
+		}
+	}
+	return n, nil
+}
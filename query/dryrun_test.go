@@ -0,0 +1,69 @@
+package query
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lodastack/router/jobs"
+)
+
+func TestTimeBounded(t *testing.T) {
+	tests := []struct {
+		where string
+		want  bool
+	}{
+		{where: `host = 'a'`},
+		{where: `uptime > 100`},
+		{where: `"time_zone" = 'utc'`},
+		{where: `host = 'a' AND time < now() - 30d`, want: true},
+		{where: `time > '2020-01-01T00:00:00Z' AND time < '2020-02-01T00:00:00Z'`, want: true},
+		{where: `(time >= 1600000000s)`, want: true},
+		// bounds in OR branches are ignored
+		{where: `host = 'a' OR time < now() - 30d`},
+		{where: `host = 'a`},
+		{where: `host = 'a'; DROP DATABASE x`},
+	}
+	for _, tt := range tests {
+		if got := timeBounded(tt.where); got != tt.want {
+			t.Errorf("timeBounded(%q) = %v, want %v", tt.where, got, tt.want)
+		}
+	}
+}
+
+func TestConfirmToken(t *testing.T) {
+	r := jobRequest{Kind: jobDelete, NS: "collect.a", Measurement: "cpu", Regexp: true, Where: `host = 'a'`}
+	tasks := deleteTasks([]string{"cpu.idle", "cpu.user"}, r.Where)
+	token := confirmToken(r, tasks, time.Now().Add(time.Minute))
+
+	if err := checkConfirm(r, tasks, token); err != nil {
+		t.Errorf("token of the dry run rejected: %s", err)
+	}
+	reordered := []jobs.Task{tasks[1], tasks[0]}
+	if err := checkConfirm(r, reordered, token); err != nil {
+		t.Errorf("token rejected for the tasks in another order: %s", err)
+	}
+
+	other := r
+	other.Where = `host = 'b'`
+	more := append(append([]jobs.Task(nil), tasks...), deleteTasks([]string{"cpu.new"}, r.Where)...)
+	tests := []struct {
+		name  string
+		r     jobRequest
+		tasks []jobs.Task
+		token string
+	}{
+		{name: "no token", r: r, tasks: tasks},
+		{name: "garbage", r: r, tasks: tasks, token: "garbage"},
+		{name: "other where", r: other, tasks: tasks, token: token},
+		{name: "new measurement", r: r, tasks: more, token: token},
+		{name: "fewer measurements", r: r, tasks: tasks[:1], token: token},
+		{name: "forged expiry", r: r, tasks: tasks, token: "9999999999" + token[strings.Index(token, "."):]},
+		{name: "expired", r: r, tasks: tasks, token: confirmToken(r, tasks, time.Now().Add(-time.Minute))},
+	}
+	for _, tt := range tests {
+		if err := checkConfirm(tt.r, tt.tasks, tt.token); err == nil {
+			t.Errorf("%s: token accepted", tt.name)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package query
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lodastack/router/audit"
+	"github.com/lodastack/router/influxql"
+	"github.com/lodastack/router/loda"
+	"github.com/lodastack/router/models"
+	"github.com/lodastack/router/worker"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/lodastack/log"
+)
+
+const (
+	// exports read every measurement exportWindow at a time
+	exportWindow      = 6 * time.Hour
+	importBatch       = 500
+	defaultImportRate = 5000
+	maxImportRate     = 100000
+	maxImportLine     = 1024 * 1024
+)
+
+// exportHandler streams the points of a namespace as gzip line protocol,
+// timestamps in seconds. measurement is a name, or a regexp with
+// regexp=true, all measurements if empty. tag=key=value filters series,
+// it may be repeated. starttime and endtime are in milliseconds.
+func (s *Service) exportHandler(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if err := req.ParseForm(); err != nil {
+		errResp(resp, http.StatusBadRequest, err.Error())
+		return
+	}
+	ns := req.Form.Get("ns")
+	measurement := req.Form.Get("measurement")
+	if ns == "" {
+		errResp(resp, http.StatusBadRequest, "need ns")
+		return
+	}
+	start, err := strconv.ParseInt(req.Form.Get("starttime"), 10, 64)
+	if err != nil {
+		errResp(resp, http.StatusBadRequest, "invalid starttime")
+		return
+	}
+	end := time.Now().UnixNano() / 1e6
+	if et := req.Form.Get("endtime"); et != "" {
+		if end, err = strconv.ParseInt(et, 10, 64); err != nil {
+			errResp(resp, http.StatusBadRequest, "invalid endtime")
+			return
+		}
+	}
+	if end <= start {
+		errResp(resp, http.StatusBadRequest, "endtime must be after starttime")
+		return
+	}
+	var conds []string
+	for _, tag := range req.Form["tag"] {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			errResp(resp, http.StatusBadRequest, "tag must be key=value")
+			return
+		}
+		conds = append(conds, fmt.Sprintf("%s = %s", influxql.QuoteIdent(kv[0]), influxql.QuoteString(kv[1])))
+	}
+
+	influxdbs, err := loda.InfluxDBs(ns)
+	if err != nil {
+		errResp(resp, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(influxdbs) == 0 {
+		errResp(resp, http.StatusNotFound, ns+" has no route config")
+		return
+	}
+	names := []string{measurement}
+	if measurement == "" || req.Form.Get("regexp") == "true" {
+		if names, err = matchMeasurements(ns, measurement); err != nil {
+			errResp(resp, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	rec := audit.FromContext(req.Context())
+	rec.SetNS(ns, req.URL.RawQuery)
+
+	resp.Header().Set("Content-Type", "application/gzip")
+	resp.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.lp.gz"`, ns))
+	gz := gzip.NewWriter(resp)
+	defer gz.Close()
+	w := bufio.NewWriter(gz)
+	defer w.Flush()
+	fmt.Fprintf(w, "# ns=%s precision=s starttime=%d endtime=%d\n", ns, start, end)
+
+	var total int64
+	for _, name := range names {
+		for from := start; from < end; from += exportWindow.Nanoseconds() / 1e6 {
+			to := from + exportWindow.Nanoseconds()/1e6
+			if to > end {
+				to = end
+			}
+			n, err := s.exportChunk(req, w, influxdbs, ns, name, from, to, conds)
+			total += n
+			if err != nil {
+				// the status is sent already, tell the reader in the file
+				log.Errorf("export %s %s failed: %s", ns, name, err)
+				fmt.Fprintf(w, "# error: export %s failed: %s\n", name, err)
+				rec.AddRows(total)
+				return
+			}
+		}
+	}
+	rec.AddRows(total)
+}
+
+// exportChunk writes the points of measurement name between from and to
+func (s *Service) exportChunk(req *http.Request, w io.Writer, influxdbs []string, ns, name string, from, to int64, conds []string) (int64, error) {
+	where := append([]string{fmt.Sprintf("time >= %dms AND time < %dms", from, to)}, conds...)
+	params := url.Values{}
+	params.Set("db", ns)
+	params.Set("epoch", "s")
+	params.Set("q", fmt.Sprintf("SELECT * FROM %s WHERE %s GROUP BY *", influxql.QuoteIdent(name), strings.Join(where, " AND ")))
+
+	ctx, cancel := queryContext(req, "export", ns)
+	defer cancel()
+	_, rs, err := queryInfluxDB(ctx, influxdbs, params, clientIP(req), false)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, r := range rs.Results {
+		if r.Error != "" {
+			return n, fmt.Errorf("%s", r.Error)
+		}
+		for _, row := range r.Series {
+			for _, v := range row.Values {
+				p := &models.Point{Measurement: name, Tags: row.Tags, Fields: make(map[string]interface{})}
+				for i, col := range row.Columns {
+					if i >= len(v) || v[i] == nil {
+						continue
+					}
+					if col == "time" {
+						if ts, ok := v[i].(float64); ok {
+							p.Timestamp = int64(ts)
+						}
+						continue
+					}
+					p.Fields[col] = v[i]
+				}
+				if len(p.Fields) == 0 {
+					continue
+				}
+				if _, err := io.WriteString(w, p.Line()+"\n"); err != nil {
+					return n, err
+				}
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+// importHandler writes line protocol, gzip or plain, into ns through the
+// write path. Timestamps are read in precision, s by default as exported,
+// at most rate points are written per second.
+func (s *Service) importHandler(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ns := req.FormValue("ns")
+	if ns == "" {
+		errResp(resp, http.StatusBadRequest, "need ns")
+		return
+	}
+	precision := req.FormValue("precision")
+	if precision == "" {
+		precision = "s"
+	}
+	rate, err := intParam(req, "rate", defaultImportRate, 1, maxImportRate)
+	if err != nil {
+		errResp(resp, http.StatusBadRequest, err.Error())
+		return
+	}
+	audit.FromContext(req.Context()).SetNS(ns, "import")
+
+	body := bufio.NewReader(req.Body)
+	defer req.Body.Close()
+	var r io.Reader = body
+	// gzip files are recognized by their magic number
+	if magic, _ := body.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			errResp(resp, http.StatusBadRequest, err.Error())
+			return
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	var written, skipped int
+	started := time.Now()
+	batch := models.Points{Database: ns, Precision: "s"}
+	flush := func() error {
+		if len(batch.Points) == 0 {
+			return nil
+		}
+		if err := worker.ImportPoints(ns, batch); err != nil {
+			return err
+		}
+		written += len(batch.Points)
+		batch.Points = nil
+		expected := time.Duration(float64(written) / float64(rate) * float64(time.Second))
+		if wait := expected - time.Since(started); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-req.Context().Done():
+				return req.Context().Err()
+			}
+		}
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxImportLine)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p, err := models.ParseLine(line, precision)
+		if err != nil {
+			skipped++
+			continue
+		}
+		batch.Points = append(batch.Points, p)
+		if len(batch.Points) >= importBatch {
+			if err := flush(); err != nil {
+				importErrResp(resp, written, skipped, err)
+				return
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		importErrResp(resp, written, skipped, err)
+		return
+	}
+	if err := flush(); err != nil {
+		importErrResp(resp, written, skipped, err)
+		return
+	}
+	audit.FromContext(req.Context()).AddRows(int64(written))
+	succResp(resp, "OK", ImportResult{Written: written, Skipped: skipped})
+}
+
+// ImportResult counts the written points and the invalid lines skipped
+type ImportResult struct {
+	Written int `json:"written"`
+	Skipped int `json:"skipped"`
+}
+
+// importErrResp tells how far a failed import went, to resume it
+func importErrResp(resp http.ResponseWriter, written, skipped int, err error) {
+	errDataResp(resp, http.StatusInternalServerError, err.Error(), ImportResult{Written: written, Skipped: skipped})
+}
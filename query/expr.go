@@ -0,0 +1,266 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lodastack/router/audit"
+	"github.com/lodastack/router/config"
+	"github.com/lodastack/router/expr"
+	"github.com/lodastack/router/influxql"
+)
+
+// maxExprSelectors limits the series fetched by one expression
+const maxExprSelectors = 10
+
+// exprParams are the query2 params shared by the selectors of an expression
+type exprParams struct {
+	ns        string
+	influxdbs []string
+	start     string
+	end       string
+	where     string
+	fn        string
+	fill      string
+	ip        string
+
+	// downsample, points and compare of query2
+	downsample string
+	points     int
+	shifts     []compareShift
+	// GROUP BY interval of the selectors
+	interval string
+}
+
+// selectorWhere turns the tag matchers of sel into an InfluxQL condition
+func selectorWhere(sel *expr.Selector) string {
+	conds := make([]string, 0, len(sel.Matchers))
+	for _, m := range sel.Matchers {
+		val := influxql.QuoteString(m.Value)
+		if m.Op == "=~" || m.Op == "!~" {
+			val = "/" + strings.Replace(m.Value, "/", `\/`, -1) + "/"
+		}
+		conds = append(conds, fmt.Sprintf("%s %s %s", influxql.QuoteIdent(m.Key), m.Op, val))
+	}
+	return strings.Join(conds, " AND ")
+}
+
+// selectorQuery builds the query2 query of sel, series are grouped by
+// the tags used in its matchers and the where param.
+func selectorQuery(sel *expr.Selector, p exprParams) (string, error) {
+	if strings.ContainsAny(sel.Measurement, `"\`) {
+		return "", fmt.Errorf("invalid measurement %s", sel.Measurement)
+	}
+	tags, err := tags(p.ns, sel.Measurement)
+	if err != nil {
+		return "", err
+	}
+	if len(tags) > 10 {
+		return "", fmt.Errorf("%s tag > 10", sel.Measurement)
+	}
+	var tagkeys []string
+	for tagkey := range tags {
+		tagkeys = append(tagkeys, tagkey)
+	}
+
+	var conds []string
+	if w := selectorWhere(sel); w != "" {
+		conds = append(conds, w)
+	}
+	if p.where != "" {
+		conds = append(conds, "("+p.where+")")
+	}
+	return newIntervalQuery(sel.Measurement, p.start, p.end, p.interval, tagkeys, strings.Join(conds, " AND "), p.fn, p.fill)
+}
+
+// fetchSelectors queries the series of every selector of e concurrently
+func fetchSelectors(ctx context.Context, e expr.Node, p exprParams) (map[string][]expr.Series, error) {
+	sels := expr.Selectors(e)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		data     = make(map[string][]expr.Series, len(sels))
+	)
+	for _, sel := range sels {
+		wg.Add(1)
+		go func(sel *expr.Selector) {
+			defer wg.Done()
+			series, err := selectorSeries(ctx, sel, p)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("%s: %s", sel, err)
+				}
+				return
+			}
+			data[sel.String()] = series
+		}(sel)
+	}
+	wg.Wait()
+	return data, firstErr
+}
+
+func selectorSeries(ctx context.Context, sel *expr.Selector, p exprParams) ([]expr.Series, error) {
+	q, err := selectorQuery(sel, p)
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	params.Set("q", q)
+	params.Set("db", p.ns)
+	params.Set("epoch", "s")
+	_, rs, err := queryInfluxDB(ctx, p.influxdbs, params, p.ip, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var series []expr.Series
+	for _, r := range rs.Results {
+		if r.Error != "" {
+			return nil, fmt.Errorf("%s", r.Error)
+		}
+		for _, row := range r.Series {
+			s := expr.Series{Tags: row.Tags}
+			for _, v := range row.Values {
+				if len(v) < 2 {
+					continue
+				}
+				t, ok := v[0].(float64)
+				val, vok := v[1].(float64)
+				if !ok || !vok {
+					continue
+				}
+				s.Points = append(s.Points, expr.Point{Time: int64(t), Value: val})
+			}
+			series = append(series, s)
+		}
+	}
+	return series, nil
+}
+
+// exprResults returns series in the query2 results shape
+func exprResults(name string, series []expr.Series) Results {
+	rows := make([]Row, 0, len(series))
+	for _, s := range series {
+		row := Row{Name: name, Tags: s.Tags, Columns: []string{"time", "value"}}
+		for _, p := range s.Points {
+			row.Values = append(row.Values, []interface{}{float64(p.Time), SetPrecision(p.Value, 4)})
+		}
+		rows = append(rows, row)
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		return tagString(rows[i].Tags) < tagString(rows[j].Tags)
+	})
+	return Results{Results: []Result{{Series: rows}}}
+}
+
+func tagString(tags map[string]string) string {
+	kv := make([]string, 0, len(tags))
+	for k, v := range tags {
+		kv = append(kv, k+"="+v)
+	}
+	sort.Strings(kv)
+	return strings.Join(kv, ",")
+}
+
+// query2Expr serves query2 requests with an expr param
+func (s *Service) query2Expr(resp http.ResponseWriter, req *http.Request, e expr.Node, exprStr, format string, p exprParams) {
+	p.start, p.end = alignRange(p.start, p.end)
+	p.interval = defaultInterval(p.start, p.end)
+	if p.downsample != "" {
+		interval, err := downsampleInterval(p.start, p.end, p.points)
+		if err != nil {
+			errResp(resp, http.StatusBadRequest, err.Error())
+			return
+		}
+		p.interval = interval
+	}
+	sels := expr.Selectors(e)
+	if len(sels) == 0 {
+		errResp(resp, http.StatusBadRequest, "expr has no series")
+		return
+	}
+	if len(sels) > maxExprSelectors {
+		errResp(resp, http.StatusBadRequest, fmt.Sprintf("expr has more than %d series", maxExprSelectors))
+		return
+	}
+	rec := audit.FromContext(req.Context())
+	rec.SetNS(p.ns, exprStr)
+
+	cacheable := config.GetConfig().Cache.Enable
+	key := strings.Join([]string{"query2|expr", p.ns, e.String(), p.start, p.end, p.where, p.fn, p.fill, p.downsample, strconv.Itoa(p.points), req.FormValue("compare")}, "|")
+	if cacheable {
+		if rs, ok := s.c.Get(key).(Results); ok {
+			if lerr := checkResults(rs, queryLimits(req, p.ns)); lerr != nil {
+				limitErrResp(resp, lerr)
+				return
+			}
+			_, points := resultsRows(rs)
+			rec.AddRows(points)
+			resp.Header().Set("X-Cache", "HIT")
+			writeResults(resp, req, format, rs, time.Second)
+			return
+		}
+	}
+
+	ctx, cancel := queryContext(req, "query2", p.ns)
+	defer cancel()
+	data, err := fetchSelectors(ctx, e, p)
+	if err != nil {
+		queryErrResp(resp, ctx, err)
+		return
+	}
+	series, err := expr.Eval(e, data)
+	if err != nil {
+		errResp(resp, http.StatusBadRequest, "eval expr failed: "+err.Error())
+		return
+	}
+	rs := exprResults(exprStr, series)
+	if len(p.shifts) > 0 {
+		rs, err = compareResults(ctx, rs, p.shifts, p.interval, p.start, p.end, func(ctx context.Context, st, et string) (Results, error) {
+			sp := p
+			sp.start, sp.end = st, et
+			data, err := fetchSelectors(ctx, e, sp)
+			if err != nil {
+				return Results{}, err
+			}
+			series, err := expr.Eval(e, data)
+			if err != nil {
+				return Results{}, err
+			}
+			return exprResults(exprStr, series), nil
+		})
+		if err != nil {
+			queryErrResp(resp, ctx, err)
+			return
+		}
+	}
+	if p.downsample != "" {
+		rs = downsampleResults(rs, p.downsample, p.points)
+	}
+	if cacheable {
+		var end time.Time
+		if et, err := strconv.ParseInt(p.end, 10, 64); err == nil {
+			end = time.Unix(0, et*int64(time.Millisecond))
+		}
+		s.c.Set(key, rs, resultTTL(end))
+	}
+	if lerr := checkResults(rs, queryLimits(req, p.ns)); lerr != nil {
+		limitErrResp(resp, lerr)
+		return
+	}
+	_, points := resultsRows(rs)
+	rec.AddRows(points)
+
+	writeResults(resp, req, format, rs, time.Second)
+}
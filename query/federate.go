@@ -0,0 +1,229 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lodastack/router/audit"
+	"github.com/lodastack/router/config"
+	"github.com/lodastack/router/loda"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// nsPlaceholder in a federated query is replaced by each namespace
+	nsPlaceholder = "$ns"
+	// maxFederatedNS bounds the namespaces of one federated query
+	maxFederatedNS = 500
+	// federateWorkers is the number of namespaces queried at a time
+	federateWorkers = 16
+)
+
+// FederatedResult merges the series of every namespace, each tagged by
+// its namespace, Errors holds the namespaces which failed.
+type FederatedResult struct {
+	Series []Row             `json:"series"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// federateHandler runs one query template against many namespaces,
+// e.g. /federate?ns=collect.*.web&q=SELECT mean(value) FROM "$ns"."autogen"."cpu.idle" WHERE time > now() - 1h
+func (s *Service) federateHandler(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if req.Method != "GET" && req.Method != "POST" {
+		errResp(resp, http.StatusMethodNotAllowed, "Get or Post please!")
+		return
+	}
+
+	tmpl := req.FormValue("q")
+	if tmpl == "" {
+		errResp(resp, http.StatusBadRequest, "q is empty")
+		return
+	}
+	nss, err := federatedNS(req.FormValue("ns"))
+	if err != nil {
+		errResp(resp, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(nss) == 0 {
+		errResp(resp, http.StatusNotFound, "no namespace matched")
+		return
+	}
+	if len(nss) > maxFederatedNS {
+		errResp(resp, http.StatusBadRequest, fmt.Sprintf("%d namespaces matched, max %d", len(nss), maxFederatedNS))
+		return
+	}
+
+	// check the template before fanning out, errors of the query are the
+	// same for every namespace
+	if _, err := parseQuery(strings.Replace(tmpl, nsPlaceholder, nss[0], -1)); err != nil {
+		errResp(resp, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	audit.FromContext(req.Context()).SetNS(strings.Join(nss, ","), tmpl)
+	limits := func(ns string) *config.LimitConfig { return queryLimits(req, ns) }
+	rs := federate(req.Context(), nss, tmpl, req.FormValue("epoch"), req.Header.Get("X-Real-IP"), limits)
+	if len(rs.Errors) == len(nss) {
+		errResp(resp, http.StatusBadGateway, fmt.Sprintf("all namespaces failed: %v", rs.Errors))
+		return
+	}
+	succResp(resp, "OK", rs)
+}
+
+// federatedNS resolves a comma separated list of namespaces, entries with
+// wildcards are matched against the namespaces of the registry.
+func federatedNS(list string) ([]string, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, fmt.Errorf("ns is empty")
+	}
+	var all []string
+	seen := make(map[string]bool)
+	var nss []string
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if !strings.ContainsAny(pattern, "*?[") {
+			if !seen[pattern] {
+				seen[pattern] = true
+				nss = append(nss, pattern)
+			}
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad ns pattern %s: %s", pattern, err)
+		}
+		if all == nil {
+			var err error
+			if all, err = loda.Namespaces(); err != nil {
+				return nil, err
+			}
+		}
+		for _, ns := range all {
+			if ok, _ := path.Match(pattern, ns); ok && !seen[ns] {
+				seen[ns] = true
+				nss = append(nss, ns)
+			}
+		}
+	}
+	sort.Strings(nss)
+	return nss, nil
+}
+
+// federate queries every namespace concurrently and merges the results,
+// each namespace within its limits
+func federate(ctx context.Context, nss []string, tmpl, epoch, ip string, limits func(ns string) *config.LimitConfig) FederatedResult {
+	type nsResult struct {
+		ns     string
+		series []Row
+		err    error
+	}
+
+	jobs := make(chan string)
+	results := make(chan nsResult)
+	var wg sync.WaitGroup
+	workers := federateWorkers
+	if len(nss) < workers {
+		workers = len(nss)
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ns := range jobs {
+				series, err := federateNS(ctx, ns, tmpl, epoch, ip, limits(ns))
+				results <- nsResult{ns: ns, series: series, err: err}
+			}
+		}()
+	}
+	go func() {
+		for _, ns := range nss {
+			jobs <- ns
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	rs := FederatedResult{Series: []Row{}}
+	for r := range results {
+		if r.err != nil {
+			if rs.Errors == nil {
+				rs.Errors = make(map[string]string)
+			}
+			rs.Errors[r.ns] = r.err.Error()
+			continue
+		}
+		rs.Series = append(rs.Series, r.series...)
+	}
+	sort.SliceStable(rs.Series, func(i, j int) bool {
+		return rs.Series[i].Tags["ns"] < rs.Series[j].Tags["ns"]
+	})
+	return rs
+}
+
+// federateNS runs the template against ns on the cluster of ns, within
+// the query timeout and the limits l of ns
+func federateNS(parent context.Context, ns, tmpl, epoch, ip string, l *config.LimitConfig) ([]Row, error) {
+	q := strings.Replace(tmpl, nsPlaceholder, ns, -1)
+	query, err := parseQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	if lerr := checkQuery(query, l, time.Now()); lerr != nil {
+		return nil, lerr
+	}
+	_, influxdbs, err := routeQuery(query, ns)
+	if err != nil {
+		return nil, err
+	}
+	if len(influxdbs) == 0 {
+		return nil, fmt.Errorf("%s has no influxdb route config", ns)
+	}
+
+	params := url.Values{"db": {ns}, "q": {q}}
+	if epoch != "" {
+		params.Set("epoch", epoch)
+	}
+	ctx, cancel := context.WithTimeout(parent, queryTimeout("federate", ns))
+	defer cancel()
+	status, rs, err := queryInfluxDB(ctx, influxdbs, params, ip, false)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("query timeout")
+		}
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("influxdb status %d", status)
+	}
+	if lerr := checkResults(rs, l); lerr != nil {
+		return nil, lerr
+	}
+
+	var series []Row
+	for _, result := range rs.Results {
+		if result.Error != "" {
+			return nil, fmt.Errorf("%s", result.Error)
+		}
+		for _, row := range result.Series {
+			tags := make(map[string]string, len(row.Tags)+1)
+			for k, v := range row.Tags {
+				tags[k] = v
+			}
+			tags["ns"] = ns
+			row.Tags = tags
+			series = append(series, row)
+		}
+	}
+	return series, nil
+}
@@ -0,0 +1,26 @@
+package query
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lodastack/router/config"
+)
+
+func TestFederateNSLimits(t *testing.T) {
+	l := &config.LimitConfig{MaxRawRange: 3600}
+	tests := []struct {
+		tmpl  string
+		limit string
+	}{
+		{tmpl: `SELECT value FROM "$ns"."autogen"."cpu.idle"`, limit: limitMaxRawRange},
+		{tmpl: `SELECT value FROM "$ns"."autogen"."cpu.idle" WHERE time > now() - 2h`, limit: limitMaxRawRange},
+	}
+	for _, tt := range tests {
+		_, err := federateNS(context.Background(), "collect.a", tt.tmpl, "", "", l)
+		lerr, ok := err.(*LimitError)
+		if !ok || lerr.Limit != tt.limit {
+			t.Errorf("%s: error %v, want %s", tt.tmpl, err, tt.limit)
+		}
+	}
+}
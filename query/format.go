@@ -0,0 +1,246 @@
+package query
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// output formats of the query APIs
+const (
+	formatJSON    = "json"
+	formatCSV     = "csv"
+	formatMsgpack = "msgpack"
+
+	mimeCSV     = "text/csv"
+	mimeMsgpack = "application/x-msgpack"
+)
+
+// responseFormat picks the output format from the format param, or
+// from the Accept header
+func responseFormat(req *http.Request) (string, error) {
+	switch f := strings.ToLower(req.FormValue("format")); f {
+	case formatJSON, formatCSV, formatMsgpack:
+		return f, nil
+	case "":
+	default:
+		return "", fmt.Errorf("unknown format %s", f)
+	}
+	accept := req.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, mimeCSV):
+		return formatCSV, nil
+	case strings.Contains(accept, mimeMsgpack):
+		return formatMsgpack, nil
+	}
+	return formatJSON, nil
+}
+
+// epochUnit is the unit of the epoch param of InfluxDB, 0 if times are
+// RFC3339 strings
+func epochUnit(epoch string) time.Duration {
+	switch epoch {
+	case "h":
+		return time.Hour
+	case "m":
+		return time.Minute
+	case "s":
+		return time.Second
+	case "ms":
+		return time.Millisecond
+	case "u", "µ":
+		return time.Microsecond
+	case "ns", "n":
+		return time.Nanosecond
+	}
+	return 0
+}
+
+// writeResults writes rs in format, JSON keeps the shape of succResp.
+// Epoch times are converted to RFC3339 in CSV with time_format=rfc3339.
+func writeResults(resp http.ResponseWriter, req *http.Request, format string, rs Results, unit time.Duration) {
+	switch format {
+	case formatCSV:
+		data, err := resultsCSV(rs, unit, req.FormValue("time_format") == "rfc3339")
+		if err != nil {
+			errResp(resp, http.StatusInternalServerError, err.Error())
+			return
+		}
+		resp.Header().Set("Content-Type", mimeCSV)
+		resp.WriteHeader(http.StatusOK)
+		resp.Write(data)
+	case formatMsgpack:
+		data, err := msgpackMarshal(Response{StatusCode: http.StatusOK, Msg: "OK", Data: rs})
+		if err != nil {
+			errResp(resp, http.StatusInternalServerError, err.Error())
+			return
+		}
+		resp.Header().Set("Content-Type", mimeMsgpack)
+		resp.WriteHeader(http.StatusOK)
+		resp.Write(data)
+	default:
+		succResp(resp, "OK", rs)
+	}
+}
+
+// writeRaw converts a raw InfluxDB JSON response to format
+func writeRaw(resp http.ResponseWriter, req *http.Request, format string, status int, body []byte, unit time.Duration) {
+	switch format {
+	case formatCSV:
+		rs, err := decodeRaw(body)
+		if err != nil {
+			errResp(resp, http.StatusInternalServerError, err.Error())
+			return
+		}
+		data, err := resultsCSV(rs, unit, req.FormValue("time_format") == "rfc3339")
+		if err != nil {
+			errResp(resp, http.StatusInternalServerError, err.Error())
+			return
+		}
+		resp.Header().Set("Content-Type", mimeCSV)
+		resp.WriteHeader(status)
+		resp.Write(data)
+	case formatMsgpack:
+		var generic interface{}
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		if err := dec.Decode(&generic); err != nil {
+			errResp(resp, http.StatusInternalServerError, err.Error())
+			return
+		}
+		var buf bytes.Buffer
+		if err := msgpackEncode(&buf, generic); err != nil {
+			errResp(resp, http.StatusInternalServerError, err.Error())
+			return
+		}
+		resp.Header().Set("Content-Type", mimeMsgpack)
+		resp.WriteHeader(status)
+		resp.Write(buf.Bytes())
+	default:
+		resp.Header().Add("Content-Type", "application/json")
+		resp.WriteHeader(status)
+		resp.Write(body)
+	}
+}
+
+// decodeRaw decodes an InfluxDB response keeping numbers exact
+func decodeRaw(body []byte) (Results, error) {
+	var rs struct {
+		Results []Result `json:"results"`
+		Error   string   `json:"error"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&rs); err != nil {
+		return Results{}, err
+	}
+	if rs.Error != "" {
+		return Results{}, fmt.Errorf("%s", rs.Error)
+	}
+	return Results{Results: rs.Results}, nil
+}
+
+// resultsCSV flattens every series into one table: the name, a column
+// per tag key and the union of the value columns.
+func resultsCSV(rs Results, unit time.Duration, rfc3339 bool) ([]byte, error) {
+	var series []Row
+	for _, r := range rs.Results {
+		if r.Error != "" {
+			return nil, fmt.Errorf("%s", r.Error)
+		}
+		series = append(series, r.Series...)
+	}
+
+	tagSet := make(map[string]bool)
+	var columns []string
+	colIndex := make(map[string]int)
+	for _, s := range series {
+		for k := range s.Tags {
+			tagSet[k] = true
+		}
+		for _, c := range s.Columns {
+			if _, ok := colIndex[c]; !ok {
+				colIndex[c] = len(columns)
+				columns = append(columns, c)
+			}
+		}
+	}
+	tagKeys := make([]string, 0, len(tagSet))
+	for k := range tagSet {
+		tagKeys = append(tagKeys, k)
+	}
+	sort.Strings(tagKeys)
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	header := append(append([]string{"name"}, tagKeys...), columns...)
+	if err := w.Write(header); err != nil {
+		return nil, err
+	}
+	for _, s := range series {
+		values := s.Values
+		if values == nil {
+			values = s.Data
+		}
+		for _, v := range values {
+			record := make([]string, len(header))
+			record[0] = s.Name
+			for i, k := range tagKeys {
+				record[1+i] = s.Tags[k]
+			}
+			for i, c := range s.Columns {
+				if i >= len(v) {
+					break
+				}
+				cell := csvCell(v[i])
+				if c == "time" && rfc3339 && unit > 0 {
+					cell = epochRFC3339(v[i], unit, cell)
+				}
+				record[1+len(tagKeys)+colIndex[c]] = cell
+			}
+			if err := w.Write(record); err != nil {
+				return nil, err
+			}
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+func csvCell(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case json.Number:
+		return v.String()
+	}
+	return fmt.Sprint(v)
+}
+
+// epochRFC3339 formats an epoch time in unit, or returns def
+func epochRFC3339(v interface{}, unit time.Duration, def string) string {
+	var n int64
+	switch v := v.(type) {
+	case float64:
+		n = int64(v)
+	case json.Number:
+		i, err := v.Int64()
+		if err != nil {
+			return def
+		}
+		n = i
+	default:
+		return def
+	}
+	return time.Unix(0, n*int64(unit)).UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,548 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lodastack/router/audit"
+	"github.com/lodastack/router/influx"
+	"github.com/lodastack/router/influxql"
+	"github.com/lodastack/router/loda"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// The Grafana simple JSON datasource API, mounted under /grafana/. A
+// target is a measurement of a namespace, given as "ns/measurement" or
+// as the measurement with {"ns": ...} in its data.
+
+type grafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+type grafanaFilter struct {
+	Key      string `json:"key"`
+	Operator string `json:"operator"`
+	Value    string `json:"value"`
+}
+
+type grafanaTargetData struct {
+	NS    string `json:"ns"`
+	Fn    string `json:"fn"`
+	Fill  string `json:"fill"`
+	Where string `json:"where"`
+}
+
+type grafanaTarget struct {
+	RefID   string             `json:"refId"`
+	Target  string             `json:"target"`
+	Type    string             `json:"type"`
+	Data    *grafanaTargetData `json:"data"`
+	Payload *grafanaTargetData `json:"payload"`
+}
+
+type grafanaQueryReq struct {
+	Range        grafanaRange    `json:"range"`
+	Targets      []grafanaTarget `json:"targets"`
+	AdhocFilters []grafanaFilter `json:"adhocFilters"`
+}
+
+type grafanaSeries struct {
+	Target     string          `json:"target"`
+	RefID      string          `json:"refId,omitempty"`
+	Datapoints [][]interface{} `json:"datapoints"`
+}
+
+type grafanaColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type,omitempty"`
+}
+
+type grafanaTable struct {
+	Type    string          `json:"type"`
+	RefID   string          `json:"refId,omitempty"`
+	Columns []grafanaColumn `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+type grafanaAnnotationReq struct {
+	Range      grafanaRange `json:"range"`
+	Annotation struct {
+		Name  string `json:"name"`
+		Query string `json:"query"`
+	} `json:"annotation"`
+}
+
+type grafanaAnnotation struct {
+	Annotation interface{} `json:"annotation"`
+	Time       int64       `json:"time"`
+	Title      string      `json:"title"`
+	Text       string      `json:"text"`
+	Tags       []string    `json:"tags,omitempty"`
+}
+
+type grafanaTagReq struct {
+	NS          string `json:"ns"`
+	Measurement string `json:"measurement"`
+	Key         string `json:"key"`
+}
+
+type grafanaText struct {
+	Type string `json:"type,omitempty"`
+	Text string `json:"text"`
+}
+
+func grafanaResp(resp http.ResponseWriter, v interface{}) {
+	bytes, _ := json.Marshal(v)
+	resp.Header().Add("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(bytes)
+}
+
+func decodeBody(req *http.Request, v interface{}) error {
+	if req.Body == nil {
+		return nil
+	}
+	defer req.Body.Close()
+	err := json.NewDecoder(req.Body).Decode(v)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// splitTarget splits "ns/measurement", ns in data wins
+func splitTarget(t grafanaTarget) (string, string, grafanaTargetData) {
+	var data grafanaTargetData
+	if t.Data != nil {
+		data = *t.Data
+	} else if t.Payload != nil {
+		data = *t.Payload
+	}
+	measurement := t.Target
+	if i := strings.Index(measurement, "/"); i > 0 {
+		if data.NS == "" {
+			data.NS = measurement[:i]
+		}
+		measurement = measurement[i+1:]
+	}
+	return data.NS, measurement, data
+}
+
+func (s *Service) grafanaTestHandler(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	resp.WriteHeader(http.StatusOK)
+}
+
+// grafanaSearchHandler lists the namespaces for an empty target, the
+// measurements of the namespace given as target otherwise
+func (s *Service) grafanaSearchHandler(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var body struct {
+		Target string `json:"target"`
+	}
+	if err := decodeBody(req, &body); err != nil {
+		errResp(resp, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ns := strings.TrimSuffix(body.Target, "/")
+	if ns == "" || ns == "*" {
+		nss, err := loda.Namespaces()
+		if err != nil {
+			errResp(resp, http.StatusInternalServerError, err.Error())
+			return
+		}
+		sort.Strings(nss)
+		grafanaResp(resp, nss)
+		return
+	}
+
+	ms, err := measurements(ns)
+	if err != nil {
+		errResp(resp, http.StatusInternalServerError, err.Error())
+		return
+	}
+	names := []string{}
+	for _, group := range ms {
+		for name := range group {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	grafanaResp(resp, names)
+}
+
+func (s *Service) grafanaQueryHandler(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var body grafanaQueryReq
+	if err := decodeBody(req, &body); err != nil {
+		errResp(resp, http.StatusBadRequest, err.Error())
+		return
+	}
+	start := strconv.FormatInt(body.Range.From.UnixNano()/1e6, 10)
+	end := strconv.FormatInt(body.Range.To.UnixNano()/1e6, 10)
+	start, end = alignRange(start, end)
+
+	rs := []interface{}{}
+	for _, t := range body.Targets {
+		if t.Target == "" {
+			continue
+		}
+		ns, measurement, data := splitTarget(t)
+		if ns == "" {
+			errResp(resp, http.StatusBadRequest, "no ns of target "+t.Target)
+			return
+		}
+		where := grafanaWhere(data.Where, body.AdhocFilters)
+		ctx, cancel := queryContext(req, "grafana", ns)
+		series, err := grafanaSeriesOf(ctx, ns, measurement, start, end, where, data, req.Header.Get("X-Real-IP"))
+		if err != nil {
+			queryErrResp(resp, ctx, fmt.Errorf("%s query failed: %s", ns, err))
+			cancel()
+			return
+		}
+		cancel()
+		if t.Type == "table" {
+			rs = append(rs, grafanaTableOf(t.RefID, series))
+			continue
+		}
+		for _, row := range series {
+			gs := grafanaSeries{Target: seriesName(row), RefID: t.RefID, Datapoints: [][]interface{}{}}
+			for _, v := range row.Values {
+				if len(v) < 2 {
+					continue
+				}
+				gs.Datapoints = append(gs.Datapoints, []interface{}{v[1], v[0]})
+			}
+			rs = append(rs, gs)
+		}
+	}
+	grafanaResp(resp, rs)
+}
+
+// grafanaWhere adds the ad hoc filters to the where of a target
+func grafanaWhere(where string, filters []grafanaFilter) string {
+	var conds []string
+	if where != "" {
+		conds = append(conds, "("+where+")")
+	}
+	for _, f := range filters {
+		switch f.Operator {
+		case "=", "!=", "<", ">":
+			conds = append(conds, fmt.Sprintf("%s %s %s", influxql.QuoteIdent(f.Key), f.Operator, influxql.QuoteString(f.Value)))
+		case "=~", "!~":
+			conds = append(conds, fmt.Sprintf("%s %s /%s/", influxql.QuoteIdent(f.Key), f.Operator, regexLiteral(f.Value)))
+		}
+	}
+	return strings.Join(conds, " AND ")
+}
+
+// checkGrafanaQuery checks q built from a request is one read only
+// statement, the where or names of the request may not end it
+func checkGrafanaQuery(q string) error {
+	query, err := parseQuery(q)
+	if err != nil {
+		return fmt.Errorf("invalid query: %s", err)
+	}
+	if len(query.Statements) != 1 {
+		return fmt.Errorf("invalid query: more than one statement")
+	}
+	return nil
+}
+
+func grafanaSeriesOf(ctx context.Context, ns, measurement, start, end, where string, data grafanaTargetData, ip string) ([]Row, error) {
+	influxdbs, err := loda.InfluxDBs(ns)
+	if err != nil {
+		return nil, err
+	}
+	if len(influxdbs) == 0 {
+		return nil, fmt.Errorf("%s has no influxdb route config", ns)
+	}
+	tagsMap, err := tags(ns, measurement)
+	if err != nil {
+		return nil, err
+	}
+	var tagkeys []string
+	for tagkey := range tagsMap {
+		tagkeys = append(tagkeys, tagkey)
+	}
+	query, err := NewQuery(measurement, start, end, tagkeys, where, data.Fn, data.Fill)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkGrafanaQuery(query); err != nil {
+		return nil, err
+	}
+	audit.FromContext(ctx).SetNS(ns, query)
+
+	p := url.Values{}
+	p.Set("q", query)
+	p.Set("db", ns)
+	p.Set("epoch", "ms")
+	_, rs, err := queryInfluxDB(ctx, influxdbs, p, ip, false)
+	if err != nil {
+		return nil, err
+	}
+	var series []Row
+	for _, result := range rs.Results {
+		if result.Error != "" {
+			return nil, fmt.Errorf("%s", result.Error)
+		}
+		series = append(series, result.Series...)
+	}
+	return series, nil
+}
+
+// seriesName is the measurement followed by the sorted tags
+func seriesName(row Row) string {
+	if len(row.Tags) == 0 {
+		return row.Name
+	}
+	keys := make([]string, 0, len(row.Tags))
+	for k := range row.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + "=" + row.Tags[k]
+	}
+	return row.Name + " {" + strings.Join(pairs, ", ") + "}"
+}
+
+// grafanaTableOf flattens series into one table, a column per tag key
+func grafanaTableOf(refID string, series []Row) grafanaTable {
+	t := grafanaTable{Type: "table", RefID: refID, Rows: [][]interface{}{}}
+	keySet := make(map[string]bool)
+	for _, row := range series {
+		for k := range row.Tags {
+			keySet[k] = true
+		}
+	}
+	var keys []string
+	for k := range keySet {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var columns []string
+	if len(series) > 0 {
+		columns = series[0].Columns
+	}
+	for i, c := range columns {
+		typ := "number"
+		if i == 0 {
+			typ = "time"
+		}
+		t.Columns = append(t.Columns, grafanaColumn{Text: c, Type: typ})
+	}
+	for _, k := range keys {
+		t.Columns = append(t.Columns, grafanaColumn{Text: k, Type: "string"})
+	}
+	for _, row := range series {
+		for _, v := range row.Values {
+			r := append([]interface{}{}, v...)
+			for _, k := range keys {
+				r = append(r, row.Tags[k])
+			}
+			t.Rows = append(t.Rows, r)
+		}
+	}
+	return t
+}
+
+// grafanaAnnotationsHandler returns an annotation per point of the
+// measurement in the annotation query, "ns/measurement [where ...]"
+func (s *Service) grafanaAnnotationsHandler(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var body grafanaAnnotationReq
+	if err := decodeBody(req, &body); err != nil {
+		errResp(resp, http.StatusBadRequest, err.Error())
+		return
+	}
+	target, where := body.Annotation.Query, ""
+	if i := strings.Index(strings.ToLower(target), " where "); i > 0 {
+		target, where = target[:i], target[i+len(" where "):]
+	}
+	ns, measurement, _ := splitTarget(grafanaTarget{Target: strings.TrimSpace(target)})
+	if ns == "" || measurement == "" {
+		errResp(resp, http.StatusBadRequest, "annotation query should be ns/measurement")
+		return
+	}
+
+	influxdbs, err := loda.InfluxDBs(ns)
+	if err != nil {
+		errResp(resp, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(influxdbs) == 0 {
+		errResp(resp, 400, ns+" has no influxdb route config")
+		return
+	}
+
+	cond := fmt.Sprintf("time > %dms and time < %dms", body.Range.From.UnixNano()/1e6, body.Range.To.UnixNano()/1e6)
+	if where != "" {
+		cond = "(" + where + ") AND " + cond
+	}
+	q := fmt.Sprintf("SELECT * FROM %s WHERE %s", influxql.QuoteIdent(measurement), cond)
+	if err := checkGrafanaQuery(q); err != nil {
+		errResp(resp, http.StatusBadRequest, err.Error())
+		return
+	}
+	audit.FromContext(req.Context()).SetNS(ns, q)
+	rs, err := influx.Query(influxdbs, map[string]string{"db": ns, "q": q, "epoch": "ms"}, req.Header.Get("X-Real-IP"))
+	if err != nil {
+		errResp(resp, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	annotations := []grafanaAnnotation{}
+	for _, result := range rs.Results {
+		for _, serie := range result.Series {
+			for _, value := range serie.Values {
+				v, ok := value.([]interface{})
+				if !ok || len(v) == 0 {
+					continue
+				}
+				ts, ok := v[0].(float64)
+				if !ok {
+					continue
+				}
+				a := grafanaAnnotation{Annotation: body.Annotation, Time: int64(ts), Title: measurement}
+				var text []string
+				for i := 1; i < len(v) && i < len(serie.Columns); i++ {
+					if v[i] == nil {
+						continue
+					}
+					if str, ok := v[i].(string); ok && serie.Columns[i] != "value" {
+						a.Tags = append(a.Tags, serie.Columns[i]+"="+str)
+						continue
+					}
+					text = append(text, fmt.Sprintf("%s: %v", serie.Columns[i], v[i]))
+				}
+				a.Text = strings.Join(text, ", ")
+				annotations = append(annotations, a)
+			}
+		}
+	}
+	grafanaResp(resp, annotations)
+}
+
+// grafanaTagReqOf reads ns and measurement from the body, falling back to
+// the URL params, Grafana sends no target with ad hoc filter requests
+func grafanaTagReqOf(req *http.Request) (grafanaTagReq, error) {
+	var body grafanaTagReq
+	if err := decodeBody(req, &body); err != nil {
+		return body, err
+	}
+	if body.NS == "" {
+		body.NS = req.URL.Query().Get("ns")
+	}
+	if body.Measurement == "" {
+		body.Measurement = req.URL.Query().Get("measurement")
+	}
+	if body.NS == "" {
+		return body, fmt.Errorf("ns is empty")
+	}
+	return body, nil
+}
+
+func (s *Service) grafanaTagKeysHandler(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	body, err := grafanaTagReqOf(req)
+	if err != nil {
+		errResp(resp, http.StatusBadRequest, err.Error())
+		return
+	}
+	q := "show tag keys"
+	if body.Measurement != "" {
+		q = fmt.Sprintf("show tag keys from %s", influxql.QuoteIdent(body.Measurement))
+	}
+	if err := checkGrafanaQuery(q); err != nil {
+		errResp(resp, http.StatusBadRequest, err.Error())
+		return
+	}
+	audit.FromContext(req.Context()).SetNS(body.NS, q)
+	values, err := showValues(body.NS, q, 0)
+	if err != nil {
+		errResp(resp, http.StatusInternalServerError, err.Error())
+		return
+	}
+	keys := []grafanaText{}
+	for _, v := range values {
+		keys = append(keys, grafanaText{Type: "string", Text: v})
+	}
+	grafanaResp(resp, keys)
+}
+
+func (s *Service) grafanaTagValuesHandler(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	body, err := grafanaTagReqOf(req)
+	if err != nil {
+		errResp(resp, http.StatusBadRequest, err.Error())
+		return
+	}
+	if body.Key == "" {
+		errResp(resp, http.StatusBadRequest, "key is empty")
+		return
+	}
+	q := fmt.Sprintf("show tag values with key = %s", influxql.QuoteIdent(body.Key))
+	if body.Measurement != "" {
+		q = fmt.Sprintf("show tag values from %s with key = %s", influxql.QuoteIdent(body.Measurement), influxql.QuoteIdent(body.Key))
+	}
+	if err := checkGrafanaQuery(q); err != nil {
+		errResp(resp, http.StatusBadRequest, err.Error())
+		return
+	}
+	audit.FromContext(req.Context()).SetNS(body.NS, q)
+	values, err := showValues(body.NS, q, 1)
+	if err != nil {
+		errResp(resp, http.StatusInternalServerError, err.Error())
+		return
+	}
+	texts := []grafanaText{}
+	for _, v := range values {
+		texts = append(texts, grafanaText{Text: v})
+	}
+	grafanaResp(resp, texts)
+}
+
+// showValues returns the distinct strings of column col of a SHOW query
+func showValues(ns, q string, col int) ([]string, error) {
+	influxdbs, err := loda.InfluxDBs(ns)
+	if err != nil {
+		return nil, err
+	}
+	if len(influxdbs) == 0 {
+		return nil, fmt.Errorf("%s has no route config", ns)
+	}
+	rs, err := influx.Query(influxdbs, map[string]string{"db": ns, "q": q}, "")
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var values []string
+	for _, result := range rs.Results {
+		for _, serie := range result.Series {
+			for _, value := range serie.Values {
+				v, ok := value.([]interface{})
+				if !ok || len(v) <= col {
+					continue
+				}
+				str, ok := v[col].(string)
+				if !ok || seen[str] {
+					continue
+				}
+				seen[str] = true
+				values = append(values, str)
+			}
+		}
+	}
+	sort.Strings(values)
+	return values, nil
+}
@@ -0,0 +1,84 @@
+package query
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestGrafanaWhere(t *testing.T) {
+	tests := []struct {
+		where   string
+		filters []grafanaFilter
+		want    string
+	}{
+		{want: ""},
+		{where: `host = 'a' OR host = 'b'`, want: `(host = 'a' OR host = 'b')`},
+		{
+			where:   `host = 'a'`,
+			filters: []grafanaFilter{{Key: "dc", Operator: "=", Value: "x"}},
+			want:    `(host = 'a') AND dc = 'x'`,
+		},
+		{
+			filters: []grafanaFilter{{Key: `a"b`, Operator: "!=", Value: `it's \`}},
+			want:    `"a\"b" != 'it\'s \\'`,
+		},
+		{
+			filters: []grafanaFilter{{Key: "path", Operator: "=~", Value: "^/data/.*"}},
+			want:    `path =~ /^\/data\/.*/`,
+		},
+		{
+			filters: []grafanaFilter{{Key: "host", Operator: "drop", Value: "x"}},
+			want:    "",
+		},
+	}
+	for _, tt := range tests {
+		if got := grafanaWhere(tt.where, tt.filters); got != tt.want {
+			t.Errorf("grafanaWhere(%q, %v) = %s, want %s", tt.where, tt.filters, got, tt.want)
+		}
+	}
+}
+
+func TestGrafanaQueryInjection(t *testing.T) {
+	filters := [][]grafanaFilter{
+		{{Key: `host" = 'a'; DROP DATABASE x; SELECT "a`, Operator: "=", Value: "a"}},
+		{{Key: "host", Operator: "=", Value: `a'; DROP DATABASE x; SELECT '`}},
+		{{Key: "host", Operator: "=", Value: `a\'; DROP DATABASE x; SELECT '`}},
+		{{Key: "host", Operator: "=~", Value: `a/; DROP DATABASE x; SELECT /`}},
+		{{Key: "host", Operator: "=~", Value: `a\/; DROP DATABASE x; SELECT /`}},
+	}
+	for _, f := range filters {
+		where := grafanaWhere("", f)
+		q, err := NewQuery("cpu", "0", "60000", []string{"host"}, where, "mean", "null")
+		if err != nil {
+			t.Errorf("%v: %s", f, err)
+			continue
+		}
+		if err := checkGrafanaQuery(q); err != nil {
+			t.Errorf("%v: %s is rejected: %s", f, q, err)
+		}
+		query, _ := parseQuery(q)
+		if n := len(query.Statements); n != 1 {
+			t.Errorf("%v: %d statements in %s", f, n, q)
+		}
+	}
+
+	// a raw where is checked as a whole
+	for _, where := range []string{
+		`host = 'a'; DROP DATABASE x`,
+		`host = 'a') GROUP BY time(1m); SELECT * FROM mem WHERE (1 = 1`,
+		`host = 'a`,
+	} {
+		q := fmt.Sprintf("SELECT * FROM cpu WHERE (%s) AND time > 0ms", where)
+		if err := checkGrafanaQuery(q); err == nil {
+			t.Errorf("where %q is accepted", where)
+		}
+	}
+	for _, q := range []string{
+		"show tag keys from cpu",
+		`show tag values from "cpu idle" with key = "a\"b"`,
+	} {
+		if err := checkGrafanaQuery(q); err != nil {
+			t.Errorf("%s: %s", q, err)
+		}
+	}
+}
@@ -1,16 +1,25 @@
 package query
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"math"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/lodastack/router/audit"
 	"github.com/lodastack/router/config"
-	"github.com/lodastack/router/influx"
+	"github.com/lodastack/router/expr"
+	"github.com/lodastack/router/influxql"
 	"github.com/lodastack/router/loda"
+	"github.com/lodastack/router/migrate"
+	"github.com/lodastack/router/models"
+	"github.com/lodastack/router/worker"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/lodastack/log"
@@ -36,6 +45,49 @@ func (s *Service) listTagsHandler(resp http.ResponseWriter, req *http.Request, _
 		return
 	}
 
+	// key, prefix, regex, since and paging select a page of values
+	if isTagSearch(params) {
+		search := tagSearch{
+			key:    params.Get("key"),
+			prefix: params.Get("prefix"),
+			cursor: params.Get("cursor"),
+		}
+		if search.cursor != "" {
+			if _, _, err := decodeTagCursor(search.cursor); err != nil {
+				errResp(resp, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		if re := params.Get("regex"); re != "" {
+			if search.regex, err = regexp.Compile(re); err != nil {
+				errResp(resp, http.StatusBadRequest, "invalid regex: "+err.Error())
+				return
+			}
+		}
+		if since := params.Get("since"); since != "" {
+			if d, err := influxql.ParseDuration(since); err != nil || d <= 0 {
+				errResp(resp, http.StatusBadRequest, "invalid since "+since)
+				return
+			}
+			search.since = since
+		}
+		if search.limit, err = intParam(req, "limit", defaultTagLimit, 1, maxTagLimit); err != nil {
+			errResp(resp, http.StatusBadRequest, err.Error())
+			return
+		}
+		if search.offset, err = intParam(req, "offset", 0, 0, math.MaxInt32); err != nil {
+			errResp(resp, http.StatusBadRequest, err.Error())
+			return
+		}
+		page, err := searchTags(ns, mt, search)
+		if err != nil {
+			errResp(resp, http.StatusInternalServerError, err.Error())
+			return
+		}
+		succResp(resp, "OK", page)
+		return
+	}
+
 	tags, err := tags(ns, mt)
 	if err != nil {
 		errResp(resp, http.StatusInternalServerError, err.Error())
@@ -58,12 +110,8 @@ func (s *Service) removeTagsHandler(resp http.ResponseWriter, req *http.Request,
 		errResp(resp, http.StatusBadRequest, "You need params")
 		return
 	}
-	err = removeTags(ns, mt, tag, value)
-	if err != nil {
-		errResp(resp, http.StatusInternalServerError, err.Error())
-		return
-	}
-	succResp(resp, "OK", nil)
+	submitJob(resp, req, jobRequest{Kind: jobRemoveHost, NS: ns, Tag: tag, Value: value,
+		DryRun: params.Get("dryrun") == "true", Range: params.Get("range"), Confirm: params.Get("confirm")})
 }
 
 func (s *Service) listMeasurementHandler(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
@@ -113,34 +161,44 @@ func (s *Service) removeMeasurementHandler(resp http.ResponseWriter, req *http.R
 		return
 	}
 
-	var q string
-	q = fmt.Sprintf("drop measurement \"%s\"", name)
-	if regexp == "true" {
-		q = fmt.Sprintf("DELETE FROM /^%s/", name)
+	submitJob(resp, req, jobRequest{Kind: jobDropMeasurement, NS: ns, Measurement: name, Regexp: regexp == "true",
+		DryRun: params.Get("dryrun") == "true", Range: params.Get("range"), Confirm: params.Get("confirm")})
+}
+
+// writeHandler writes a JSON points batch through the same path as NSQ
+func (s *Service) writeHandler(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var points models.Points
+	if err := json.NewDecoder(req.Body).Decode(&points); err != nil {
+		errResp(resp, http.StatusBadRequest, "invalid points body: "+err.Error())
+		return
 	}
 
-	ps := map[string]string{"q": q, "db": ns}
+	ns := req.FormValue("ns")
+	if ns == "" {
+		ns = points.Database
+	}
+	if ns == "" {
+		errResp(resp, http.StatusBadRequest, "ns or database please")
+		return
+	}
+	if points.Database == "" {
+		points.Database = ns
+	}
 	influxdbs, err := loda.InfluxDBs(ns)
 	if err != nil {
 		errResp(resp, http.StatusInternalServerError, err.Error())
 		return
 	}
-
 	if len(influxdbs) == 0 {
-		errResp(resp, 400, ns+" has no influxdb route config")
+		errResp(resp, http.StatusBadRequest, ns+" has no influxdb route config")
 		return
 	}
 
-	rs, err := influx.QueryRaw(influxdbs, ps, req.Header.Get("X-Real-IP"))
-	if err != nil {
+	if err := worker.WritePoints(ns, points); err != nil {
 		errResp(resp, http.StatusInternalServerError, err.Error())
 		return
 	}
-
-	// just return the origin influxdb rs
-	resp.Header().Add("Content-Type", "application/json")
-	resp.WriteHeader(rs.Status)
-	resp.Write(rs.Body)
+	succResp(resp, "OK", len(points.Points))
 }
 
 func (s *Service) queryHandler(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
@@ -154,33 +212,32 @@ func (s *Service) queryHandler(resp http.ResponseWriter, req *http.Request, _ ht
 		errResp(resp, http.StatusBadRequest, err.Error())
 		return
 	}
-
-	if strings.Contains(strings.ToLower(params.Get("q")), "drop ") || strings.Contains(strings.ToLower(params.Get("q")), "delete ") {
-		errResp(resp, http.StatusBadRequest, "ah, Don't support drop")
+	format, err := responseFormat(req)
+	if err != nil {
+		errResp(resp, http.StatusBadRequest, err.Error())
 		return
 	}
+	// output params of the router
+	delete(params, "format")
+	delete(params, "time_format")
 
-	cluster := params.Get("cluster")
-	_ns := params.Get("db")
-
-	if len(_ns) == 0 {
-		_ns, err = parseDB(params.Get("q"))
-		if err != nil {
-			errResp(resp, http.StatusBadRequest, err.Error())
-			return
-		}
+	q, err := parseQuery(params.Get("q"))
+	if err != nil {
+		errResp(resp, http.StatusBadRequest, err.Error())
+		return
 	}
 
+	cluster := params.Get("cluster")
 	var ns string
+	var influxdbs []string
 	if len(cluster) > 0 {
 		ns = "_cluster_" + cluster
+		influxdbs, err = loda.InfluxDBs(ns)
 	} else {
-		ns = _ns
+		ns, influxdbs, err = routeQuery(q, params.Get("db"))
 	}
-
-	influxdbs, err := loda.InfluxDBs(ns)
 	if err != nil {
-		errResp(resp, http.StatusInternalServerError, err.Error())
+		errResp(resp, http.StatusBadRequest, err.Error())
 		return
 	}
 
@@ -191,30 +248,149 @@ func (s *Service) queryHandler(resp http.ResponseWriter, req *http.Request, _ ht
 
 	// remote cluster param
 	delete(params, "cluster")
+	rec := audit.FromContext(req.Context())
+	rec.SetNS(ns, params.Get("q"))
+
+	limits := queryLimits(req, ns)
+	if lerr := checkQuery(q, limits, time.Now()); lerr != nil {
+		limitErrResp(resp, lerr)
+		return
+	}
+
+	if params.Get("chunked") == "true" {
+		if migrate.Source(ns) != nil {
+			errResp(resp, http.StatusConflict, ns+" is migrated to another cluster, query it without chunked")
+			return
+		}
+		if format != formatJSON {
+			errResp(resp, http.StatusBadRequest, "chunked only supports json")
+			return
+		}
+		maxRows, err := maxRowsParam(params.Get("max_rows"))
+		if err != nil {
+			errResp(resp, http.StatusBadRequest, err.Error())
+			return
+		}
+		delete(params, "max_rows")
+		ctx, cancel := queryContext(req, "query", ns)
+		defer cancel()
+		streamQuery(ctx, resp, req, influxdbs, params, maxRows, limits)
+		return
+	}
+
+	cacheable := config.GetConfig().Cache.Enable
+	key := rawQueryKey(ns, params)
+	if cacheable {
+		if v, ok := s.c.Get(key).(rawResult); ok {
+			if lerr := checkRaw(v.body, limits); lerr != nil {
+				limitErrResp(resp, lerr)
+				return
+			}
+			if rec != nil {
+				_, points := rawRows(v.body)
+				rec.AddRows(points)
+			}
+			resp.Header().Set("X-Cache", "HIT")
+			writeRaw(resp, req, format, v.status, v.body, epochUnit(params.Get("epoch")))
+			return
+		}
+	}
 
-	status, rs, err := queryInfluxRaw(influxdbs, params, req.Header.Get("X-Real-IP"))
+	ctx, cancel := queryContext(req, "query", ns)
+	defer cancel()
+	status, rs, err := queryInfluxRaw(ctx, influxdbs, params, req.Header.Get("X-Real-IP"))
 	if err != nil {
-		errResp(resp, http.StatusInternalServerError, err.Error())
+		queryErrResp(resp, ctx, err)
+		return
+	}
+	if cacheable && status == http.StatusOK {
+		s.c.Set(key, rawResult{status: status, body: rs}, rawQueryTTL(q))
+	}
+	if lerr := checkRaw(rs, limits); lerr != nil {
+		limitErrResp(resp, lerr)
 		return
 	}
+	if rec != nil {
+		_, points := rawRows(rs)
+		rec.AddRows(points)
+	}
 
 	// just return the origin influxdb rs
-	resp.Header().Add("Content-Type", "application/json")
-	resp.WriteHeader(status)
-	resp.Write(rs)
+	writeRaw(resp, req, format, status, rs, epochUnit(params.Get("epoch")))
 }
 
-func parseDB(q string) (string, error) {
-	list := strings.Split(q, " ")
-	for _, str := range list {
-		if !strings.HasPrefix(str, "\""+config.GetConfig().Nsq.TopicPrefix+".") {
+// defaultAllowStatements keeps /query read only
+var defaultAllowStatements = []string{"SELECT", "SHOW", "EXPLAIN"}
+
+// parseQuery parses q and checks every statement is allowed
+func parseQuery(q string) (*influxql.Query, error) {
+	query, err := influxql.ParseQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	allowed := config.GetConfig().Query.AllowStatements
+	if len(allowed) == 0 {
+		allowed = defaultAllowStatements
+	}
+	for _, stmt := range query.Statements {
+		if s, ok := stmt.(*influxql.SelectStatement); ok && s.Into != nil {
+			return nil, fmt.Errorf("not support SELECT INTO")
+		}
+		if !statementAllowed(stmt.Kind(), allowed) {
+			return nil, fmt.Errorf("not support %s", stmt.Kind())
+		}
+	}
+	return query, nil
+}
+
+func statementAllowed(kind string, allowed []string) bool {
+	for _, prefix := range allowed {
+		prefix = strings.ToUpper(strings.TrimSpace(prefix))
+		if kind == prefix || strings.HasPrefix(kind, prefix+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+// routeQuery returns the namespace and influxdb hosts q is sent to, every
+// database q reads must be on the same hosts.
+func routeQuery(q *influxql.Query, db string) (string, []string, error) {
+	dbs := q.Databases(db)
+	if len(dbs) == 0 {
+		return "", nil, fmt.Errorf("can not found db from params q")
+	}
+	var influxdbs []string
+	for i, ns := range dbs {
+		hosts, err := loda.InfluxDBs(ns)
+		if err != nil {
+			return "", nil, err
+		}
+		if i == 0 {
+			influxdbs = hosts
 			continue
 		}
-		if dbIndex := strings.Index(str, "\"."); dbIndex != -1 {
-			return str[1:dbIndex], nil
+		if !sameHosts(influxdbs, hosts) {
+			return "", nil, fmt.Errorf("%s and %s are on different clusters", dbs[0], ns)
 		}
 	}
-	return "", fmt.Errorf("can not found db from params q")
+	return dbs[0], influxdbs, nil
+}
+
+func sameHosts(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[string]bool, len(a))
+	for _, h := range a {
+		set[h] = true
+	}
+	for _, h := range b {
+		if !set[h] {
+			return false
+		}
+	}
+	return true
 }
 
 func (s *Service) query2Handler(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
@@ -230,11 +406,38 @@ func (s *Service) query2Handler(resp http.ResponseWriter, req *http.Request, _ h
 	measurement := req.FormValue("measurement")
 	fn := req.FormValue("fn")
 	fill := req.FormValue("fill")
+	exprStr := req.FormValue("expr")
 
-	if len(ns) == 0 || len(starttime) == 0 || len(endtime) == 0 || len(measurement) == 0 {
+	if len(ns) == 0 || len(starttime) == 0 || len(endtime) == 0 || (len(measurement) == 0 && len(exprStr) == 0) {
 		errResp(resp, http.StatusBadRequest, "need params")
 		return
 	}
+	format, err := responseFormat(req)
+	if err != nil {
+		errResp(resp, http.StatusBadRequest, err.Error())
+		return
+	}
+	method, dsPoints, err := downsampleParams(req)
+	if err != nil {
+		errResp(resp, http.StatusBadRequest, err.Error())
+		return
+	}
+	if method != "" && (fill == "" || fill == "null") {
+		// empty buckets would be reduced as zeros
+		fill = "none"
+	}
+	shifts, err := compareParam(req)
+	if err != nil {
+		errResp(resp, http.StatusBadRequest, err.Error())
+		return
+	}
+	var e expr.Node
+	if exprStr != "" {
+		if e, err = expr.Parse(exprStr); err != nil {
+			errResp(resp, http.StatusBadRequest, "invalid expr: "+err.Error())
+			return
+		}
+	}
 
 	influxdbs, err := loda.InfluxDBs(ns)
 	if err != nil {
@@ -247,6 +450,15 @@ func (s *Service) query2Handler(resp http.ResponseWriter, req *http.Request, _ h
 		return
 	}
 
+	if e != nil {
+		s.query2Expr(resp, req, e, exprStr, format, exprParams{
+			ns: ns, influxdbs: influxdbs, start: starttime, end: endtime,
+			where: where, fn: fn, fill: fill, ip: req.Header.Get("X-Real-IP"),
+			downsample: method, points: dsPoints, shifts: shifts,
+		})
+		return
+	}
+
 	tags, err := tags(ns, measurement)
 	if err != nil {
 		errResp(resp, 500, ns+" get tags failed: "+err.Error())
@@ -264,12 +476,47 @@ func (s *Service) query2Handler(resp http.ResponseWriter, req *http.Request, _ h
 		tagkeys = append(tagkeys, tagkey)
 	}
 
-	query, err := NewQuery(measurement, starttime, endtime, tagkeys, where, fn, fill)
+	// aligned ranges let overlapping refreshes share the cached result
+	starttime, endtime = alignRange(starttime, endtime)
+	interval := defaultInterval(starttime, endtime)
+	if method != "" {
+		// fetch a finer resolution and reduce it here
+		if interval, err = downsampleInterval(starttime, endtime, dsPoints); err != nil {
+			errResp(resp, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	query, err := newIntervalQuery(measurement, starttime, endtime, interval, tagkeys, where, fn, fill)
 	if err != nil {
-		errResp(resp, 500, ns+" new query failed: "+err.Error())
+		errResp(resp, http.StatusBadRequest, ns+" new query failed: "+err.Error())
 		return
 	}
 
+	rec := audit.FromContext(req.Context())
+	rec.SetNS(ns, query)
+
+	cacheable := config.GetConfig().Cache.Enable
+	key := "query2|" + ns + "|" + query
+	if method != "" {
+		key += "|" + method + "|" + strconv.Itoa(dsPoints)
+	}
+	if len(shifts) > 0 {
+		key += "|compare=" + req.FormValue("compare")
+	}
+	if cacheable {
+		if rs, ok := s.c.Get(key).(Results); ok {
+			if lerr := checkResults(rs, queryLimits(req, ns)); lerr != nil {
+				limitErrResp(resp, lerr)
+				return
+			}
+			_, points := resultsRows(rs)
+			rec.AddRows(points)
+			resp.Header().Set("X-Cache", "HIT")
+			writeResults(resp, req, format, rs, time.Second)
+			return
+		}
+	}
+
 	p := url.Values{}
 	p.Set("q", query)
 	p.Set("db", ns)
@@ -277,22 +524,107 @@ func (s *Service) query2Handler(resp http.ResponseWriter, req *http.Request, _ h
 	p.Set("pretty", "true")
 
 	req.URL.RawQuery = p.Encode()
-	status, rs, err := queryInfluxDB(influxdbs, p, req.Header.Get("X-Real-IP"), true)
+	ctx, cancel := queryContext(req, "query2", ns)
+	defer cancel()
+	status, rs, err := queryInfluxDB(ctx, influxdbs, p, req.Header.Get("X-Real-IP"), true)
 	if err != nil {
-		errResp(resp, http.StatusInternalServerError, err.Error())
+		queryErrResp(resp, ctx, err)
+		return
+	}
+	if len(shifts) > 0 {
+		rs, err = compareResults(ctx, rs, shifts, interval, starttime, endtime, func(ctx context.Context, st, et string) (Results, error) {
+			q, err := newIntervalQuery(measurement, st, et, interval, tagkeys, where, fn, fill)
+			if err != nil {
+				return Results{}, err
+			}
+			sp := url.Values{}
+			sp.Set("q", q)
+			sp.Set("db", ns)
+			sp.Set("epoch", "s")
+			_, srs, err := queryInfluxDB(ctx, influxdbs, sp, req.Header.Get("X-Real-IP"), true)
+			return srs, err
+		})
+		if err != nil {
+			queryErrResp(resp, ctx, err)
+			return
+		}
+	}
+	if method != "" {
+		rs = downsampleResults(rs, method, dsPoints)
+	}
+	if cacheable && status == http.StatusOK {
+		var end time.Time
+		if et, err := strconv.ParseInt(endtime, 10, 64); err == nil {
+			end = time.Unix(0, et*int64(time.Millisecond))
+		}
+		s.c.Set(key, rs, resultTTL(end))
+	}
+	if lerr := checkResults(rs, queryLimits(req, ns)); lerr != nil {
+		limitErrResp(resp, lerr)
 		return
 	}
+	_, points := resultsRows(rs)
+	rec.AddRows(points)
 
-	// just return the origin influxdb rs
-	resp.Header().Add("Content-Type", "application/json")
-	succResp(resp, "OK", rs)
-	resp.WriteHeader(status)
+	writeResults(resp, req, format, rs, time.Second)
 }
 
 func (s *Service) statsHandler(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	succResp(resp, "OK", map[string]interface{}{
+		"cache": s.c.Stats(),
+	})
+}
+
+// purgeCacheHandler drops all cached results
+func (s *Service) purgeCacheHandler(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	s.c.Purge()
 	succResp(resp, "OK", nil)
 }
 
+// auditHandler searches the recent audit records
+func (s *Service) auditHandler(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	f := audit.Filter{
+		NS:       req.FormValue("ns"),
+		Endpoint: req.FormValue("endpoint"),
+		IP:       req.FormValue("ip"),
+		User:     req.FormValue("user"),
+		Host:     req.FormValue("host"),
+		Query:    req.FormValue("q"),
+		Slow:     req.FormValue("slow") == "true",
+		Limit:    100,
+	}
+	if v := req.FormValue("min_duration"); v != "" {
+		d, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			errResp(resp, http.StatusBadRequest, "invalid min_duration")
+			return
+		}
+		f.MinDuration = d
+	}
+	if v := req.FormValue("since"); v != "" {
+		ts, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			errResp(resp, http.StatusBadRequest, "invalid since")
+			return
+		}
+		f.Since = time.Unix(ts, 0)
+	}
+	if v := req.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			errResp(resp, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		f.Limit = n
+	}
+	succResp(resp, "OK", audit.Search(f))
+}
+
+// clockSkewHandler lists agents which sent points outside the timestamp window
+func (s *Service) clockSkewHandler(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	succResp(resp, "OK", worker.SkewedHosts())
+}
+
 func (s *Service) saHandler(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 	starttime := req.FormValue("starttime")
 	endtime := req.FormValue("endtime")
@@ -403,7 +735,7 @@ func (s *Service) sa(ns string, starttime string, endtime string) (map[string]fl
 			p.Set("pretty", "true")
 
 			p.Encode()
-			_, rs, err := queryInfluxDB(influxdbs, p, "", false)
+			_, rs, err := queryInfluxDB(context.Background(), influxdbs, p, "", false)
 			if err != nil {
 				log.Errorf(err.Error())
 				continue
@@ -420,7 +752,7 @@ func (s *Service) sa(ns string, starttime string, endtime string) (map[string]fl
 			log.Debugf("failed conut: %v", failedCount)
 		}
 	}
-	s.c.Set(ns+starttime+endtime, m)
+	s.c.Set(ns+starttime+endtime, m, saCacheTTL)
 	return m, nil
 }
 
@@ -467,6 +799,11 @@ func (s *Service) usageHandler(resp http.ResponseWriter, req *http.Request, _ ht
 		errResp(resp, http.StatusBadRequest, "need params")
 		return
 	}
+	format, err := responseFormat(req)
+	if err != nil {
+		errResp(resp, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	influxdbs, err := loda.InfluxDBs(ns)
 	if err != nil {
@@ -501,10 +838,12 @@ func (s *Service) usageHandler(resp http.ResponseWriter, req *http.Request, _ ht
 	}
 	query, err := NewUsageQuery(measurement, fn, period, duration, starttime, endtime, groupByList)
 	if err != nil {
-		errResp(resp, 500, ns+" new query failed: "+err.Error())
+		errResp(resp, http.StatusBadRequest, ns+" new query failed: "+err.Error())
 		return
 	}
 	log.Errorf("[usage] query: %s", query)
+	rec := audit.FromContext(req.Context())
+	rec.SetNS(ns, query)
 	p := url.Values{}
 	p.Set("q", query)
 	p.Set("db", ns)
@@ -512,16 +851,21 @@ func (s *Service) usageHandler(resp http.ResponseWriter, req *http.Request, _ ht
 	p.Set("pretty", "true")
 
 	req.URL.RawQuery = p.Encode()
-	status, rs, err := queryInfluxDB(influxdbs, p, req.Header.Get("X-Real-IP"), true)
+	ctx, cancel := queryContext(req, "usage", ns)
+	defer cancel()
+	_, rs, err := queryInfluxDB(ctx, influxdbs, p, req.Header.Get("X-Real-IP"), true)
 	if err != nil {
-		errResp(resp, http.StatusInternalServerError, err.Error())
+		queryErrResp(resp, ctx, err)
+		return
+	}
+	if lerr := checkResults(rs, queryLimits(req, ns)); lerr != nil {
+		limitErrResp(resp, lerr)
 		return
 	}
+	_, points := resultsRows(rs)
+	rec.AddRows(points)
 
-	// just return the origin influxdb rs
-	resp.Header().Add("Content-Type", "application/json")
-	succResp(resp, "OK", rs)
-	resp.WriteHeader(status)
+	writeResults(resp, req, format, rs, time.Second)
 }
 
 func (s *Service) linkstatsHandler(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
@@ -670,7 +1014,7 @@ func latest(influxdbs []string, ns, measurement, source, target string) (float64
 	p.Set("pretty", "true")
 
 	p.Encode()
-	_, rs, err := queryInfluxDB(influxdbs, p, "", false)
+	_, rs, err := queryInfluxDB(context.Background(), influxdbs, p, "", false)
 	if err != nil {
 		log.Errorf(err.Error())
 		return 0, err
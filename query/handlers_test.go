@@ -0,0 +1,26 @@
+package query
+
+import "testing"
+
+func TestParseQueryAllowed(t *testing.T) {
+	tests := []struct {
+		q  string
+		ok bool
+	}{
+		{q: `SELECT * FROM cpu`, ok: true},
+		{q: `SHOW TAG KEYS FROM cpu`, ok: true},
+		{q: `EXPLAIN SELECT * FROM cpu`, ok: true},
+		{q: `SELECT * FROM cpu; SHOW MEASUREMENTS`, ok: true},
+		{q: `SELECT * INTO cpu_copy FROM cpu`},
+		{q: `SELECT * FROM cpu; SELECT * INTO cpu_copy FROM cpu`},
+		{q: `DROP MEASUREMENT cpu`},
+		{q: `SELECT * FROM cpu; DROP DATABASE x`},
+		{q: `DELETE FROM cpu`},
+		{q: `SELECT * FROM cpu WHERE host = 'a`},
+	}
+	for _, tt := range tests {
+		if _, err := parseQuery(tt.q); (err == nil) != tt.ok {
+			t.Errorf("parseQuery(%q) error %v, want ok %v", tt.q, err, tt.ok)
+		}
+	}
+}
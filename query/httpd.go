@@ -2,6 +2,7 @@ package query
 
 import (
 	"compress/gzip"
+	"crypto/subtle"
 	"fmt"
 	"io"
 	"net"
@@ -11,6 +12,9 @@ import (
 	"sync"
 	"time"
 
+	"github.com/lodastack/router/audit"
+	"github.com/lodastack/router/config"
+
 	"github.com/julienschmidt/httprouter"
 	"github.com/lodastack/log"
 )
@@ -125,26 +129,117 @@ func cors(inner http.Handler) http.Handler {
 	})
 }
 
+// adminOnly checks the admin token of the request, admin routes are
+// refused while no token is configured
+func adminOnly(inner httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if config.GetConfig().Admin.Token == "" {
+			errResp(w, http.StatusForbidden, "admin API disabled, no admin token configured")
+			return
+		}
+		if !isAdmin(r) {
+			errResp(w, http.StatusForbidden, "admin token required")
+			return
+		}
+		inner(w, r, ps)
+	}
+}
+
+// audited records the requests of endpoint in the audit log
+func audited(endpoint string, inner httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if !audit.Enabled() {
+			inner(w, r, ps)
+			return
+		}
+		rec := &audit.Record{
+			Time:     time.Now(),
+			IP:       clientIP(r),
+			User:     r.Header.Get("X-User"),
+			Token:    audit.MaskToken(r.Header.Get("AuthToken")),
+			Endpoint: endpoint,
+		}
+		if isAdmin(r) {
+			rec.User = "admin"
+		}
+		rw := newResponseWriter(w)
+		inner(rw, r.WithContext(audit.NewContext(r.Context(), rec)), ps)
+		audit.Finish(rec, rw.statusCode)
+	}
+}
+
+// clientIP is the X-Real-IP set by the proxy, or the remote address
+func clientIP(r *http.Request) string {
+	if ip := r.Header.Get("X-Real-IP"); ip != "" {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// isAdmin reports whether the request carries the configured admin token
+func isAdmin(r *http.Request) bool {
+	token := config.GetConfig().Admin.Token
+	return token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("AuthToken")), []byte(token)) == 1
+}
+
 func (s *Service) initHandler() {
 	s.router.GET("/ping", s.servePing)
 	s.router.GET("/stats", s.statsHandler)
+	s.router.GET("/clockskew", s.clockSkewHandler)
+	s.router.DELETE("/cache", adminOnly(s.purgeCacheHandler))
+	s.router.GET("/audit", adminOnly(s.auditHandler))
 
 	s.router.GET("/measurement", s.listMeasurementHandler)
-	s.router.DELETE("/measurement", s.removeMeasurementHandler)
+	s.router.DELETE("/measurement", adminOnly(s.removeMeasurementHandler))
+	s.router.GET("/catalog", s.catalogHandler)
+	s.router.PUT("/catalog", adminOnly(s.putCatalogHandler))
+	s.router.DELETE("/catalog", adminOnly(s.removeCatalogHandler))
+	s.router.PUT("/catalog/category", adminOnly(s.putCategoryHandler))
+	s.router.GET("/jobs", s.listJobsHandler)
+	s.router.POST("/jobs", adminOnly(s.submitJobHandler))
+	s.router.GET("/jobs/:id", s.getJobHandler)
+	s.router.DELETE("/jobs/:id", adminOnly(s.cancelJobHandler))
+	s.router.GET("/migrations", s.listMigrationsHandler)
+	s.router.POST("/migrations", adminOnly(s.startMigrationHandler))
+	s.router.GET("/migrations/:ns", s.getMigrationHandler)
+	s.router.DELETE("/migrations/:ns", adminOnly(s.cancelMigrationHandler))
+	s.router.POST("/migrations/:ns/resume", adminOnly(s.resumeMigrationHandler))
 	s.router.GET("/tags", s.listTagsHandler)
-	s.router.DELETE("/tags", s.removeTagsHandler)
+	s.router.DELETE("/tags", adminOnly(s.removeTagsHandler))
+
+	// ingest points, same as the NSQ consumers
+	s.router.POST("/write", adminOnly(s.writeHandler))
+	// namespace dumps in line protocol
+	s.router.GET("/export", adminOnly(audited("export", s.exportHandler)))
+	s.router.POST("/import", adminOnly(audited("import", s.importHandler)))
 
 	// origin influxdb http api
-	s.router.GET("/query", s.queryHandler)
-	s.router.POST("/query", s.queryHandler)
+	s.router.GET("/query", audited("query", s.queryHandler))
+	s.router.POST("/query", audited("query", s.queryHandler))
 	// only return about 1500 points every request
-	s.router.GET("/query2", s.query2Handler)
-	s.router.POST("/query2", s.query2Handler)
+	s.router.GET("/query2", audited("query2", s.query2Handler))
+	s.router.POST("/query2", audited("query2", s.query2Handler))
+	// one query template against many namespaces
+	s.router.GET("/federate", audited("federate", s.federateHandler))
+	s.router.POST("/federate", audited("federate", s.federateHandler))
+
+	// grafana simple JSON datasource
+	s.router.GET("/grafana/", s.grafanaTestHandler)
+	s.router.POST("/grafana/search", s.grafanaSearchHandler)
+	s.router.POST("/grafana/query", audited("grafana", s.grafanaQueryHandler))
+	s.router.POST("/grafana/annotations", audited("grafana", s.grafanaAnnotationsHandler))
+	s.router.POST("/grafana/tag-keys", audited("grafana", s.grafanaTagKeysHandler))
+	s.router.POST("/grafana/tag-values", audited("grafana", s.grafanaTagValuesHandler))
 
 	// custom API
 	s.router.GET("/custom/sa", s.saHandler)
 	s.router.GET("/custom/sa2", s.sa2Handler)
-	s.router.GET("/custom/usage", s.usageHandler)
+	s.router.GET("/custom/usage", audited("usage", s.usageHandler))
+	s.router.GET("/custom/topn", audited("topn", s.topnHandler))
+	s.router.GET("/custom/distribution", audited("distribution", s.distributionHandler))
 	s.router.GET("/custom/linkstats", s.linkstatsHandler)
 }
 
@@ -163,7 +258,7 @@ type Service struct {
 func New(listen string) (*Service, error) {
 	return &Service{
 		addr:   listen,
-		c:      NewCache(),
+		c:      NewCache(config.GetConfig().Cache.Size),
 		router: httprouter.New(),
 	}, nil
 }
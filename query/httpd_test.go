@@ -0,0 +1,43 @@
+package query
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lodastack/router/config"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestAdminOnly(t *testing.T) {
+	tests := []struct {
+		token  string
+		sent   string
+		status int
+	}{
+		// no token configured, the admin API is closed
+		{token: "", sent: "", status: http.StatusForbidden},
+		{token: "", sent: "x", status: http.StatusForbidden},
+		{token: "secret", sent: "", status: http.StatusForbidden},
+		{token: "secret", sent: "secre", status: http.StatusForbidden},
+		{token: "secret", sent: "secret", status: http.StatusOK},
+	}
+	c := config.GetConfig()
+	defer func() { c.Admin.Token = "" }()
+	h := adminOnly(func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		w.WriteHeader(http.StatusOK)
+	})
+	for _, tt := range tests {
+		c.Admin.Token = tt.token
+		req := httptest.NewRequest("DELETE", "/jobs/1", nil)
+		if tt.sent != "" {
+			req.Header.Set("AuthToken", tt.sent)
+		}
+		w := httptest.NewRecorder()
+		h(w, req, nil)
+		if w.Code != tt.status {
+			t.Errorf("token %q, sent %q: status %d, want %d", tt.token, tt.sent, w.Code, tt.status)
+		}
+	}
+}
@@ -1,29 +1,79 @@
 package query
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/grafana/grafana/pkg/tsdb"
 	"github.com/lodastack/log"
+	"github.com/lodastack/router/catalog"
 	"github.com/lodastack/router/influx"
 	"github.com/lodastack/router/loda"
+	"github.com/lodastack/router/migrate"
 )
 
 // NewQuery only return about 1500 points
 func NewQuery(measurement string, start string, end string, tags []string, where string, fn string, fill string) (string, error) {
+	return newIntervalQuery(measurement, start, end, defaultInterval(start, end), tags, where, fn, fill)
+}
+
+// defaultInterval is the GROUP BY interval of NewQuery
+func defaultInterval(start, end string) string {
+	return tsdb.CalculateInterval(tsdb.NewTimeRange(start, end))
+}
+
+// aggregations fn may name, pNN is percentile NN
+var validFns = map[string]bool{
+	"mean": true, "median": true, "mode": true, "max": true, "min": true,
+	"sum": true, "count": true, "first": true, "last": true, "spread": true,
+	"stddev": true,
+}
+
+var percentileFn = regexp.MustCompile(`^p([0-9]{1,2}(\.[0-9]+)?|100)$`)
 
-	tr := tsdb.NewTimeRange(start, end)
-	interval := tsdb.CalculateInterval(tr)
+// validFn returns the InfluxQL call of fn on "value"
+func validFn(fn string) (string, error) {
+	if validFns[fn] {
+		return fn + "(\"value\")", nil
+	}
+	if percentileFn.MatchString(fn) {
+		return "percentile(\"value\", " + fn[1:] + ")", nil
+	}
+	return "", fmt.Errorf("not support fn %s", fn)
+}
+
+// validFill checks fill is an InfluxQL fill option
+func validFill(fill string) error {
+	switch fill {
+	case "null", "none", "previous", "linear":
+		return nil
+	}
+	if _, err := strconv.ParseFloat(fill, 64); err != nil {
+		return fmt.Errorf("not support fill %s", fill)
+	}
+	return nil
+}
 
+// newIntervalQuery is NewQuery grouped by the given interval
+func newIntervalQuery(measurement, start, end, interval string, tags []string, where, fn, fill string) (string, error) {
 	if fn == "" {
 		fn = "mean"
 	}
 	if fill == "" {
 		fill = "null"
 	}
+	call, err := validFn(fn)
+	if err != nil {
+		return "", err
+	}
+	if err := validFill(fill); err != nil {
+		return "", err
+	}
 
 	var filterTags []string
 	for _, tagkey := range tags {
@@ -32,17 +82,17 @@ func NewQuery(measurement string, start string, end string, tags []string, where
 		}
 	}
 
-	rawQuery := fmt.Sprintf("SELECT %s(\"value\") FROM \"%s\" WHERE time > %sms and time < %sms GROUP BY time(%s) fill(%s)",
-		fn, measurement, start, end, interval, fill)
+	rawQuery := fmt.Sprintf("SELECT %s FROM \"%s\" WHERE time > %sms and time < %sms GROUP BY time(%s) fill(%s)",
+		call, measurement, start, end, interval, fill)
 	// display hostname if fn in (max, min, medium)
 	if fn == "max" || fn == "min" || fn == "medium" {
-		rawQuery = fmt.Sprintf("SELECT %s(\"value\"),\"host\" FROM \"%s\" WHERE time > %sms and time < %sms GROUP BY time(%s) fill(%s)",
-			fn, measurement, start, end, interval, fill)
+		rawQuery = fmt.Sprintf("SELECT %s,\"host\" FROM \"%s\" WHERE time > %sms and time < %sms GROUP BY time(%s) fill(%s)",
+			call, measurement, start, end, interval, fill)
 	}
 
 	if where != "" {
-		rawQuery = fmt.Sprintf("SELECT %s(\"value\") FROM \"%s\" WHERE %s AND time > %sms and time < %sms GROUP BY time(%s), %s fill(%s)",
-			fn, measurement, where, start, end, interval, strings.Join(filterTags, ","), fill)
+		rawQuery = fmt.Sprintf("SELECT %s FROM \"%s\" WHERE %s AND time > %sms and time < %sms GROUP BY time(%s), %s fill(%s)",
+			call, measurement, where, start, end, interval, strings.Join(filterTags, ","), fill)
 	}
 	return rawQuery, nil
 }
@@ -50,13 +100,17 @@ func NewQuery(measurement string, start string, end string, tags []string, where
 // NewUsageQuery is customer API for customer system
 func NewUsageQuery(measurement, fn, period, duration, stime, etime string, groupby []string) (string, error) {
 	//select max("value") from "cpu.idle" where time> now() - 1d group by "host","tag",time(1h);
+	call, err := validFn(fn)
+	if err != nil {
+		return "", err
+	}
 	groupBy := "\"host\""
 	for _, tag := range groupby {
 		groupBy = groupBy + ",\"" + tag + "\""
 	}
 
-	rawQuery := fmt.Sprintf("SELECT %s(\"value\") FROM \"%s\" WHERE time > %sms and time < %sms GROUP BY %s,time(%s)",
-		fn, measurement, stime, etime, groupBy, duration)
+	rawQuery := fmt.Sprintf("SELECT %s FROM \"%s\" WHERE time > %sms and time < %sms GROUP BY %s,time(%s)",
+		call, measurement, stime, etime, groupBy, duration)
 	return rawQuery, nil
 }
 
@@ -70,6 +124,23 @@ func tags(ns, mt string) (map[string][]interface{}, error) {
 		return nil, fmt.Errorf("%s has no route config", ns)
 	}
 
+	tagsMap, err := hostTags(influxdbs, ns, mt)
+	if err != nil {
+		return nil, err
+	}
+	// the history of a migrated ns is still on its old cluster
+	if src := migrate.Source(ns); src != nil {
+		old, err := hostTags(src, ns, mt)
+		if err != nil {
+			log.Warningf("query tags of %s on migration source %v failed: %s", ns, src, err)
+		}
+		tagsMap = mergeTags(tagsMap, old)
+	}
+	return tagsMap, nil
+}
+
+// hostTags returns the tag values of mt on the cluster influxdbs
+func hostTags(influxdbs []string, ns, mt string) (map[string][]interface{}, error) {
 	rs, err := influx.Query(influxdbs, map[string]string{
 		"db": ns,
 		"q":  fmt.Sprintf("show tag keys from \"%s\"", mt),
@@ -141,60 +212,32 @@ func tags(ns, mt string) (map[string][]interface{}, error) {
 	return tagsMap, nil
 }
 
-func removeTags(ns string, mt string, tag string, tagvalue string) error {
-	if tag != "host" {
-		return nil
-	}
-
+func getMeasurementsFromInfluxDB(ns string) ([]interface{}, error) {
 	influxdbs, err := loda.InfluxDBs(ns)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if len(influxdbs) == 0 {
-		return fmt.Errorf("%s has no route config", ns)
+		return nil, fmt.Errorf("%s has no route config", ns)
 	}
 
-	values, err := getMeasurementsFromInfluxDB(ns)
+	values, err := hostMeasurements(influxdbs, ns)
 	if err != nil {
-		return err
-	}
-
-	if len(values) == 0 {
-		return nil
+		return nil, err
 	}
-
-	for _, value := range values {
-		v, ok := value.([]interface{})
-		if !ok || len(v) == 0 {
-			continue
-		}
-		mName, ok := v[0].(string)
-		if !ok {
-			continue
-		}
-
-		_, err = influx.Query(influxdbs, map[string]string{
-			"db": ns,
-			"q":  fmt.Sprintf("DELETE FROM \"%s\" WHERE \"%s\" = '%s'", mName, tag, tagvalue),
-		}, "")
+	if src := migrate.Source(ns); src != nil {
+		old, err := hostMeasurements(src, ns)
 		if err != nil {
-			return err
+			log.Warningf("query measurements of %s on migration source %v failed: %s", ns, src, err)
 		}
+		values = mergeMeasurements(values, old)
 	}
-	return nil
+	return values, nil
 }
 
-func getMeasurementsFromInfluxDB(ns string) ([]interface{}, error) {
-	influxdbs, err := loda.InfluxDBs(ns)
-	if err != nil {
-		return nil, err
-	}
-
-	if len(influxdbs) == 0 {
-		return nil, fmt.Errorf("%s has no route config", ns)
-	}
-
+// hostMeasurements lists the measurements of ns on the cluster influxdbs
+func hostMeasurements(influxdbs []string, ns string) ([]interface{}, error) {
 	rs, err := influx.Query(influxdbs, map[string]string{
 		"db": ns,
 		"q":  "show measurements",
@@ -215,7 +258,7 @@ func getMeasurementsFromInfluxDB(ns string) ([]interface{}, error) {
 	return rs.Results[0].Series[0].Values, nil
 }
 
-func measurements(ns string) (map[string]map[string]Detail, error) {
+func measurements(ns string) (map[string]map[string]catalog.Detail, error) {
 	values, err := getMeasurementsFromInfluxDB(ns)
 	if err != nil {
 		return nil, err
@@ -231,7 +274,7 @@ func measurements(ns string) (map[string]map[string]Detail, error) {
 		log.Error(err)
 	}
 
-	mNames := make(map[string]map[string]Detail)
+	mNames := make(map[string]map[string]catalog.Detail)
 	for _, value := range values {
 		v, ok := value.([]interface{})
 		if !ok || len(v) == 0 {
@@ -250,13 +293,11 @@ func measurements(ns string) (map[string]map[string]Detail, error) {
 			continue
 		}
 
-		mNameParts := strings.Split(mName, ".")
-		key := transKey(mNameParts[0])
-		d := MeasurementDetail(mName)
-		if _, ok := mNames[key]; !ok {
-			mNames[key] = make(map[string]Detail)
+		d := catalog.Lookup(mName, ms)
+		if _, ok := mNames[d.Category]; !ok {
+			mNames[d.Category] = make(map[string]catalog.Detail)
 		}
-		mNames[key][mName] = d
+		mNames[d.Category][mName] = d
 	}
 	return mNames, nil
 }
@@ -276,7 +317,7 @@ func existInRegistry(metricName string, ms []loda.CollectMetric) bool {
 	return false
 }
 
-func queryInfluxRaw(influxdbs []string, params map[string][]string, ip string) (int, []byte, error) {
+func queryInfluxRaw(ctx context.Context, influxdbs []string, params map[string][]string, ip string) (int, []byte, error) {
 	queryParams := make(map[string]string)
 	for k, v := range params {
 		if len(v) == 0 {
@@ -285,11 +326,37 @@ func queryInfluxRaw(influxdbs []string, params map[string][]string, ip string) (
 		queryParams[k] = v[0]
 	}
 
-	response, err := influx.QueryRaw(influxdbs, queryParams, ip)
+	// the history of a migrated ns is still on its old cluster
+	var old chan []byte
+	if src := migrate.Source(queryParams["db"]); src != nil {
+		old = make(chan []byte, 1)
+		go func() {
+			rs, err := influx.QueryRaw(ctx, src, queryParams, ip)
+			if err != nil {
+				log.Warningf("query migration source %v failed: %s", src, err)
+				old <- nil
+				return
+			}
+			old <- rs.Body
+		}()
+	}
+
+	response, err := influx.QueryRaw(ctx, influxdbs, queryParams, ip)
 	if err != nil {
 		return 0, nil, err
 	}
-	return response.Status, response.Body, nil
+	body := response.Body
+	if old != nil {
+		if ob := <-old; ob != nil {
+			merged, err := mergeRaw(body, ob, queryParams["q"])
+			if err != nil {
+				log.Warningf("merge migration source response failed: %s", err)
+			} else {
+				body = merged
+			}
+		}
+	}
+	return response.Status, body, nil
 }
 
 // Results struct
@@ -302,6 +369,7 @@ type Results struct {
 type Result struct {
 	Series   []Row
 	Messages []*Message
+	Error    string `json:"error,omitempty"`
 	Err      error
 }
 
@@ -320,8 +388,7 @@ type Row struct {
 	Data    [][]interface{}   `json:"data,omitempty"`
 }
 
-func queryInfluxDB(influxdbs []string, params map[string][]string, ip string, needParse bool) (int, Results, error) {
-	var response Results
+func queryInfluxDB(ctx context.Context, influxdbs []string, params map[string][]string, ip string, needParse bool) (int, Results, error) {
 	queryParams := make(map[string]string)
 	for k, v := range params {
 		if len(v) == 0 {
@@ -329,7 +396,39 @@ func queryInfluxDB(influxdbs []string, params map[string][]string, ip string, ne
 		}
 		queryParams[k] = v[0]
 	}
-	resp, err := httpDo(influxdbs, queryParams, ip)
+
+	// the history of a migrated ns is still on its old cluster
+	var old chan Results
+	if src := migrate.Source(queryParams["db"]); src != nil {
+		old = make(chan Results, 1)
+		go func() {
+			_, rs, err := decodeQuery(ctx, src, queryParams, ip)
+			if err != nil {
+				log.Warningf("query migration source %v failed: %s", src, err)
+			}
+			old <- rs
+		}()
+	}
+
+	status, response, err := decodeQuery(ctx, influxdbs, queryParams, ip)
+	if err != nil {
+		return status, response, err
+	}
+	if old != nil {
+		response = mergeResults(response, <-old, queryParams["q"])
+	}
+
+	if needParse {
+		res := parse(&response)
+		return status, *res, nil
+	}
+
+	return status, response, nil
+}
+
+func decodeQuery(ctx context.Context, influxdbs []string, queryParams map[string]string, ip string) (int, Results, error) {
+	var response Results
+	resp, err := httpDo(ctx, influxdbs, queryParams, ip)
 	if err != nil {
 		return 500, response, err
 	}
@@ -346,26 +445,11 @@ func queryInfluxDB(influxdbs []string, params map[string][]string, ip string, ne
 	if response.Err != nil {
 		return 500, response, response.Err
 	}
-
-	if needParse {
-		res := parse(&response)
-		return resp.StatusCode, *res, nil
-	}
-
 	return resp.StatusCode, response, nil
 }
 
-func httpDo(hosts []string, params map[string]string, ip string) (*http.Response, error) {
-	var host string
-	if len(hosts) > 0 {
-		host = hosts[0]
-	}
-	fullURL := fmt.Sprintf("%s%s", influx.GetQueryUrl(host), influx.ParseParams(params))
-	resp, err := http.Get(fullURL)
-	if err != nil {
-		return nil, err
-	}
-	return resp, nil
+func httpDo(ctx context.Context, hosts []string, params map[string]string, ip string) (*http.Response, error) {
+	return influx.QueryStream(ctx, hosts, params, ip)
 }
 
 func parse(response *Results) *Results {
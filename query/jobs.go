@@ -0,0 +1,230 @@
+package query
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/lodastack/router/influxql"
+	"github.com/lodastack/router/jobs"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// kinds of jobs
+const (
+	jobDropMeasurement = "drop-measurement"
+	jobRemoveHost      = "remove-host"
+	jobDelete          = "delete"
+)
+
+// jobRequest describes a job: drop-measurement uses Measurement and
+// Regexp, remove-host Tag and Value, delete Measurements, Regexp or both
+// and Where. DryRun previews the job over Range, Confirm is the token of
+// the preview.
+type jobRequest struct {
+	Kind         string   `json:"kind"`
+	NS           string   `json:"ns"`
+	Measurement  string   `json:"measurement,omitempty"`
+	Regexp       bool     `json:"regexp,omitempty"`
+	Tag          string   `json:"tag,omitempty"`
+	Value        string   `json:"value,omitempty"`
+	Measurements []string `json:"measurements,omitempty"`
+	Where        string   `json:"where,omitempty"`
+	DryRun       bool     `json:"dryrun,omitempty"`
+	Range        string   `json:"range,omitempty"`
+	Confirm      string   `json:"confirm,omitempty"`
+}
+
+func (r jobRequest) params() map[string]string {
+	p := make(map[string]string)
+	for k, v := range map[string]string{"measurement": r.Measurement, "tag": r.Tag, "value": r.Value, "where": r.Where} {
+		if v != "" {
+			p[k] = v
+		}
+	}
+	if r.Regexp {
+		p["regexp"] = "true"
+	}
+	if len(r.Measurements) > 0 {
+		p["measurements"] = strings.Join(r.Measurements, ",")
+	}
+	return p
+}
+
+// jobTasks returns the statements of the job r
+func jobTasks(r jobRequest) ([]jobs.Task, error) {
+	if r.NS == "" {
+		return nil, fmt.Errorf("need ns")
+	}
+	switch r.Kind {
+	case jobDropMeasurement:
+		if r.Measurement == "" {
+			return nil, fmt.Errorf("need measurement")
+		}
+		if !r.Regexp {
+			return []jobs.Task{{Measurement: r.Measurement, Query: "DROP MEASUREMENT " + influxql.QuoteIdent(r.Measurement)}}, nil
+		}
+		names, err := matchMeasurements(r.NS, "^"+r.Measurement)
+		if err != nil {
+			return nil, err
+		}
+		return deleteTasks(names, ""), nil
+
+	case jobRemoveHost:
+		if r.Tag == "" {
+			r.Tag = "host"
+		}
+		if r.Tag != "host" || r.Value == "" {
+			return nil, fmt.Errorf("need the host value")
+		}
+		names, err := matchMeasurements(r.NS, "")
+		if err != nil {
+			return nil, err
+		}
+		return deleteTasks(names, fmt.Sprintf("%s = %s", influxql.QuoteIdent(r.Tag), influxql.QuoteString(r.Value))), nil
+
+	case jobDelete:
+		if r.Where == "" {
+			return nil, fmt.Errorf("need where")
+		}
+		names := r.Measurements
+		if r.Measurement != "" {
+			if !r.Regexp {
+				names = append(names, r.Measurement)
+			} else {
+				matched, err := matchMeasurements(r.NS, r.Measurement)
+				if err != nil {
+					return nil, err
+				}
+				names = append(names, matched...)
+			}
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("need measurements")
+		}
+		tasks := deleteTasks(names, r.Where)
+		// the where must not end the statement
+		if q, err := influxql.ParseQuery(tasks[0].Query); err != nil || len(q.Statements) != 1 {
+			return nil, fmt.Errorf("invalid where")
+		}
+		return tasks, nil
+	}
+	return nil, fmt.Errorf("unknown job kind %s", r.Kind)
+}
+
+func deleteTasks(names []string, where string) []jobs.Task {
+	tasks := make([]jobs.Task, 0, len(names))
+	for _, name := range names {
+		q := "DELETE FROM " + influxql.QuoteIdent(name)
+		if where != "" {
+			q += " WHERE " + where
+		}
+		tasks = append(tasks, jobs.Task{Measurement: name, Query: q})
+	}
+	return tasks
+}
+
+// matchMeasurements returns the measurements of ns matching the regexp
+// pattern, all if empty.
+func matchMeasurements(ns, pattern string) ([]string, error) {
+	var re *regexp.Regexp
+	if pattern != "" {
+		var err error
+		if re, err = regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("invalid regexp: %s", err)
+		}
+	}
+	values, err := getMeasurementsFromInfluxDB(ns)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, value := range values {
+		v, ok := value.([]interface{})
+		if !ok || len(v) == 0 {
+			continue
+		}
+		name, ok := v[0].(string)
+		if !ok || (re != nil && !re.MatchString(name)) {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// submitJob submits r and answers 202 with the job, or the preview of
+// a dry run. Bulk deletes need the confirm token of a dry run.
+func submitJob(resp http.ResponseWriter, req *http.Request, r jobRequest) {
+	tasks, err := jobTasks(r)
+	if err != nil {
+		errResp(resp, http.StatusBadRequest, err.Error())
+		return
+	}
+	if r.DryRun {
+		ctx, cancel := queryContext(req, "dryrun", r.NS)
+		defer cancel()
+		p, err := previewJob(ctx, r, tasks, clientIP(req))
+		if err != nil {
+			queryErrResp(resp, ctx, err)
+			return
+		}
+		succResp(resp, "dry run, nothing deleted", p)
+		return
+	}
+	if len(tasks) == 0 {
+		succResp(resp, "nothing to do", nil)
+		return
+	}
+	if needsConfirm(r) {
+		if err := checkConfirm(r, tasks, r.Confirm); err != nil {
+			errResp(resp, http.StatusPreconditionRequired, err.Error())
+			return
+		}
+	}
+	job, err := jobs.Submit(r.Kind, r.NS, r.params(), tasks)
+	if err != nil {
+		errResp(resp, http.StatusInternalServerError, err.Error())
+		return
+	}
+	acceptedResp(resp, "job "+job.ID+" submitted", job)
+}
+
+// submitJobHandler submits the job of the JSON body
+func (s *Service) submitJobHandler(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var r jobRequest
+	if err := decodeBody(req, &r); err != nil {
+		errResp(resp, http.StatusBadRequest, err.Error())
+		return
+	}
+	submitJob(resp, req, r)
+}
+
+func (s *Service) listJobsHandler(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	succResp(resp, "OK", jobs.List(req.FormValue("ns"), req.FormValue("state")))
+}
+
+func (s *Service) getJobHandler(resp http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	job, err := jobs.Get(ps.ByName("id"))
+	if err != nil {
+		errResp(resp, http.StatusNotFound, err.Error())
+		return
+	}
+	succResp(resp, "OK", job)
+}
+
+// cancelJobHandler cancels a running job
+func (s *Service) cancelJobHandler(resp http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	job, err := jobs.Cancel(ps.ByName("id"))
+	if err == jobs.ErrNotFound {
+		errResp(resp, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		errResp(resp, http.StatusConflict, err.Error())
+		return
+	}
+	succResp(resp, "canceling", job)
+}
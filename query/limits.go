@@ -0,0 +1,178 @@
+package query
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/lodastack/router/config"
+	"github.com/lodastack/router/influxql"
+)
+
+// names of the limits
+const (
+	limitMaxRawRange     = "maxRawRange"
+	limitMaxSeries       = "maxSeries"
+	limitMaxPoints       = "maxPoints"
+	limitMaxGroupByRatio = "maxGroupByRatio"
+)
+
+// LimitError tells which limit a query hit. Value is -1 when the time
+// range is unbounded.
+type LimitError struct {
+	Limit string `json:"limit"`
+	Value int64  `json:"value"`
+	Max   int64  `json:"max"`
+}
+
+func (e *LimitError) Error() string {
+	if e.Value < 0 {
+		return fmt.Sprintf("query exceeds %s %d: unbounded time range", e.Limit, e.Max)
+	}
+	return fmt.Sprintf("query exceeds %s %d: %d", e.Limit, e.Max, e.Value)
+}
+
+func limitErrResp(resp http.ResponseWriter, err *LimitError) {
+	errDataResp(resp, http.StatusUnprocessableEntity, err.Error(), err)
+}
+
+// queryLimits returns the limits of ns, nil for admin requests
+func queryLimits(req *http.Request, ns string) *config.LimitConfig {
+	if isAdmin(req) {
+		return nil
+	}
+	c := config.GetConfig().Limits
+	l := c.Default
+	if o, ok := c.NS[ns]; ok {
+		if o.MaxRawRange > 0 {
+			l.MaxRawRange = o.MaxRawRange
+		}
+		if o.MaxSeries > 0 {
+			l.MaxSeries = o.MaxSeries
+		}
+		if o.MaxPoints > 0 {
+			l.MaxPoints = o.MaxPoints
+		}
+		if o.MaxGroupByRatio > 0 {
+			l.MaxGroupByRatio = o.MaxGroupByRatio
+		}
+	}
+	return &l
+}
+
+// checkQuery checks the time ranges of the SELECTs of q before running it
+func checkQuery(q *influxql.Query, l *config.LimitConfig, now time.Time) *LimitError {
+	if l == nil {
+		return nil
+	}
+	for _, s := range q.Selects() {
+		min, max := s.TimeRange(now)
+		if max.IsZero() || max.After(now) {
+			max = now
+		}
+		rng := int64(-1)
+		if !min.IsZero() {
+			rng = int64(max.Sub(min))
+			if rng < 0 {
+				rng = 0
+			}
+		}
+
+		if l.MaxRawRange > 0 && s.IsRaw() {
+			if rng < 0 {
+				return &LimitError{Limit: limitMaxRawRange, Value: -1, Max: l.MaxRawRange}
+			}
+			if secs := rng / int64(time.Second); secs > l.MaxRawRange {
+				return &LimitError{Limit: limitMaxRawRange, Value: secs, Max: l.MaxRawRange}
+			}
+		}
+
+		interval := int64(s.GroupByInterval())
+		if interval <= 0 {
+			continue
+		}
+		if l.MaxGroupByRatio > 0 {
+			if rng < 0 {
+				return &LimitError{Limit: limitMaxGroupByRatio, Value: -1, Max: l.MaxGroupByRatio}
+			}
+			if ratio := rng / interval; ratio > l.MaxGroupByRatio {
+				return &LimitError{Limit: limitMaxGroupByRatio, Value: ratio, Max: l.MaxGroupByRatio}
+			}
+		}
+		// every series has a point per interval
+		if l.MaxPoints > 0 && rng >= 0 {
+			if points := rng / interval; points > l.MaxPoints {
+				return &LimitError{Limit: limitMaxPoints, Value: points, Max: l.MaxPoints}
+			}
+		}
+	}
+	return nil
+}
+
+// checkRows checks the series and points returned
+func checkRows(series, points int64, l *config.LimitConfig) *LimitError {
+	if l == nil {
+		return nil
+	}
+	if l.MaxSeries > 0 && series > l.MaxSeries {
+		return &LimitError{Limit: limitMaxSeries, Value: series, Max: l.MaxSeries}
+	}
+	if l.MaxPoints > 0 && points > l.MaxPoints {
+		return &LimitError{Limit: limitMaxPoints, Value: points, Max: l.MaxPoints}
+	}
+	return nil
+}
+
+// resultsRows counts the series and points of parsed results
+func resultsRows(rs Results) (int64, int64) {
+	var series, points int64
+	for _, r := range rs.Results {
+		series += int64(len(r.Series))
+		for _, s := range r.Series {
+			points += int64(len(s.Values))
+		}
+	}
+	return series, points
+}
+
+// checkResults checks the rows of parsed results
+func checkResults(rs Results, l *config.LimitConfig) *LimitError {
+	if l == nil {
+		return nil
+	}
+	series, points := resultsRows(rs)
+	return checkRows(series, points, l)
+}
+
+// checkRaw checks the rows of a raw InfluxDB response
+func checkRaw(body []byte, l *config.LimitConfig) *LimitError {
+	if l == nil || (l.MaxSeries <= 0 && l.MaxPoints <= 0) {
+		return nil
+	}
+	series, points := rawRows(body)
+	return checkRows(series, points, l)
+}
+
+// rawRows counts the series and points of a raw InfluxDB response
+func rawRows(body []byte) (int64, int64) {
+	var rs struct {
+		Results []struct {
+			Series []struct {
+				Values []json.RawMessage `json:"values"`
+			} `json:"series"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&rs); err != nil {
+		return 0, 0
+	}
+	var series, points int64
+	for _, r := range rs.Results {
+		series += int64(len(r.Series))
+		for _, s := range r.Series {
+			points += int64(len(s.Values))
+		}
+	}
+	return series, points
+}
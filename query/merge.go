@@ -0,0 +1,223 @@
+package query
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lodastack/router/influxql"
+)
+
+// Reads of a migrated namespace are merged from its new and old clusters
+// until the history is copied. Rows of raw points of the same series are
+// joined by their first column, the time. Where both have a row the non
+// null values win, the new cluster first: points copied or written to
+// both are the same. Aggregates are answered by the old cluster alone,
+// it holds the whole history as points are written to both, while a
+// bucket of the new cluster may only hold part of its points. Chunked
+// /query requests are refused during a migration.
+
+// aggregates reports by statement of q whether it aggregates points
+func aggregates(q string) []bool {
+	query, err := influxql.ParseQuery(q)
+	if err != nil {
+		return nil
+	}
+	res := make([]bool, len(query.Statements))
+	for i, stmt := range query.Statements {
+		if s, ok := stmt.(*influxql.SelectStatement); ok {
+			res[i] = aggregated(s)
+		}
+	}
+	return res
+}
+
+func aggregated(s *influxql.SelectStatement) bool {
+	if !s.IsRaw() {
+		return true
+	}
+	for _, src := range s.Sources {
+		if sq, ok := src.(*influxql.SubQuery); ok && aggregated(sq.Statement) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeResults adds the series of old missing from cur, the statements
+// of q which aggregate are taken from old
+func mergeResults(cur, old Results, q string) Results {
+	aggs := aggregates(q)
+	for i := range cur.Results {
+		if i >= len(old.Results) {
+			break
+		}
+		if old.Results[i].Error != "" {
+			continue
+		}
+		if i < len(aggs) && aggs[i] {
+			cur.Results[i] = old.Results[i]
+			continue
+		}
+		cur.Results[i].Series = mergeSeries(cur.Results[i].Series, old.Results[i].Series)
+	}
+	return cur
+}
+
+func mergeSeries(cur, old []Row) []Row {
+	index := make(map[string]int, len(cur))
+	for i, row := range cur {
+		index[rowKey(row)] = i
+	}
+	for _, row := range old {
+		i, ok := index[rowKey(row)]
+		if !ok {
+			index[rowKey(row)] = len(cur)
+			cur = append(cur, row)
+			continue
+		}
+		if strings.Join(cur[i].Columns, ",") != strings.Join(row.Columns, ",") {
+			continue
+		}
+		cur[i].Values = mergeValues(cur[i].Values, row.Values)
+	}
+	return cur
+}
+
+// rowKey identifies the series of row
+func rowKey(row Row) string {
+	return row.Name + "," + tagString(row.Tags)
+}
+
+func mergeValues(cur, old [][]interface{}) [][]interface{} {
+	index := make(map[string]int, len(cur))
+	for i, v := range cur {
+		if len(v) > 0 {
+			index[fmt.Sprint(v[0])] = i
+		}
+	}
+	added := false
+	for _, v := range old {
+		if len(v) == 0 {
+			continue
+		}
+		i, ok := index[fmt.Sprint(v[0])]
+		if !ok {
+			cur = append(cur, v)
+			added = true
+			continue
+		}
+		// fill(null) buckets of the new cluster take the old values
+		for j := 1; j < len(v) && j < len(cur[i]); j++ {
+			if cur[i][j] == nil {
+				cur[i][j] = v[j]
+			}
+		}
+	}
+	if added {
+		sort.SliceStable(cur, func(i, j int) bool { return lessValue(cur[i], cur[j]) })
+	}
+	return cur
+}
+
+// lessValue orders rows by their first column, epoch numbers or strings
+func lessValue(a, b []interface{}) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) < len(b)
+	}
+	// nanosecond epochs are too long for float64
+	if na, ok := a[0].(json.Number); ok {
+		if nb, ok := b[0].(json.Number); ok {
+			ia, aerr := na.Int64()
+			ib, berr := nb.Int64()
+			if aerr == nil && berr == nil {
+				return ia < ib
+			}
+		}
+	}
+	fa, aok := number(a[0])
+	fb, bok := number(b[0])
+	if aok && bok {
+		return fa < fb
+	}
+	return fmt.Sprint(a[0]) < fmt.Sprint(b[0])
+}
+
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// mergeMeasurements adds the measurements of old missing from cur
+func mergeMeasurements(cur, old []interface{}) []interface{} {
+	seen := make(map[string]bool, len(cur))
+	for _, value := range cur {
+		if v, ok := value.([]interface{}); ok && len(v) > 0 {
+			seen[fmt.Sprint(v[0])] = true
+		}
+	}
+	for _, value := range old {
+		if v, ok := value.([]interface{}); ok && len(v) > 0 && !seen[fmt.Sprint(v[0])] {
+			seen[fmt.Sprint(v[0])] = true
+			cur = append(cur, value)
+		}
+	}
+	return cur
+}
+
+// mergeTags adds the tag values of old missing from cur
+func mergeTags(cur, old map[string][]interface{}) map[string][]interface{} {
+	if cur == nil {
+		cur = make(map[string][]interface{}, len(old))
+	}
+	for k, values := range old {
+		seen := make(map[interface{}]bool, len(cur[k]))
+		for _, v := range cur[k] {
+			seen[v] = true
+		}
+		for _, v := range values {
+			if !seen[v] {
+				seen[v] = true
+				cur[k] = append(cur[k], v)
+			}
+		}
+	}
+	return cur
+}
+
+// mergeRaw merges the raw responses of /query to q, numbers are kept exact
+func mergeRaw(cur, old []byte, q string) ([]byte, error) {
+	var c, o chunk
+	if err := decodeNumbers(cur, &c); err != nil {
+		return nil, err
+	}
+	if err := decodeNumbers(old, &o); err != nil {
+		return nil, err
+	}
+	aggs := aggregates(q)
+	for i := range c.Results {
+		if i >= len(o.Results) || o.Results[i].Error != "" {
+			continue
+		}
+		if i < len(aggs) && aggs[i] {
+			c.Results[i] = o.Results[i]
+			continue
+		}
+		c.Results[i].Series = mergeSeries(c.Results[i].Series, o.Results[i].Series)
+	}
+	return json.Marshal(c)
+}
+
+func decodeNumbers(b []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
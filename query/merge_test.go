@@ -0,0 +1,198 @@
+package query
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeValues(t *testing.T) {
+	tests := []struct {
+		name     string
+		cur, old [][]interface{}
+		want     [][]interface{}
+	}{
+		{
+			name: "old only",
+			old:  [][]interface{}{{1.0, 1.0}},
+			want: [][]interface{}{{1.0, 1.0}},
+		},
+		{
+			name: "sorted by time",
+			cur:  [][]interface{}{{3.0, 3.0}, {5.0, 5.0}},
+			old:  [][]interface{}{{1.0, 1.0}, {4.0, 4.0}},
+			want: [][]interface{}{{1.0, 1.0}, {3.0, 3.0}, {4.0, 4.0}, {5.0, 5.0}},
+		},
+		{
+			name: "new cluster first",
+			cur:  [][]interface{}{{1.0, 1.0, 10.0}},
+			old:  [][]interface{}{{1.0, 2.0, 20.0}},
+			want: [][]interface{}{{1.0, 1.0, 10.0}},
+		},
+		{
+			name: "nulls filled per column",
+			cur:  [][]interface{}{{1.0, nil, 10.0}, {2.0, nil, nil}},
+			old:  [][]interface{}{{1.0, 1.0, nil}, {2.0, nil, 20.0}},
+			want: [][]interface{}{{1.0, 1.0, 10.0}, {2.0, nil, 20.0}},
+		},
+		{
+			name: "rfc3339 times",
+			cur:  [][]interface{}{{"2020-01-02T00:00:00Z", 2.0}},
+			old:  [][]interface{}{{"2020-01-01T00:00:00Z", 1.0}},
+			want: [][]interface{}{{"2020-01-01T00:00:00Z", 1.0}, {"2020-01-02T00:00:00Z", 2.0}},
+		},
+		{
+			name: "json numbers",
+			cur:  [][]interface{}{{json.Number("20"), json.Number("2")}},
+			old:  [][]interface{}{{json.Number("3"), json.Number("1")}},
+			want: [][]interface{}{{json.Number("3"), json.Number("1")}, {json.Number("20"), json.Number("2")}},
+		},
+	}
+	for _, tt := range tests {
+		if got := mergeValues(tt.cur, tt.old); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMergeSeries(t *testing.T) {
+	cols := []string{"time", "value"}
+	cur := []Row{
+		{Name: "cpu", Tags: map[string]string{"host": "a"}, Columns: cols, Values: [][]interface{}{{2.0, 2.0}}},
+	}
+	old := []Row{
+		{Name: "cpu", Tags: map[string]string{"host": "a"}, Columns: cols, Values: [][]interface{}{{1.0, 1.0}}},
+		{Name: "cpu", Tags: map[string]string{"host": "b"}, Columns: cols, Values: [][]interface{}{{1.0, 3.0}}},
+		// rows with other columns are not joined
+		{Name: "cpu", Tags: map[string]string{"host": "a"}, Columns: []string{"time", "other"}, Values: [][]interface{}{{0.0, 0.0}}},
+	}
+	got := mergeSeries(cur, old)
+	if len(got) != 2 {
+		t.Fatalf("%d series, want 2: %v", len(got), got)
+	}
+	if want := [][]interface{}{{1.0, 1.0}, {2.0, 2.0}}; !reflect.DeepEqual(got[0].Values, want) {
+		t.Errorf("host a values %v, want %v", got[0].Values, want)
+	}
+	if got[1].Tags["host"] != "b" {
+		t.Errorf("series %v, want host b added", got[1])
+	}
+}
+
+func TestMergeMeasurementsAndTags(t *testing.T) {
+	ms := mergeMeasurements(
+		[]interface{}{[]interface{}{"cpu"}, []interface{}{"mem"}},
+		[]interface{}{[]interface{}{"mem"}, []interface{}{"disk"}},
+	)
+	if want := []interface{}{[]interface{}{"cpu"}, []interface{}{"mem"}, []interface{}{"disk"}}; !reflect.DeepEqual(ms, want) {
+		t.Errorf("measurements %v, want %v", ms, want)
+	}
+
+	tags := mergeTags(
+		map[string][]interface{}{"host": {"a"}},
+		map[string][]interface{}{"host": {"a", "b"}, "dc": {"x"}},
+	)
+	if want := map[string][]interface{}{"host": {"a", "b"}, "dc": {"x"}}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("tags %v, want %v", tags, want)
+	}
+	if tags := mergeTags(nil, map[string][]interface{}{"host": {"a"}}); len(tags["host"]) != 1 {
+		t.Errorf("tags %v, want host a", tags)
+	}
+}
+
+func TestMergeRaw(t *testing.T) {
+	cur := `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[1600000000000000002,null]]}]},` +
+		`{"statement_id":1,"series":[{"name":"mem","columns":["time","value"],"values":[[1,1]]}]}]}`
+	old := `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[1600000000000000001,9007199254740993],[1600000000000000002,2]]}]},` +
+		`{"statement_id":1,"error":"database not found"}]}`
+	b, err := mergeRaw([]byte(cur), []byte(old), `SELECT value FROM cpu; SELECT value FROM mem`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(b)
+	for _, want := range []string{
+		// numbers are kept exact and nulls taken from the old cluster
+		`"values":[[1600000000000000001,9007199254740993],[1600000000000000002,2]]`,
+		`"name":"mem","columns":["time","value"],"values":[[1,1]]`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("merged %s, want %s", got, want)
+		}
+	}
+	if strings.Contains(got, "database not found") {
+		t.Errorf("merged %s has the error of the old cluster", got)
+	}
+
+	if _, err := mergeRaw([]byte(cur), []byte("{"), ""); err == nil {
+		t.Error("merged an invalid response")
+	}
+}
+
+func TestMergeAggregates(t *testing.T) {
+	// the new cluster holds the points written since the migration
+	// started at 1600000030 and the history copied up to 1600000010,
+	// the bucket of 1600000000 straddles the checkpoint
+	cur := Results{Results: []Result{{Series: []Row{
+		{Name: "cpu", Columns: []string{"time", "mean", "count"}, Values: [][]interface{}{
+			{1600000000.0, 2.0, 2.0}, {1600000060.0, 5.0, 3.0},
+		}},
+	}}}}
+	old := Results{Results: []Result{{Series: []Row{
+		{Name: "cpu", Columns: []string{"time", "mean", "count"}, Values: [][]interface{}{
+			{1600000000.0, 3.0, 6.0}, {1600000060.0, 5.0, 3.0},
+		}},
+	}}}}
+	want := [][]interface{}{{1600000000.0, 3.0, 6.0}, {1600000060.0, 5.0, 3.0}}
+
+	tests := []struct {
+		q   string
+		agg bool
+	}{
+		{q: `SELECT mean(value), count(value) FROM cpu WHERE time > now() - 1h GROUP BY time(1m)`, agg: true},
+		{q: `SELECT max(mean) FROM (SELECT mean(value) FROM cpu GROUP BY time(1m))`, agg: true},
+		{q: `SELECT value FROM cpu`},
+		{q: `SHOW MEASUREMENTS`},
+	}
+	for _, tt := range tests {
+		if aggs := aggregates(tt.q); len(aggs) != 1 || aggs[0] != tt.agg {
+			t.Errorf("%s: aggregates %v, want %v", tt.q, aggs, tt.agg)
+		}
+	}
+
+	got := mergeResults(copyResults(cur), old, tests[0].q)
+	if v := got.Results[0].Series[0].Values; !reflect.DeepEqual(v, want) {
+		t.Errorf("merged %v, want the buckets of the old cluster %v", v, want)
+	}
+	// the new cluster answers when the old one fails
+	failed := Results{Results: []Result{{Error: "timeout"}}}
+	got = mergeResults(copyResults(cur), failed, tests[0].q)
+	if v := got.Results[0].Series[0].Values; !reflect.DeepEqual(v, cur.Results[0].Series[0].Values) {
+		t.Errorf("merged %v, want the buckets of the new cluster", v)
+	}
+
+	rawCur := `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","mean","count"],"values":[[1600000000,2,2]]}]}]}`
+	rawOld := `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","mean","count"],"values":[[1600000000,3,6]]}]}]}`
+	b, err := mergeRaw([]byte(rawCur), []byte(rawOld), tests[0].q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"values":[[1600000000,3,6]]`) {
+		t.Errorf("merged %s, want the bucket of the old cluster", b)
+	}
+}
+
+// copyResults copies the rows of rs, merges change them in place
+func copyResults(rs Results) Results {
+	res := Results{Results: make([]Result, len(rs.Results))}
+	for i, r := range rs.Results {
+		for _, row := range r.Series {
+			values := make([][]interface{}, len(row.Values))
+			for j, v := range row.Values {
+				values[j] = append([]interface{}(nil), v...)
+			}
+			row.Values = values
+			res.Results[i].Series = append(res.Results[i].Series, row)
+		}
+	}
+	return res
+}
@@ -0,0 +1,95 @@
+package query
+
+import (
+	"net/http"
+
+	"github.com/lodastack/router/config"
+	"github.com/lodastack/router/loda"
+	"github.com/lodastack/router/migrate"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// migrationRequest starts copying the history of NS from the hosts From
+// to its current cluster, for route changes the router missed.
+type migrationRequest struct {
+	NS   string   `json:"ns"`
+	From []string `json:"from"`
+}
+
+func (s *Service) listMigrationsHandler(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	succResp(resp, "OK", migrate.List())
+}
+
+func (s *Service) getMigrationHandler(resp http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	m, err := migrate.Get(ps.ByName("ns"))
+	if err != nil {
+		errResp(resp, http.StatusNotFound, err.Error())
+		return
+	}
+	succResp(resp, "OK", m)
+}
+
+func (s *Service) startMigrationHandler(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	if !config.GetConfig().Migrate.Enable {
+		errResp(resp, http.StatusBadRequest, "migrate is disabled")
+		return
+	}
+	var r migrationRequest
+	if err := decodeBody(req, &r); err != nil {
+		errResp(resp, http.StatusBadRequest, err.Error())
+		return
+	}
+	if r.NS == "" || len(r.From) == 0 {
+		errResp(resp, http.StatusBadRequest, "need ns and from")
+		return
+	}
+	to, err := loda.InfluxDBs(r.NS)
+	if err != nil {
+		errResp(resp, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for _, h := range r.From {
+		for _, t := range to {
+			if h == t {
+				errResp(resp, http.StatusBadRequest, h+" is in the current cluster of "+r.NS)
+				return
+			}
+		}
+	}
+	m, err := migrate.Start(r.NS, r.From, to)
+	if err != nil {
+		errResp(resp, http.StatusBadRequest, err.Error())
+		return
+	}
+	acceptedResp(resp, "migration of "+r.NS+" started", m)
+}
+
+// resumeMigrationHandler restarts a failed migration from its checkpoints
+func (s *Service) resumeMigrationHandler(resp http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	m, err := migrate.Resume(ps.ByName("ns"))
+	if err == migrate.ErrNotFound {
+		errResp(resp, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		errResp(resp, http.StatusConflict, err.Error())
+		return
+	}
+	acceptedResp(resp, "resumed", m)
+}
+
+// cancelMigrationHandler stops a migration, the old cluster is not
+// written nor read anymore
+func (s *Service) cancelMigrationHandler(resp http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	m, err := migrate.Cancel(ps.ByName("ns"))
+	if err == migrate.ErrNotFound {
+		errResp(resp, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		errResp(resp, http.StatusConflict, err.Error())
+		return
+	}
+	succResp(resp, "canceled", m)
+}
@@ -14,10 +14,15 @@ type Response struct {
 }
 
 func errResp(resp http.ResponseWriter, status int, msg string) {
+	errDataResp(resp, status, msg, nil)
+}
+
+// errDataResp is errResp with details of the error in data
+func errDataResp(resp http.ResponseWriter, status int, msg string, data interface{}) {
 	response := Response{
 		StatusCode: status,
 		Msg:        msg,
-		Data:       nil,
+		Data:       data,
 	}
 	bytes, _ := json.Marshal(&response)
 	resp.Header().Add("Content-Type", "application/json")
@@ -37,6 +42,19 @@ func succResp(resp http.ResponseWriter, msg string, data interface{}) {
 	resp.Write(bytes)
 }
 
+// acceptedResp answers 202 for work going on in the background
+func acceptedResp(resp http.ResponseWriter, msg string, data interface{}) {
+	response := Response{
+		StatusCode: http.StatusAccepted,
+		Msg:        msg,
+		Data:       data,
+	}
+	bytes, _ := json.Marshal(&response)
+	resp.Header().Add("Content-Type", "application/json")
+	resp.WriteHeader(http.StatusAccepted)
+	resp.Write(bytes)
+}
+
 func getTimeDurMs(start time.Time, end time.Time) float64 {
 	return float64((end.UnixNano() - start.UnixNano()) / 1e6)
 }
@@ -55,3 +73,10 @@ func (w *responseWriter) WriteHeader(code int) {
 	w.statusCode = code
 	w.ResponseWriter.WriteHeader(code)
 }
+
+// Flush sends the buffered data, for streamed responses
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,150 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/lodastack/router/audit"
+	"github.com/lodastack/router/config"
+	"github.com/lodastack/router/influx"
+
+	"github.com/lodastack/log"
+)
+
+// chunk is one object of a chunked InfluxDB response
+type chunk struct {
+	Results []chunkResult `json:"results,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+type chunkResult struct {
+	StatementID int        `json:"statement_id"`
+	Series      []Row      `json:"series,omitempty"`
+	Messages    []*Message `json:"messages,omitempty"`
+	Partial     bool       `json:"partial,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// streamQuery proxies a chunked query chunk by chunk, so only one chunk
+// is held at a time. maxRows caps the rows sent, 0 is no limit, going
+// over limits ends the stream with an error. The backend query is killed
+// when ctx is done.
+func streamQuery(ctx context.Context, resp http.ResponseWriter, req *http.Request, influxdbs []string, params map[string][]string, maxRows int, limits *config.LimitConfig) {
+	queryParams := make(map[string]string)
+	for k, v := range params {
+		if len(v) == 0 {
+			continue
+		}
+		queryParams[k] = v[0]
+	}
+	queryParams["chunked"] = "true"
+
+	backend, err := influx.QueryStream(ctx, influxdbs, queryParams, req.Header.Get("X-Real-IP"))
+	if err != nil {
+		queryErrResp(resp, ctx, err)
+		return
+	}
+	defer backend.Body.Close()
+
+	resp.Header().Add("Content-Type", "application/json")
+	resp.WriteHeader(backend.StatusCode)
+	flusher, _ := resp.(http.Flusher)
+	enc := json.NewEncoder(resp)
+	dec := json.NewDecoder(backend.Body)
+	// keep int64 values, like ns timestamps, exact
+	dec.UseNumber()
+
+	rec := audit.FromContext(ctx)
+	rows := 0
+	// a series split over chunks is counted once, only tracked when
+	// capped to bound its memory
+	series := make(map[string]bool)
+	for {
+		var c chunk
+		if err := dec.Decode(&c); err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				log.Errorf("read chunked response failed: %s", err)
+				enc.Encode(chunk{Error: err.Error()})
+			}
+			return
+		}
+
+		full := maxRows > 0 && capRows(&c, maxRows-rows, maxRows)
+		for _, r := range c.Results {
+			for _, s := range r.Series {
+				rows += len(s.Values)
+				if limits != nil && limits.MaxSeries > 0 {
+					series[fmt.Sprintf("%d|%s", r.StatementID, seriesName(s))] = true
+				}
+			}
+		}
+		if lerr := checkRows(int64(len(series)), int64(rows), limits); lerr != nil {
+			enc.Encode(chunk{Error: lerr.Error()})
+			return
+		}
+		rec.AddRows(int64(countRows(c)))
+		if err := enc.Encode(&c); err != nil {
+			// the client is gone
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if full {
+			return
+		}
+	}
+}
+
+// capRows truncates the series of c to the rows left under maxRows, it
+// reports whether the cap was reached and marks the truncated result.
+func capRows(c *chunk, left, maxRows int) bool {
+	for i := range c.Results {
+		r := &c.Results[i]
+		for j := range r.Series {
+			if len(r.Series[j].Values) <= left {
+				left -= len(r.Series[j].Values)
+				continue
+			}
+			r.Series[j].Values = r.Series[j].Values[:left]
+			if left == 0 {
+				j--
+			}
+			r.Series = r.Series[:j+1]
+			r.Partial = false
+			r.Messages = append(r.Messages, &Message{
+				Level: "warning",
+				Text:  fmt.Sprintf("max_rows %d reached, result truncated", maxRows),
+			})
+			c.Results = c.Results[:i+1]
+			return true
+		}
+	}
+	return false
+}
+
+func countRows(c chunk) int {
+	n := 0
+	for _, r := range c.Results {
+		for _, s := range r.Series {
+			n += len(s.Values)
+		}
+	}
+	return n
+}
+
+// maxRowsParam reads the max_rows param, 0 is no limit
+func maxRowsParam(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid max_rows %s", v)
+	}
+	return n, nil
+}
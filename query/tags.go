@@ -0,0 +1,222 @@
+package query
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lodastack/router/influx"
+	"github.com/lodastack/router/influxql"
+	"github.com/lodastack/router/loda"
+)
+
+const (
+	defaultTagLimit = 100
+	maxTagLimit     = 10000
+)
+
+// TagValue is a value of a tag key
+type TagValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// TagValuesPage is a page of tag values sorted by key and value, Next is
+// the cursor of the next page.
+type TagValuesPage struct {
+	Values []TagValue `json:"values"`
+	Next   string     `json:"next,omitempty"`
+}
+
+// tagSearch selects the tag values of a measurement
+type tagSearch struct {
+	key    string
+	prefix string
+	regex  *regexp.Regexp
+	// since is an InfluxQL duration, values seen within it
+	since  string
+	limit  int
+	offset int
+	cursor string
+}
+
+// isTagSearch reports whether the /tags request asks for a page
+func isTagSearch(params url.Values) bool {
+	for _, p := range []string{"key", "prefix", "regex", "since", "limit", "offset", "cursor"} {
+		if params.Get(p) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeTagCursor points after v, and at offset among the matching
+// values when the page was cut by influxdb, -1 otherwise
+func encodeTagCursor(v TagValue, offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset) + "\x00" + v.Key + "\x00" + v.Value))
+}
+
+func decodeTagCursor(cursor string) (TagValue, int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return TagValue{}, 0, fmt.Errorf("invalid cursor")
+	}
+	parts := strings.SplitN(string(b), "\x00", 3)
+	if len(parts) != 3 {
+		return TagValue{}, 0, fmt.Errorf("invalid cursor")
+	}
+	offset, err := strconv.Atoi(parts[0])
+	if err != nil || offset < -1 {
+		return TagValue{}, 0, fmt.Errorf("invalid cursor")
+	}
+	return TagValue{Key: parts[1], Value: parts[2]}, offset, nil
+}
+
+// searchTags returns a page of the tag values of mt matching s. When
+// influxdb can filter the values by itself the page is cut with LIMIT and
+// OFFSET, otherwise every value is read and the page is cut here.
+func searchTags(ns, mt string, s tagSearch) (TagValuesPage, error) {
+	page := TagValuesPage{Values: []TagValue{}}
+	influxdbs, err := loda.InfluxDBs(ns)
+	if err != nil {
+		return page, err
+	}
+	if len(influxdbs) == 0 {
+		return page, fmt.Errorf("%s has no route config", ns)
+	}
+
+	var after TagValue
+	start := 0
+	if s.cursor != "" {
+		if after, start, err = decodeTagCursor(s.cursor); err != nil {
+			return page, err
+		}
+	}
+	// influxdb cuts the page when it filters the values itself, and the
+	// cursor, if any, comes from a page it cut
+	pushdown := start >= 0 && s.filteredByInflux()
+	if pushdown {
+		start += s.offset
+	} else {
+		start = -1
+	}
+	q := tagValuesQuery(mt, s, start)
+
+	rs, err := influx.Query(influxdbs, map[string]string{"db": ns, "q": q}, "")
+	if err != nil {
+		return page, err
+	}
+
+	var values []TagValue
+	for _, r := range rs.Results {
+		for _, series := range r.Series {
+			for _, vs := range series.Values {
+				v, ok := vs.([]interface{})
+				if !ok || len(v) < 2 {
+					continue
+				}
+				key, _ := v[0].(string)
+				value, _ := v[1].(string)
+				if s.prefix != "" && !strings.HasPrefix(value, s.prefix) {
+					continue
+				}
+				if s.regex != nil && !s.regex.MatchString(value) {
+					continue
+				}
+				values = append(values, TagValue{Key: key, Value: value})
+			}
+		}
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].Key != values[j].Key {
+			return values[i].Key < values[j].Key
+		}
+		return values[i].Value < values[j].Value
+	})
+
+	if pushdown {
+		if len(values) > s.limit {
+			values = values[:s.limit]
+			page.Next = encodeTagCursor(values[len(values)-1], start+s.limit)
+		}
+		page.Values = values
+		return page, nil
+	}
+
+	if s.cursor != "" {
+		values = values[sort.Search(len(values), func(i int) bool {
+			return values[i].Key > after.Key || (values[i].Key == after.Key && values[i].Value > after.Value)
+		}):]
+	}
+	if s.offset >= len(values) {
+		return page, nil
+	}
+	values = values[s.offset:]
+	if len(values) > s.limit {
+		values = values[:s.limit]
+		page.Next = encodeTagCursor(values[len(values)-1], -1)
+	}
+	page.Values = values
+	return page, nil
+}
+
+// filteredByInflux reports whether influxdb returns only the matching
+// values, prefix and regex are only matched by influxdb against a key
+func (s tagSearch) filteredByInflux() bool {
+	return s.key != "" || (s.prefix == "" && s.regex == nil)
+}
+
+// tagValuesQuery builds the SHOW TAG VALUES of s, a page from start is
+// asked with LIMIT and OFFSET when start is not negative
+func tagValuesQuery(mt string, s tagSearch, start int) string {
+	q := "SHOW TAG VALUES FROM " + influxql.QuoteIdent(mt)
+	var conds []string
+	if s.key != "" {
+		q += " WITH KEY = " + influxql.QuoteIdent(s.key)
+		// only the series with a matching value of key
+		if s.prefix != "" {
+			conds = append(conds, fmt.Sprintf("%s =~ /^%s/", influxql.QuoteIdent(s.key), regexLiteral(regexp.QuoteMeta(s.prefix))))
+		}
+		if s.regex != nil {
+			conds = append(conds, fmt.Sprintf("%s =~ /%s/", influxql.QuoteIdent(s.key), regexLiteral(s.regex.String())))
+		}
+	} else {
+		q += " WITH KEY =~ /.*/"
+	}
+	if s.since != "" {
+		conds = append(conds, "time > now() - "+s.since)
+	}
+	if len(conds) > 0 {
+		q += " WHERE " + strings.Join(conds, " AND ")
+	}
+	if start >= 0 {
+		// one more value tells whether there is a next page
+		q += fmt.Sprintf(" LIMIT %d OFFSET %d", s.limit+1, start)
+	}
+	return q
+}
+
+// regexLiteral escapes the slashes of a regex for an InfluxQL regex
+// literal. Escaped characters, like an already escaped slash, are kept.
+func regexLiteral(re string) string {
+	var b strings.Builder
+	for i := 0; i < len(re); i++ {
+		switch {
+		case re[i] == '\\' && i+1 < len(re):
+			b.WriteString(re[i : i+2])
+			i++
+		case re[i] == '\\':
+			// a trailing backslash would escape the closing slash
+			b.WriteString(`\\`)
+		case re[i] == '/':
+			b.WriteString(`\/`)
+		default:
+			b.WriteByte(re[i])
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,92 @@
+package query
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/lodastack/router/influxql"
+)
+
+func TestRegexLiteral(t *testing.T) {
+	tests := []struct {
+		re   string
+		want string
+	}{
+		{re: `^a.b$`, want: `^a.b$`},
+		{re: `a/b`, want: `a/b`},
+		// an escaped slash reads as a slash, both match the same
+		{re: `a\/b`, want: `a/b`},
+		{re: `a\\`, want: `a\\`},
+		{re: `a\\/b`, want: `a\\/b`},
+		{re: `a\`, want: `a\\`},
+		{re: `/; DROP DATABASE x; SELECT /`, want: `/; DROP DATABASE x; SELECT /`},
+		{re: `\/; DROP DATABASE x; SELECT \/`, want: `/; DROP DATABASE x; SELECT /`},
+	}
+	for _, tt := range tests {
+		q, err := influxql.ParseQuery("SHOW TAG VALUES FROM cpu WITH KEY = host WHERE host =~ /" + regexLiteral(tt.re) + "/")
+		if err != nil || len(q.Statements) != 1 {
+			t.Errorf("%s: %v", tt.re, err)
+			continue
+		}
+		got := q.Statements[0].(*influxql.ShowStatement).Condition.(*influxql.BinaryExpr).RHS.(*influxql.RegexLiteral).Val
+		if got != tt.want {
+			t.Errorf("%s: parsed as %s, want %s", tt.re, got, tt.want)
+		}
+	}
+}
+
+func TestTagValuesQuery(t *testing.T) {
+	tests := []struct {
+		s     tagSearch
+		start int
+		want  string
+		infl  bool
+	}{
+		{
+			s:     tagSearch{limit: 10},
+			start: 20,
+			want:  `SHOW TAG VALUES FROM cpu WITH KEY =~ /.*/ LIMIT 11 OFFSET 20`,
+			infl:  true,
+		},
+		{
+			s:     tagSearch{key: "host", prefix: "a.b/", regex: regexp.MustCompile(`\d/`), since: "1h", limit: 10},
+			start: 0,
+			want:  `SHOW TAG VALUES FROM cpu WITH KEY = host WHERE host =~ /^a\.b\// AND host =~ /\d\// AND time > now() - 1h LIMIT 11 OFFSET 0`,
+			infl:  true,
+		},
+		{
+			s:     tagSearch{prefix: "a", limit: 10},
+			start: -1,
+			want:  `SHOW TAG VALUES FROM cpu WITH KEY =~ /.*/`,
+		},
+		{
+			s:     tagSearch{key: "host name", limit: 10},
+			start: -1,
+			want:  `SHOW TAG VALUES FROM cpu WITH KEY = "host name"`,
+			infl:  true,
+		},
+	}
+	for _, tt := range tests {
+		if got := tagValuesQuery("cpu", tt.s, tt.start); got != tt.want {
+			t.Errorf("query %s, want %s", got, tt.want)
+		}
+		if got := tt.s.filteredByInflux(); got != tt.infl {
+			t.Errorf("%s: filtered by influxdb %v, want %v", tt.want, got, tt.infl)
+		}
+	}
+}
+
+func TestTagCursor(t *testing.T) {
+	v := TagValue{Key: "host", Value: "a\x00b"}
+	for _, offset := range []int{-1, 0, 30} {
+		got, n, err := decodeTagCursor(encodeTagCursor(v, offset))
+		if err != nil || got != v || n != offset {
+			t.Errorf("offset %d: decoded %+v %d %v", offset, got, n, err)
+		}
+	}
+	for _, c := range []string{"!", "aG9zdABh", "eABob3N0AGE", "LTIAaG9zdABh"} {
+		if _, _, err := decodeTagCursor(c); err == nil {
+			t.Errorf("%s: decoded", c)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package query
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lodastack/router/audit"
+	"github.com/lodastack/router/influxql"
+	"github.com/lodastack/router/loda"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	defaultTopN      = 10
+	maxTopN          = 100
+	defaultTopNBy    = "host"
+	defaultWindow    = "1h"
+	maxWindow        = 7 * 24 * time.Hour
+	defaultSparkline = 30
+	maxSparkline     = 300
+)
+
+// TopN is the ranking of the groups of a measurement
+type TopN struct {
+	Measurement string      `json:"measurement"`
+	By          string      `json:"by"`
+	Fn          string      `json:"fn"`
+	Window      string      `json:"window"`
+	Order       string      `json:"order"`
+	Entries     []TopNEntry `json:"entries"`
+}
+
+// TopNEntry is a ranked group, Sparkline holds [time, value] pairs
+type TopNEntry struct {
+	Rank      int             `json:"rank"`
+	Key       string          `json:"key"`
+	Value     float64         `json:"value"`
+	Sparkline [][]interface{} `json:"sparkline,omitempty"`
+}
+
+// topnHandler ranks the groups of a measurement by an aggregation over a
+// window, like the 20 hosts with the highest disk.io.util in the last hour.
+func (s *Service) topnHandler(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ns := req.FormValue("ns")
+	measurement := req.FormValue("measurement")
+	where := req.FormValue("where")
+	if len(ns) == 0 || len(measurement) == 0 {
+		errResp(resp, http.StatusBadRequest, "need params")
+		return
+	}
+	if strings.ContainsAny(measurement, `"\`) {
+		errResp(resp, http.StatusBadRequest, "invalid measurement")
+		return
+	}
+
+	fn := req.FormValue("fn")
+	if fn == "" {
+		fn = "mean"
+	}
+	call, err := validFn(fn)
+	if err != nil {
+		errResp(resp, http.StatusBadRequest, err.Error())
+		return
+	}
+	window := req.FormValue("window")
+	if window == "" {
+		window = defaultWindow
+	}
+	windowDur, err := influxql.ParseDuration(window)
+	if err != nil || windowDur <= 0 || windowDur > maxWindow {
+		errResp(resp, http.StatusBadRequest, "window must be a duration up to 7d")
+		return
+	}
+	n, err := intParam(req, "n", defaultTopN, 1, maxTopN)
+	if err != nil {
+		errResp(resp, http.StatusBadRequest, err.Error())
+		return
+	}
+	sparkline := 0
+	if req.FormValue("sparkline") == "true" {
+		if sparkline, err = intParam(req, "points", defaultSparkline, 2, maxSparkline); err != nil {
+			errResp(resp, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	order := req.FormValue("order")
+	if order == "" {
+		order = "desc"
+	}
+	if order != "desc" && order != "asc" {
+		errResp(resp, http.StatusBadRequest, "order must be desc or asc")
+		return
+	}
+	by := req.FormValue("by")
+	if by == "" {
+		by = defaultTopNBy
+	}
+
+	influxdbs, err := loda.InfluxDBs(ns)
+	if err != nil {
+		errResp(resp, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(influxdbs) == 0 {
+		errResp(resp, 400, ns+" has no influxdb route config")
+		return
+	}
+	tags, err := tags(ns, measurement)
+	if err != nil {
+		errResp(resp, 500, ns+" get tags failed: "+err.Error())
+		return
+	}
+	if _, ok := tags[by]; !ok {
+		errResp(resp, http.StatusBadRequest, fmt.Sprintf("%s has no tag %s", measurement, by))
+		return
+	}
+
+	cond := "time > now() - " + window
+	if where != "" {
+		cond = "(" + where + ") AND " + cond
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s GROUP BY %s",
+		call, influxql.QuoteIdent(measurement), cond, influxql.QuoteIdent(by))
+	if q, err := parseQuery(query); err != nil || len(q.Statements) != 1 {
+		errResp(resp, http.StatusBadRequest, "invalid where")
+		return
+	}
+
+	rec := audit.FromContext(req.Context())
+	rec.SetNS(ns, query)
+	ctx, cancel := queryContext(req, "topn", ns)
+	defer cancel()
+	p := url.Values{}
+	p.Set("q", query)
+	p.Set("db", ns)
+	p.Set("epoch", "s")
+	_, rs, err := queryInfluxDB(ctx, influxdbs, p, req.Header.Get("X-Real-IP"), true)
+	if err != nil {
+		queryErrResp(resp, ctx, err)
+		return
+	}
+	if lerr := checkResults(rs, queryLimits(req, ns)); lerr != nil {
+		limitErrResp(resp, lerr)
+		return
+	}
+
+	res := TopN{Measurement: measurement, By: by, Fn: fn, Window: window, Order: order, Entries: []TopNEntry{}}
+	for _, r := range rs.Results {
+		for _, row := range r.Series {
+			if len(row.Values) == 0 || len(row.Values[0]) < 2 {
+				continue
+			}
+			if v, ok := row.Values[0][1].(float64); ok {
+				res.Entries = append(res.Entries, TopNEntry{Key: row.Tags[by], Value: v})
+			}
+		}
+	}
+	sort.SliceStable(res.Entries, func(i, j int) bool {
+		if order == "asc" {
+			return res.Entries[i].Value < res.Entries[j].Value
+		}
+		return res.Entries[i].Value > res.Entries[j].Value
+	})
+	if len(res.Entries) > n {
+		res.Entries = res.Entries[:n]
+	}
+	for i := range res.Entries {
+		res.Entries[i].Rank = i + 1
+	}
+	rec.AddRows(int64(len(res.Entries)))
+
+	if sparkline > 0 && len(res.Entries) > 0 {
+		keys := make([]string, len(res.Entries))
+		for i, e := range res.Entries {
+			keys[i] = fmt.Sprintf("%s = %s", influxql.QuoteIdent(by), influxql.QuoteString(e.Key))
+		}
+		interval := windowDur / time.Duration(sparkline)
+		if interval < time.Second {
+			interval = time.Second
+		}
+		p.Set("q", fmt.Sprintf("SELECT %s FROM %s WHERE %s AND (%s) GROUP BY time(%ds), %s fill(none)",
+			call, influxql.QuoteIdent(measurement), cond, strings.Join(keys, " OR "),
+			int64(interval/time.Second), influxql.QuoteIdent(by)))
+		_, lines, err := queryInfluxDB(ctx, influxdbs, p, req.Header.Get("X-Real-IP"), true)
+		if err != nil {
+			queryErrResp(resp, ctx, err)
+			return
+		}
+		byKey := make(map[string][][]interface{})
+		for _, r := range lines.Results {
+			for _, row := range r.Series {
+				byKey[row.Tags[by]] = row.Values
+			}
+		}
+		for i := range res.Entries {
+			res.Entries[i].Sparkline = byKey[res.Entries[i].Key]
+		}
+	}
+	succResp(resp, "OK", res)
+}
+
+// intParam reads an int param between min and max, def when it is empty
+func intParam(req *http.Request, name string, def, min, max int) (int, error) {
+	v := req.FormValue(name)
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i < min || i > max {
+		return 0, fmt.Errorf("%s must be between %d and %d", name, min, max)
+	}
+	return i, nil
+}
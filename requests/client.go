@@ -0,0 +1,200 @@
+package requests
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultTimeout             = 30 * time.Second
+	defaultDialTimeout         = 5 * time.Second
+	defaultMaxIdleConnsPerHost = 16
+	defaultBackoff             = 100 * time.Millisecond
+)
+
+// Options tunes a Client for one backend.
+type Options struct {
+	// Timeout bounds a whole call, including reading the body.
+	// Streamed calls are only bounded until the response header. A
+	// negative Timeout is none, calls are only bounded by their context.
+	Timeout time.Duration
+	// MaxIdleConnsPerHost sizes the keep-alive pool.
+	MaxIdleConnsPerHost int
+	// Retries is how many times idempotent calls are retried on
+	// connection errors or 5xx responses.
+	Retries int
+	// Backoff is the wait before the first retry, doubled every retry.
+	Backoff time.Duration
+	// Gzip compresses request bodies.
+	Gzip bool
+}
+
+// Client is a HTTP client with its own connection pool.
+type Client struct {
+	opts Options
+	hc   *http.Client
+}
+
+// DefaultClient is used by the package level helpers.
+var DefaultClient = NewClient(Options{})
+
+// NewClient returns a client, zero options are set to defaults.
+func NewClient(opts Options) *Client {
+	if opts.Timeout == 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.MaxIdleConnsPerHost <= 0 {
+		opts.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = defaultBackoff
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   defaultDialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        opts.MaxIdleConnsPerHost * 4,
+		MaxIdleConnsPerHost: opts.MaxIdleConnsPerHost,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	if opts.Timeout > 0 {
+		transport.ResponseHeaderTimeout = opts.Timeout
+	}
+	return &Client{
+		opts: opts,
+		hc:   &http.Client{Transport: transport},
+	}
+}
+
+// Timeout returns the timeout of a call, negative if none
+func (c *Client) Timeout() time.Duration {
+	return c.opts.Timeout
+}
+
+// withTimeout bounds ctx by the timeout of a call
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.opts.Timeout < 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.opts.Timeout)
+}
+
+// Get requests url and reads the whole body. It is retried.
+func (c *Client) Get(ctx context.Context, url string) (*Resp, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	resp, err := c.GetStream(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	return newResp(resp)
+}
+
+// GetStream requests url and returns the unread response, the caller
+// must close its body. It is retried until the response header.
+func (c *Client) GetStream(ctx context.Context, url string) (*http.Response, error) {
+	var resp *http.Response
+	var err error
+	backoff := c.opts.Backoff
+	for i := 0; ; i++ {
+		var req *http.Request
+		req, err = http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err = c.hc.Do(req.WithContext(ctx))
+		// the caller gave up, do not try again
+		if i >= c.opts.Retries || ctx.Err() != nil || !retryable(resp, err) {
+			break
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return resp, err
+}
+
+// Post sends obj as JSON. It is not retried.
+func (c *Client) Post(ctx context.Context, url string, obj interface{}) (*Resp, error) {
+	data, err := getReader(obj)
+	if err != nil {
+		return nil, err
+	}
+	return c.post(ctx, url, "application/json", data)
+}
+
+// PostBytes sends data as plain text. It is not retried.
+func (c *Client) PostBytes(ctx context.Context, url string, data []byte) (*Resp, error) {
+	return c.post(ctx, url, "text/plain", bytes.NewReader(data))
+}
+
+func (c *Client) post(ctx context.Context, url string, contentType string, data io.Reader) (*Resp, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	var encoding string
+	if c.opts.Gzip {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := io.Copy(gz, data); err != nil {
+			return nil, err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+		data, encoding = &buf, "gzip"
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, data)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	resp, err := c.hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return newResp(resp)
+}
+
+func retryable(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode >= 500
+}
+
+func newResp(resp *http.Response) (*Resp, error) {
+	body, err := getBytes(resp)
+	if err != nil {
+		return nil, err
+	}
+	return &Resp{Status: resp.StatusCode, Body: body}, nil
+}
+
+// StatusError returns an error carrying the status and a body snippet
+// of a non 2xx response, and nil otherwise.
+func StatusError(status int, body []byte) error {
+	if status/100 == 2 {
+		return nil
+	}
+	if len(body) > 512 {
+		body = body[:512]
+	}
+	return fmt.Errorf("returned invalid status code: %d, body: %s", status, bytes.TrimSpace(body))
+}
@@ -1,23 +1,10 @@
 package requests
 
 import (
-	"net/http"
+	"context"
 )
 
+// Get requests url with the DefaultClient.
 func Get(url string) (*Resp, error) {
-	var rs *Resp = new(Resp)
-
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, err
-	}
-
-	rs.Status = resp.StatusCode
-
-	if bytes, err := getBytes(resp); err != nil {
-		return nil, err
-	} else {
-		rs.Body = bytes
-		return rs, nil
-	}
+	return DefaultClient.Get(context.Background(), url)
 }
@@ -0,0 +1,125 @@
+package worker
+
+import (
+	"container/list"
+	"encoding/json"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/lodastack/router/config"
+	"github.com/lodastack/router/models"
+)
+
+const (
+	defaultDedupWindow = 600
+	defaultDedupSize   = 100000
+)
+
+type fingerprint [16]byte
+
+type dedupEntry struct {
+	fp      fingerprint
+	written time.Time
+}
+
+// dedupWindow remembers the fingerprints of points batches written
+// successfully in the last window, bounded to size entries.
+type dedupWindow struct {
+	mu     sync.Mutex
+	window time.Duration
+	size   int
+	seen   map[fingerprint]*list.Element
+	order  *list.List
+}
+
+func newDedupWindow(window time.Duration, size int) *dedupWindow {
+	return &dedupWindow{
+		window: window,
+		size:   size,
+		seen:   make(map[fingerprint]*list.Element),
+		order:  list.New(),
+	}
+}
+
+// SeenOrAdd reports whether fp was written within the window, and records
+// it as written at now if not. Checking and recording under one lock lets
+// only one of two identical batches arriving together through.
+func (d *dedupWindow) SeenOrAdd(fp fingerprint, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expire(now)
+	if _, ok := d.seen[fp]; ok {
+		return true
+	}
+	for d.order.Len() >= d.size {
+		d.remove(d.order.Front())
+	}
+	d.seen[fp] = d.order.PushBack(&dedupEntry{fp: fp, written: now})
+	return false
+}
+
+// Forget drops fp, a batch which failed to write can be retried.
+func (d *dedupWindow) Forget(fp fingerprint) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.seen[fp]; ok {
+		d.remove(e)
+	}
+}
+
+func (d *dedupWindow) expire(now time.Time) {
+	for e := d.order.Front(); e != nil; e = d.order.Front() {
+		if now.Sub(e.Value.(*dedupEntry).written) < d.window {
+			return
+		}
+		d.remove(e)
+	}
+}
+
+func (d *dedupWindow) remove(e *list.Element) {
+	delete(d.seen, e.Value.(*dedupEntry).fp)
+	d.order.Remove(e)
+}
+
+var (
+	dedupMu      sync.Mutex
+	dedupWindows = make(map[string]*dedupWindow)
+)
+
+// dedupFor returns the window of namespace ns, or nil if dedup is disabled.
+func dedupFor(ns string) *dedupWindow {
+	c := config.GetConfig().Dedup
+	if !c.Enable {
+		return nil
+	}
+	dedupMu.Lock()
+	defer dedupMu.Unlock()
+	if d, ok := dedupWindows[ns]; ok {
+		return d
+	}
+	window, size := c.Window, c.Size
+	if window <= 0 {
+		window = defaultDedupWindow
+	}
+	if size <= 0 {
+		size = defaultDedupSize
+	}
+	d := newDedupWindow(time.Duration(window)*time.Second, size)
+	dedupWindows[ns] = d
+	return d
+}
+
+// pointsFingerprint hashes the canonical JSON form of the batch, so the
+// same points are matched whatever field order the agent sent them in.
+func pointsFingerprint(points models.Points) (fingerprint, error) {
+	var fp fingerprint
+	data, err := json.Marshal(points)
+	if err != nil {
+		return fp, err
+	}
+	h := fnv.New128a()
+	h.Write(data)
+	copy(fp[:], h.Sum(nil))
+	return fp, nil
+}
@@ -0,0 +1,116 @@
+package worker
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lodastack/router/config"
+	"github.com/lodastack/router/models"
+)
+
+func batch(value float64) models.Points {
+	return models.Points{Database: "collect.a", Points: []*models.Point{{
+		Measurement: "cpu",
+		Timestamp:   1600000000,
+		Tags:        map[string]string{"host": "a"},
+		Fields:      map[string]interface{}{"value": value},
+	}}}
+}
+
+func TestDedupWindow(t *testing.T) {
+	fp1, _ := pointsFingerprint(batch(1))
+	fp2, _ := pointsFingerprint(batch(2))
+	if fp1 == fp2 {
+		t.Fatal("different batches have the same fingerprint")
+	}
+	start := time.Unix(1600000000, 0)
+	tests := []struct {
+		fp    fingerprint
+		at    time.Duration
+		seen  bool
+		about string
+	}{
+		{fp: fp1, at: 0, about: "first write"},
+		{fp: fp1, at: time.Second, seen: true, about: "resent"},
+		{fp: fp2, at: time.Second, about: "other points"},
+		{fp: fp1, at: 9 * time.Second, seen: true, about: "resent before expiry"},
+		{fp: fp1, at: 10 * time.Second, about: "resent at expiry"},
+		{fp: fp1, at: 11 * time.Second, seen: true, about: "resent after the rewrite"},
+	}
+	d := newDedupWindow(10*time.Second, 10)
+	for _, tt := range tests {
+		if seen := d.SeenOrAdd(tt.fp, start.Add(tt.at)); seen != tt.seen {
+			t.Errorf("%s: seen %v, want %v", tt.about, seen, tt.seen)
+		}
+	}
+
+	d.Forget(fp1)
+	if d.SeenOrAdd(fp1, start.Add(12*time.Second)) {
+		t.Error("forgotten batch is seen")
+	}
+}
+
+func TestDedupWindowSize(t *testing.T) {
+	now := time.Now()
+	d := newDedupWindow(time.Minute, 2)
+	fps := make([]fingerprint, 3)
+	for i := range fps {
+		fps[i], _ = pointsFingerprint(batch(float64(i)))
+		d.SeenOrAdd(fps[i], now)
+	}
+	if d.SeenOrAdd(fps[0], now) {
+		t.Error("oldest batch is not evicted")
+	}
+	if !d.SeenOrAdd(fps[2], now) {
+		t.Error("newest batch is evicted")
+	}
+}
+
+func TestDedupConcurrent(t *testing.T) {
+	d := newDedupWindow(time.Minute, 10)
+	fp, _ := pointsFingerprint(batch(1))
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		passed int
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !d.SeenOrAdd(fp, time.Now()) {
+				mu.Lock()
+				passed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if passed != 1 {
+		t.Errorf("%d identical batches passed, want 1", passed)
+	}
+}
+
+func TestDedupPerNamespace(t *testing.T) {
+	c := config.GetConfig()
+	c.Dedup.Enable = true
+	defer func() { c.Dedup.Enable = false }()
+
+	fp, _ := pointsFingerprint(batch(1))
+	now := time.Now()
+	if dedupFor("collect.a").SeenOrAdd(fp, now) {
+		t.Fatal("first write is seen")
+	}
+	if !dedupFor("collect.a").SeenOrAdd(fp, now) {
+		t.Error("resent batch is not seen")
+	}
+	if dedupFor("collect.b").SeenOrAdd(fp, now) {
+		t.Error("batch of another namespace is seen")
+	}
+
+	c.Dedup.Enable = false
+	if dedupFor("collect.a") != nil {
+		t.Error("disabled dedup has a window")
+	}
+}
@@ -4,8 +4,6 @@ import (
 	"encoding/json"
 	golog "log"
 
-	"github.com/lodastack/router/influx"
-	"github.com/lodastack/router/loda"
 	"github.com/lodastack/router/models"
 
 	"github.com/bitly/go-nsq"
@@ -56,24 +54,5 @@ func (this *NsqWorker) HandleMessage(m *nsq.Message) error {
 		return nil
 	}
 
-	pointsObj := originPointsObj
-	if len(pointsObj.Points) == 0 {
-		return nil
-	}
-
-	influxdbs, err := loda.InfluxDBs(this.Namespace)
-	if err != nil {
-		return err
-	}
-
-	if len(influxdbs) == 0 {
-		log.Warningf("get empty influxdbs config, ignore the points")
-		return nil
-	}
-
-	if err := influx.WritePoints(influxdbs, pointsObj); err != nil {
-		log.Errorf("<%s> post message to influxdbs %v failed: %s", this.Namespace, influxdbs, err.Error())
-		return err
-	}
-	return nil
+	return WritePoints(this.Namespace, originPointsObj)
 }
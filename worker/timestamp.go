@@ -0,0 +1,109 @@
+package worker
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lodastack/router/config"
+	"github.com/lodastack/router/models"
+)
+
+const (
+	// ActionReject drops the offending point
+	ActionReject = "reject"
+	// ActionClamp moves the offending point to the nearest allowed time
+	ActionClamp = "clamp"
+	// ActionRewrite sets the offending point to the receive time
+	ActionRewrite = "rewrite"
+)
+
+// SkewedHost counts the points an agent sent outside the allowed window.
+type SkewedHost struct {
+	Host      string    `json:"host"`
+	NS        string    `json:"ns"`
+	Past      int64     `json:"past"`
+	Future    int64     `json:"future"`
+	LastSkew  int64     `json:"last_skew"`
+	LastPoint int64     `json:"last_point"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+var (
+	skewMu    sync.RWMutex
+	skewHosts = make(map[string]*SkewedHost)
+)
+
+// SkewedHosts returns hosts which sent late or future points, the most
+// recently seen first.
+func SkewedHosts() []SkewedHost {
+	skewMu.RLock()
+	res := make([]SkewedHost, 0, len(skewHosts))
+	for _, h := range skewHosts {
+		res = append(res, *h)
+	}
+	skewMu.RUnlock()
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].LastSeen.After(res[j].LastSeen)
+	})
+	return res
+}
+
+func recordSkew(ns string, p *models.Point, skew int64, now time.Time) {
+	host := p.Tags["host"]
+	if host == "" {
+		host = "unknown"
+	}
+	skewMu.Lock()
+	h, ok := skewHosts[host]
+	if !ok {
+		h = &SkewedHost{Host: host}
+		skewHosts[host] = h
+	}
+	if skew < 0 {
+		h.Past++
+	} else {
+		h.Future++
+	}
+	h.NS, h.LastSkew, h.LastPoint, h.LastSeen = ns, skew, p.Timestamp, now
+	skewMu.Unlock()
+}
+
+// checkTimestamps applies the timestamp policy to the batch in place and
+// returns the number of points changed or dropped.
+func checkTimestamps(ns string, pointsObj *models.Points, now time.Time) int {
+	c := config.GetConfig().Timestamp
+	if !c.Enable {
+		return 0
+	}
+
+	var changed int
+	points := pointsObj.Points[:0]
+	minTs, maxTs := now.Unix()-c.MaxPast, now.Unix()+c.MaxFuture
+	for _, p := range pointsObj.Points {
+		var bound int64
+		switch {
+		case c.MaxPast > 0 && p.Timestamp < minTs:
+			bound = minTs
+		case c.MaxFuture > 0 && p.Timestamp > maxTs:
+			bound = maxTs
+		default:
+			points = append(points, p)
+			continue
+		}
+
+		changed++
+		recordSkew(ns, p, p.Timestamp-now.Unix(), now)
+		switch c.Action {
+		case ActionClamp:
+			p.Timestamp = bound
+		case ActionRewrite:
+			p.Timestamp = now.Unix()
+		default:
+			continue
+		}
+		points = append(points, p)
+	}
+	pointsObj.Points = points
+	return changed
+}
@@ -0,0 +1,101 @@
+package worker
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lodastack/router/config"
+	"github.com/lodastack/router/models"
+)
+
+func TestCheckTimestamps(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	ts := []int64{
+		now.Unix() - 3601, // late
+		now.Unix() - 3600, // at the late limit
+		now.Unix(),
+		now.Unix() + 60, // at the future limit
+		now.Unix() + 61, // future
+	}
+	tests := []struct {
+		action  string
+		want    []int64
+		changed int
+	}{
+		{action: ActionReject, want: ts[1:4], changed: 2},
+		{action: "", want: ts[1:4], changed: 2},
+		{action: ActionClamp, want: []int64{ts[1], ts[1], ts[2], ts[3], ts[3]}, changed: 2},
+		{action: ActionRewrite, want: []int64{ts[2], ts[1], ts[2], ts[3], ts[2]}, changed: 2},
+	}
+
+	c := config.GetConfig()
+	defer func() { c.Timestamp = config.TimestampConfig{} }()
+	for _, tt := range tests {
+		c.Timestamp = config.TimestampConfig{Enable: true, MaxPast: 3600, MaxFuture: 60, Action: tt.action}
+		var pointsObj models.Points
+		for _, sec := range ts {
+			pointsObj.Points = append(pointsObj.Points, &models.Point{Measurement: "cpu", Timestamp: sec})
+		}
+		changed := checkTimestamps("collect.a", &pointsObj, now)
+		var got []int64
+		for _, p := range pointsObj.Points {
+			got = append(got, p.Timestamp)
+		}
+		if changed != tt.changed || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: changed %d, timestamps %v, want %d %v", tt.action, changed, got, tt.changed, tt.want)
+		}
+	}
+}
+
+func TestCheckTimestampsDisabled(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	c := config.GetConfig()
+	defer func() { c.Timestamp = config.TimestampConfig{} }()
+	for _, tc := range []config.TimestampConfig{
+		{MaxPast: 1, MaxFuture: 1, Action: ActionReject},
+		// a zero limit is no limit
+		{Enable: true, Action: ActionReject},
+	} {
+		c.Timestamp = tc
+		pointsObj := models.Points{Points: []*models.Point{{Timestamp: 0}, {Timestamp: now.Unix() * 2}}}
+		if n := checkTimestamps("collect.a", &pointsObj, now); n != 0 || len(pointsObj.Points) != 2 {
+			t.Errorf("%+v: %d changed, %d points left", tc, n, len(pointsObj.Points))
+		}
+	}
+}
+
+func TestSkewedHosts(t *testing.T) {
+	skewMu.Lock()
+	skewHosts = make(map[string]*SkewedHost)
+	skewMu.Unlock()
+
+	c := config.GetConfig()
+	c.Timestamp = config.TimestampConfig{Enable: true, MaxPast: 60, MaxFuture: 60, Action: ActionReject}
+	defer func() { c.Timestamp = config.TimestampConfig{} }()
+
+	now := time.Unix(1600000000, 0)
+	point := func(host string, skew int64) *models.Point {
+		return &models.Point{Tags: map[string]string{"host": host}, Timestamp: now.Unix() + skew}
+	}
+	checkTimestamps("collect.a", &models.Points{Points: []*models.Point{
+		point("a", -100), point("a", -200), point("a", 100), point("b", 0),
+	}}, now)
+	checkTimestamps("collect.b", &models.Points{Points: []*models.Point{
+		point("c", 300), {Timestamp: 0},
+	}}, now.Add(time.Second))
+
+	want := []SkewedHost{
+		{Host: "c", NS: "collect.b", Future: 1, LastSkew: 299, LastPoint: now.Unix() + 300, LastSeen: now.Add(time.Second)},
+		{Host: "unknown", NS: "collect.b", Past: 1, LastSkew: -now.Unix() - 1, LastPoint: 0, LastSeen: now.Add(time.Second)},
+		{Host: "a", NS: "collect.a", Past: 2, Future: 1, LastSkew: 100, LastPoint: now.Unix() + 100, LastSeen: now},
+	}
+	got := SkewedHosts()
+	// hosts seen at the same time have no order
+	if len(got) == 3 && got[0].Host == "unknown" {
+		got[0], got[1] = got[1], got[0]
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("skewed hosts %+v, want %+v", got, want)
+	}
+}
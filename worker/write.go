@@ -0,0 +1,111 @@
+package worker
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/lodastack/router/config"
+	"github.com/lodastack/router/influx"
+	"github.com/lodastack/router/loda"
+	"github.com/lodastack/router/migrate"
+	"github.com/lodastack/router/models"
+
+	"github.com/lodastack/log"
+)
+
+// WritePoints writes a points batch of namespace ns into its influxdbs.
+// It is shared by the NSQ consumers and the HTTP ingest path, a returned
+// error means the batch should be retried.
+func WritePoints(ns string, pointsObj models.Points) error {
+	if len(pointsObj.Points) == 0 {
+		return nil
+	}
+
+	influxdbs, err := loda.InfluxDBs(ns)
+	if err != nil {
+		return err
+	}
+
+	if len(influxdbs) == 0 {
+		log.Warningf("get empty influxdbs config, ignore the points")
+		return nil
+	}
+
+	var fp fingerprint
+	dedup := dedupFor(ns)
+	if dedup != nil {
+		if fp, err = pointsFingerprint(pointsObj); err != nil {
+			dedup = nil
+		} else if dedup.SeenOrAdd(fp, time.Now()) {
+			log.Infof("<%s> duplicate points abandoned", ns)
+			return nil
+		}
+	}
+
+	if n := checkTimestamps(ns, &pointsObj, time.Now()); n > 0 {
+		log.Warningf("<%s> %d points out of timestamp window, action: %s", ns, n, config.GetConfig().Timestamp.Action)
+		if len(pointsObj.Points) == 0 {
+			return nil
+		}
+	}
+
+	if err := influx.WritePoints(influxdbs, pointsObj); err != nil {
+		log.Errorf("<%s> post message to influxdbs %v failed: %s", ns, influxdbs, err.Error())
+		if dedup != nil {
+			dedup.Forget(fp)
+		}
+		return err
+	}
+	writeSource(ns, pointsObj)
+	return nil
+}
+
+// writeSource also writes the points to the cluster ns is migrated from,
+// until its history is copied. Failures only lose the old copy.
+func writeSource(ns string, pointsObj models.Points) {
+	src := migrate.Source(ns)
+	if src == nil {
+		return
+	}
+	if err := influx.WritePoints(src, pointsObj); err != nil {
+		log.Warningf("<%s> write points to migration source %v failed: %s", ns, src, err)
+	}
+}
+
+// ImportPoints writes a batch of exported points of namespace ns. Unlike
+// WritePoints it skips the dedup window and the timestamp policy, old
+// points are expected, and a point influxdb refuses fails the batch.
+func ImportPoints(ns string, pointsObj models.Points) error {
+	var lines bytes.Buffer
+	for _, p := range pointsObj.Points {
+		lines.WriteString(p.Line())
+		lines.WriteByte('\n')
+	}
+	return WriteLines(ns, "s", lines.Bytes())
+}
+
+// WriteLines writes line protocol of namespace ns, timestamps in
+// precision, as is. Lines are not deduplicated nor checked, any non 2xx
+// answer of influxdb is an error.
+func WriteLines(ns, precision string, lines []byte) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	influxdbs, err := loda.InfluxDBs(ns)
+	if err != nil {
+		return err
+	}
+	if len(influxdbs) == 0 {
+		return fmt.Errorf("%s has no route config", ns)
+	}
+	if err := influx.WriteLines(influxdbs, ns, precision, lines); err != nil {
+		return err
+	}
+	if src := migrate.Source(ns); src != nil {
+		if err := influx.WriteLines(src, ns, precision, lines); err != nil {
+			log.Warningf("<%s> write lines to migration source %v failed: %s", ns, src, err)
+		}
+	}
+	return nil
+}